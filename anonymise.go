@@ -0,0 +1,155 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netgo
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	LOG_ANONYMISE        = "LOG_ANONYMISE"
+	LOG_ANONYMISE_KEY    = "LOG_ANONYMISE_KEY"
+	LOG_ANONYMISE_PERIOD = "LOG_ANONYMISE_PERIOD"
+)
+
+// ANONYMOUS_PREFIX marks addresses replaced with a pseudonym.
+const ANONYMOUS_PREFIX = "anon-"
+
+type AnonymisationMode int
+
+const (
+	// Record addresses as is
+	ANONYMISE_NONE AnonymisationMode = iota
+	// Truncate IPv4 addresses to /24 and IPv6 addresses to /48
+	ANONYMISE_TRUNCATE
+	// Replace addresses with a pseudonym keyed by the period, so an address has the same pseudonym within a period and a different one in the next.
+	// This is keyed pseudonymisation rather than anonymisation, since anyone with the key can derive the pseudonym of any address in any period.
+	ANONYMISE_HMAC
+)
+
+// LogAnonymiser is applied to client addresses by LogRequest.
+var LogAnonymiser = &Anonymiser{}
+
+func ParseAnonymisationMode(s string) (AnonymisationMode, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return ANONYMISE_NONE, nil
+	case "truncate":
+		return ANONYMISE_TRUNCATE, nil
+	case "hmac":
+		return ANONYMISE_HMAC, nil
+	default:
+		return 0, fmt.Errorf("Unrecognized Anonymisation Mode: %s", s)
+	}
+}
+
+// Anonymiser removes identifying information from client addresses.
+type Anonymiser struct {
+	Mode   AnonymisationMode
+	Key    []byte
+	Period time.Duration
+}
+
+// NewAnonymiser creates an Anonymiser for the given mode.
+// If no key is given for ANONYMISE_HMAC a random key is generated, so pseudonyms cannot be reproduced once the process exits, and differ from those of any other process.
+func NewAnonymiser(mode AnonymisationMode, key []byte, period time.Duration) (*Anonymiser, error) {
+	if mode == ANONYMISE_HMAC && len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	if period <= 0 {
+		period = 24 * time.Hour
+	}
+	return &Anonymiser{
+		Mode:   mode,
+		Key:    key,
+		Period: period,
+	}, nil
+}
+
+// AnonymiserFromEnv creates an Anonymiser from the LOG_ANONYMISE (none, truncate, or hmac), LOG_ANONYMISE_KEY, and LOG_ANONYMISE_PERIOD (eg. 24h) environment variables.
+func AnonymiserFromEnv() (*Anonymiser, error) {
+	mode, err := ParseAnonymisationMode(os.Getenv(LOG_ANONYMISE))
+	if err != nil {
+		return nil, err
+	}
+	var period time.Duration
+	if p, ok := os.LookupEnv(LOG_ANONYMISE_PERIOD); ok {
+		period, err = time.ParseDuration(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewAnonymiser(mode, []byte(os.Getenv(LOG_ANONYMISE_KEY)), period)
+}
+
+// IsAnonymous returns true if the given IP address has already been replaced with a pseudonym.
+func IsAnonymous(ip string) bool {
+	return strings.HasPrefix(ip, ANONYMOUS_PREFIX)
+}
+
+// TruncateIP zeroes all but the first 24 bits of an IPv4 address, or all but the first 48 bits of an IPv6 address.
+func TruncateIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32))
+	}
+	return ip.Mask(net.CIDRMask(48, 128))
+}
+
+// AnonymiseIP anonymises an IP address seen at the given time.
+func (a *Anonymiser) AnonymiseIP(ip string, t time.Time) string {
+	switch a.Mode {
+	case ANONYMISE_TRUNCATE:
+		if parsed := net.ParseIP(ip); parsed != nil {
+			return TruncateIP(parsed).String()
+		}
+	case ANONYMISE_HMAC:
+		if IsAnonymous(ip) {
+			return ip
+		}
+		// Derive the key of the period containing the given time from the long lived key, which can derive it again
+		period := hmac.New(sha256.New, a.Key)
+		period.Write([]byte(strconv.FormatInt(t.UTC().Truncate(a.Period).Unix(), 10)))
+		mac := hmac.New(sha256.New, period.Sum(nil))
+		mac.Write([]byte(ip))
+		return ANONYMOUS_PREFIX + hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	return ip
+}
+
+// AnonymiseAddress anonymises the host part of a host:port address seen at the given time.
+func (a *Anonymiser) AnonymiseAddress(address string, t time.Time) string {
+	if a.Mode == ANONYMISE_NONE {
+		return address
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return a.AnonymiseIP(address, t)
+	}
+	return net.JoinHostPort(a.AnonymiseIP(host, t), port)
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netgo_test
+
+import (
+	"aletheiaware.com/netgo"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnonymiser(t *testing.T) {
+	now := time.Date(2022, 3, 4, 12, 0, 0, 0, time.UTC)
+	t.Run("None", func(t *testing.T) {
+		a, err := netgo.NewAnonymiser(netgo.ANONYMISE_NONE, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := a.AnonymiseAddress("192.0.2.123:4567", now); actual != "192.0.2.123:4567" {
+			t.Errorf("Incorrect address; expected '192.0.2.123:4567', got '%s'", actual)
+		}
+	})
+	t.Run("Truncate", func(t *testing.T) {
+		a, err := netgo.NewAnonymiser(netgo.ANONYMISE_TRUNCATE, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for address, expected := range map[string]string{
+			"192.0.2.123:4567":                "192.0.2.0:4567",
+			"[2001:db8:1234:5678::1]:4567":    "[2001:db8:1234::]:4567",
+			"192.0.2.123":                     "192.0.2.0",
+			"anon-0123456789abcdef:4567":      "anon-0123456789abcdef:4567",
+			"[::ffff:198.51.100.200]:4567":    "198.51.100.0:4567",
+			"[2001:db8:ffff:ffff:ffff::]:443": "[2001:db8:ffff::]:443",
+		} {
+			if actual := a.AnonymiseAddress(address, now); actual != expected {
+				t.Errorf("Incorrect address; expected '%s', got '%s'", expected, actual)
+			}
+		}
+	})
+	t.Run("HMAC", func(t *testing.T) {
+		a, err := netgo.NewAnonymiser(netgo.ANONYMISE_HMAC, []byte("secret"), 24*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := a.AnonymiseIP("192.0.2.123", now)
+		if !netgo.IsAnonymous(first) || strings.Contains(first, "192.0.2") {
+			t.Errorf("Incorrect pseudonym; got '%s'", first)
+		}
+		if same := a.AnonymiseIP("192.0.2.123", now.Add(time.Hour)); same != first {
+			t.Errorf("Pseudonym changed within period; expected '%s', got '%s'", first, same)
+		}
+		if next := a.AnonymiseIP("192.0.2.123", now.Add(24*time.Hour)); next == first {
+			t.Errorf("Pseudonym did not rotate; got '%s'", next)
+		}
+		if other := a.AnonymiseIP("192.0.2.124", now); other == first {
+			t.Errorf("Pseudonym collision; got '%s'", other)
+		}
+		if again := a.AnonymiseIP(first, now); again != first {
+			t.Errorf("Pseudonym anonymised again; expected '%s', got '%s'", first, again)
+		}
+	})
+}
@@ -0,0 +1,39 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"aletheiaware.com/netgo"
+	"aletheiaware.com/netgo/logdb"
+	"errors"
+	"time"
+)
+
+// Anonymise replaces the addresses of all requests recorded before the given time.
+func Anonymise(dsn string, anonymiser *netgo.Anonymiser, before time.Time) (int, error) {
+	if anonymiser.Mode == netgo.ANONYMISE_NONE {
+		return 0, errors.New("Anonymisation Mode Required")
+	}
+
+	store, err := logdb.Open(dsn)
+	if err != nil {
+		return 0, err
+	}
+	defer store.Close()
+
+	return store.Anonymise(before, anonymiser.AnonymiseIP)
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"aletheiaware.com/netgo/logdb"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// ListExclusions writes the name and expressions of each exclusion, in columns.
+func ListExclusions(dsn string, w io.Writer) error {
+	store, err := logdb.Open(dsn)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	exclusions, err := store.Exclusions()
+	if err != nil {
+		return err
+	}
+	t := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(t, "NAME\tADDRESS\tURL\tUSER AGENT\t")
+	for _, e := range exclusions {
+		name := e.Name
+		if e.BuiltIn {
+			name += " (built in)"
+		}
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t\n", name, e.Address, e.URL, e.UserAgent)
+	}
+	return t.Flush()
+}
+
+// SaveExclusion stores the exclusion, replacing any with the same name.
+func SaveExclusion(dsn string, e *logdb.Exclusion) error {
+	store, err := logdb.Open(dsn)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	return store.SaveExclusion(e)
+}
+
+// DeleteExclusion removes the named exclusion.
+func DeleteExclusion(dsn, name string) error {
+	store, err := logdb.Open(dsn)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	deleted, err := store.DeleteExclusion(name)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("Exclusion Not Found: %s", name)
+	}
+	return nil
+}
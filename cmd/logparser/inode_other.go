@@ -0,0 +1,26 @@
+//go:build !unix
+
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import "os"
+
+// fileInode returns 0 as inodes are unavailable, so replaced logs are only detected by truncation.
+func fileInode(info os.FileInfo) int64 {
+	return 0
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// STDIN_NAME is given in place of a directory to parse logs piped to standard input.
+const STDIN_NAME = "-"
+
+// STDIN_BLOCK is the most of the first line of standard input digested to recognise a log when it is piped again.
+const STDIN_BLOCK = 4096
+
+// decompressors wrap a reader of compressed data, keyed by the suffix of compressed files.
+var decompressors = map[string]func(io.Reader) (io.ReadCloser, error){
+	".gz": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	".zst": func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	},
+	".bz2": func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	},
+}
+
+// magics are the leading bytes of compressed data, keyed by the suffix of compressed files, to detect compressed standard input.
+var magics = map[string][]byte{
+	".gz":  {0x1f, 0x8b},
+	".zst": {0x28, 0xb5, 0x2f, 0xfd},
+	".bz2": []byte("BZh"),
+}
+
+// archiveSuffixes are the suffixes of tar archives, optionally compressed.
+var archiveSuffixes = []string{".tar", ".tar.gz", ".tgz", ".tar.zst", ".tar.bz2"}
+
+// compression returns the suffix of the compressed file, or "" if it is not compressed.
+func compression(name string) string {
+	if strings.HasSuffix(name, ".tgz") {
+		return ".gz"
+	}
+	if s := path.Ext(name); decompressors[s] != nil {
+		return s
+	}
+	return ""
+}
+
+// isArchive returns true if the named file is a tar archive.
+func isArchive(name string) bool {
+	for _, s := range archiveSuffixes {
+		if strings.HasSuffix(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// logName returns the name a log is recorded under, which is the same whether or not it has been compressed.
+func logName(name string) string {
+	if strings.HasSuffix(name, ".tgz") {
+		return strings.TrimSuffix(name, ".tgz") + ".tar"
+	}
+	return strings.TrimSuffix(name, compression(name))
+}
+
+// decompress wraps the reader with the decompressor for the named file, if it is compressed.
+func decompress(r io.Reader, name string) (io.ReadCloser, error) {
+	if d := decompressors[compression(name)]; d != nil {
+		return d(r)
+	}
+	return io.NopCloser(r), nil
+}
+
+// input is a decompressed file.
+type input struct {
+	io.ReadCloser
+	file *os.File
+}
+
+// openInput opens the named file, decompressing it if compressed.
+func openInput(name string) (*input, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decompress(f, name)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &input{
+		ReadCloser: r,
+		file:       f,
+	}, nil
+}
+
+func (i *input) Close() error {
+	err := i.ReadCloser.Close()
+	if e := i.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// spoolStdin copies standard input to a temporary file, decompressing it if compressed, so it can be read like any other log.
+// The log is recorded under the given name followed by a digest of its first line, so a log piped again resumes where it was parsed up to, while a different log is parsed from the beginning.
+func spoolStdin(name string) (string, string, error) {
+	f, err := os.CreateTemp("", "logparser-stdin-")
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	if err := copyDecompressed(f, os.Stdin); err != nil {
+		os.Remove(f.Name())
+		return "", "", err
+	}
+	if err := f.Sync(); err != nil {
+		os.Remove(f.Name())
+		return "", "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		os.Remove(f.Name())
+		return "", "", err
+	}
+	// Lines longer than the block are only digested up to it
+	line, err := bufio.NewReaderSize(f, STDIN_BLOCK).ReadSlice('\n')
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		os.Remove(f.Name())
+		return "", "", err
+	}
+	digest := sha256.Sum256(bytes.TrimSuffix(line, []byte("\n")))
+	return f.Name(), name + "@" + hex.EncodeToString(digest[:8]), nil
+}
+
+// copyDecompressed copies the reader to the writer, decompressing it if it starts with the magic bytes of a compression format.
+func copyDecompressed(w io.Writer, r io.Reader) error {
+	b := bufio.NewReader(r)
+	// Shorter input is not compressed
+	head, _ := b.Peek(4)
+	for suffix, magic := range magics {
+		if bytes.HasPrefix(head, magic) {
+			d, err := decompressors[suffix](b)
+			if err != nil {
+				return err
+			}
+			defer d.Close()
+			_, err = io.Copy(w, d)
+			return err
+		}
+	}
+	_, err := io.Copy(w, b)
+	return err
+}
@@ -17,27 +17,260 @@
 package main
 
 import (
+	"aletheiaware.com/netgo"
+	"aletheiaware.com/netgo/logdb"
+	"context"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path"
+	"runtime"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
 )
 
+// EXCLUSION_USAGE describes the commands managing the exclusions applied by logserver.
+const EXCLUSION_USAGE = "logparser exclusion <list|set <name> <address> <url> <user-agent>|delete <name>>"
+
 var sqlite = flag.String("sqlite", "log.db", "Sqlite Database Name")
-var sources = flag.String("sources", "log.go:", "Log Sources")
+var dsn = flag.String("dsn", "", "Database DSN (eg. postgres://user@host/logs or duckdb://log.duckdb), overrides -sqlite")
+var sources = flag.String("sources", "log.go:", "Log Sources (for logs written before request entries were tagged)")
+var redactHeaders = flag.String("redact-headers", strings.Join(netgo.DefaultRedactedHeaders, ","), "Headers to Redact (empty to disable)")
+var redactMode = flag.String("redact-mode", "mask", "Header Redaction Mode (drop, mask, or hash with key from "+netgo.LOG_REDACT_KEY+")")
+var anonymise = flag.String("anonymise", "none", "Address Anonymisation Mode (none, truncate, or hmac with key from "+netgo.LOG_ANONYMISE_KEY+")")
+var anonymisePeriod = flag.Duration("anonymise-period", 24*time.Hour, "Period after which Address Pseudonyms Change")
+var batch = flag.Int("batch", 0, "Number of Lines Inserted per Transaction (0 to insert each log in one transaction)")
+var workers = flag.Int("workers", runtime.NumCPU(), "Number of Workers Parsing Lines, and of Logs Read Concurrently (inserts are serialised, in order)")
+var follow = flag.Bool("follow", false, "Continuously Parse New Requests")
+var interval = flag.Duration("interval", time.Second, "Follow Polling Interval")
+var stdinName = flag.String("stdin-name", "stdin", "Log Name Recorded for Standard Input, Followed by a Digest of its First Line")
+var include = flag.String("include", "", "Glob Patterns of Logs to Parse (empty for all)")
+var exclude = flag.String("exclude", "*.swp,*.swo,*~,*.tmp", "Glob Patterns of Logs and Subdirectories to Skip")
+var modifiedSince = flag.String("modified-since", "", "Skip Logs Last Modified Before a Duration Ago or Date (eg. 72h or 2022-03-04)")
+var tag = flag.Bool("tag", false, "Tag Logs with the Top Level Subdirectory they are in (eg. host1 for host1/nginx/access.log)")
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: logparser [flags] [[format:]directory|-...]")
+		fmt.Fprintln(flag.CommandLine.Output(), "       logparser -anonymise <truncate|hmac> anonymise <days>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       logparser migrate")
+		fmt.Fprintln(flag.CommandLine.Output(), "       "+EXCLUSION_USAGE)
+		fmt.Fprintln(flag.CommandLine.Output(), "Formats: netgo, combined (Apache/nginx Common or Combined Log Format), vhost_combined (Apache), caddy, w3c; detected when omitted")
+		fmt.Fprintln(flag.CommandLine.Output(), "Logs may be compressed (.gz, .zst, .bz2) or archived (.tar, .tar.gz, .tgz, .tar.zst, .tar.bz2), and - reads standard input")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	if err := run(logger, flag.Args()); err != nil {
+		logger.Error("Failed", "error", err)
+		os.Exit(1)
+	}
+}
 
-	logs := flag.Args()
+func run(logger *slog.Logger, args []string) error {
+	mode, err := netgo.ParseRedactionMode(*redactMode)
+	if err != nil {
+		return err
+	}
+	redaction, err := netgo.NewRedactionPolicy(mode, strings.Split(*redactHeaders, ","), []byte(os.Getenv(netgo.LOG_REDACT_KEY)))
+	if err != nil {
+		return err
+	}
+
+	database := *dsn
+	if database == "" {
+		database = *sqlite
+	}
+
+	am, err := netgo.ParseAnonymisationMode(*anonymise)
+	if err != nil {
+		return err
+	}
+	key := []byte(os.Getenv(netgo.LOG_ANONYMISE_KEY))
+	if am == netgo.ANONYMISE_HMAC && len(key) == 0 {
+		// A random key is generated, so the same address is given a different pseudonym by each run
+		logger.Warn("Anonymisation Key Not Set, Pseudonyms will Differ between Runs", "env", netgo.LOG_ANONYMISE_KEY)
+	}
+	anonymiser, err := netgo.NewAnonymiser(am, key, *anonymisePeriod)
+	if err != nil {
+		return err
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "anonymise":
+			// Anonymise addresses older than the given number of days
+			if len(args) != 2 {
+				return errors.New("Usage: logparser -anonymise <truncate|hmac> anonymise <days>")
+			}
+			days := netgo.ParseInt(args[1], logger)
+			if days <= 0 {
+				return fmt.Errorf("Invalid Number of Days: %s", args[1])
+			}
+			count, err := Anonymise(database, anonymiser, time.Now().AddDate(0, 0, -int(days)))
+			if err != nil {
+				return err
+			}
+			logger.Info("Anonymised Records", "count", count)
+			return nil
+		case "migrate":
+			// Migrate the database to the latest version, without parsing
+			if len(args) != 1 {
+				return errors.New("Usage: logparser migrate")
+			}
+			dialect, name, err := logdb.ParseDSN(database)
+			if err != nil {
+				return err
+			}
+			store, err := logdb.OpenSQL(dialect, name)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			count, err := store.Migrate()
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				// Reclaim the space freed by the migrations
+				if err := store.Vacuum(); err != nil {
+					return err
+				}
+			}
+			version, err := store.Version()
+			if err != nil {
+				return err
+			}
+			logger.Info("Migrated Database", "count", count, "version", version)
+			return nil
+		case "exclusion":
+			// Manage the exclusions applied by logserver, where an empty expression matches anything
+			switch {
+			case len(args) == 2 && args[1] == "list":
+				return ListExclusions(database, os.Stdout)
+			case len(args) == 6 && args[1] == "set":
+				if err := SaveExclusion(database, &logdb.Exclusion{
+					Name:      args[2],
+					Address:   args[3],
+					URL:       args[4],
+					UserAgent: args[5],
+				}); err != nil {
+					return err
+				}
+				logger.Info("Saved Exclusion", "name", args[2])
+				return nil
+			case len(args) == 3 && args[1] == "delete":
+				if err := DeleteExclusion(database, args[2]); err != nil {
+					return err
+				}
+				logger.Info("Deleted Exclusion", "name", args[2])
+				return nil
+			}
+			return errors.New("Usage: " + EXCLUSION_USAGE)
+		}
+	}
+
+	// Directories may be prefixed by the format of their logs, eg. caddy:/var/log/caddy
+	ss := strings.Split(*sources, ",")
+	formats := make(map[string]netgo.LogFormat)
+	var logs []string
+	for _, a := range args {
+		if i := strings.IndexByte(a, ':'); i > 0 {
+			if f, err := netgo.ParseLogFormat(a[:i], ss); err == nil {
+				a = a[i+1:]
+				formats[a] = f
+			}
+		}
+		logs = append(logs, a)
+	}
 	if len(logs) == 0 {
-		logs = append(logs, "logs")
+		store, ok := os.LookupEnv("LOG_DIRECTORY")
+		if !ok {
+			store = "logs"
+		}
+		logs = append(logs, store)
 	}
 
-	count, err := Parse(*sqlite, strings.Split(*sources, ","), logs)
+	includes, err := parseGlobs(*include)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	excludes, err := parseGlobs(*exclude)
+	if err != nil {
+		return err
+	}
+	since, err := parseSince(*modifiedSince, time.Now())
+	if err != nil {
+		return err
+	}
+
+	options := &Options{
+		Sources:       ss,
+		Formats:       formats,
+		Include:       includes,
+		Exclude:       excludes,
+		ModifiedSince: since,
+		Tag:           *tag,
+		Redaction:     redaction,
+		Anonymiser:    anonymiser,
+		BatchSize:     *batch,
+		Workers:       *workers,
+		StdinName:     *stdinName,
+		Logger:        logger,
+	}
+
+	if *follow {
+		if slices.Contains(logs, STDIN_NAME) {
+			return errors.New("Cannot Follow Standard Input")
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return Follow(ctx, database, logs, options, *interval)
+	}
+
+	count, err := Parse(database, logs, options)
+	if err != nil {
+		return err
+	}
+	logger.Info(fmt.Sprintf("Parsed %d Records", count))
+	return nil
+}
+
+// parseGlobs returns the comma separated glob patterns.
+func parseGlobs(s string) ([]string, error) {
+	var patterns []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("Invalid Glob Pattern: %s", p)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// parseSince returns the time a duration before now, or the given date or RFC 3339 time, or the zero time if empty.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
 	}
-	log.Println("Parsed", count, "Records")
+	return time.Time{}, fmt.Errorf("Invalid Modified Since: %s", s)
 }
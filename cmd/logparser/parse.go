@@ -18,182 +18,914 @@ package main
 
 import (
 	"aletheiaware.com/netgo"
+	"aletheiaware.com/netgo/logdb"
+	"archive/tar"
 	"bufio"
-	"database/sql"
-	_ "github.com/mattn/go-sqlite3"
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	CREATE_FILES_QUERY = `CREATE TABLE IF NOT EXISTS tbl_files (
-    id INTEGER NOT NULL PRIMARY KEY,
-    name TEXT NOT NULL UNIQUE
-);`
-	CREATE_REQUESTS_QUERY = `CREATE TABLE IF NOT EXISTS tbl_requests (
-    id INTEGER NOT NULL PRIMARY KEY,
-    file INT NULL,
-    timestamp INT UNSIGNED NOT NULL,
-    source TEXT,
-    address TEXT,
-    protocol TEXT,
-    method TEXT,
-    host TEXT,
-    url TEXT,
-    FOREIGN KEY (file) REFERENCES tbl_files(id)
-);`
-	CREATE_HEADERS_QUERY = `CREATE TABLE IF NOT EXISTS tbl_headers (
-	id INTEGER NOT NULL PRIMARY KEY,
-	request INT NULL,
-	key TEXT,
-	value TEXT,
-	FOREIGN KEY (request) REFERENCES tbl_requests(id)
-);`
-	SELECT_FILE_QUERY = `SELECT * FROM tbl_files WHERE name = ?;`
-	INSERT_FILE_QUERY = `INSERT INTO tbl_files
-(name)
-VALUES
-(?);`
-	INSERT_REQUEST_QUERY = `INSERT INTO tbl_requests
-(file, timestamp, source, address, protocol, method, host, url)
-VALUES
-(?, ?, ?, ?, ?, ?, ?, ?);`
-	INSERT_HEADER_QUERY = `INSERT INTO tbl_headers
-(request, key, value)
-VALUES
-(?, ?, ?);`
+	// Number of lines between reports of progress through a log
+	PROGRESS_LINES = 100000
+	// Number of lines parsed together by a worker
+	BATCH_LINES = 1024
 )
 
-func Parse(name string, sources, dirs []string) (int, error) {
-	// Create sqlite database
-	db, err := openDatabase(name)
+// Options controls how logs are parsed.
+type Options struct {
+	// Prefixes identifying request lines written by netgo before entries were tagged
+	Sources []string
+	// Format of the logs in each directory, logs in other directories have their format detected
+	Formats map[string]netgo.LogFormat
+	// Glob patterns of the logs to parse, or empty to parse all
+	Include []string
+	// Glob patterns of the logs and subdirectories to skip
+	Exclude []string
+	// Logs last modified before are skipped
+	ModifiedSince time.Time
+	// Whether logs are tagged with the top level subdirectory they are in, such as the host of host1/nginx/access.log
+	Tag bool
+	// Policy applied to header values
+	Redaction *netgo.RedactionPolicy
+	// Anonymisation applied to client addresses
+	Anonymiser *netgo.Anonymiser
+	// Number of lines inserted in each transaction, or 0 to insert each log in a single transaction
+	BatchSize int
+	// Number of workers parsing lines, and of logs read concurrently, while a single writer inserts them in order
+	Workers int
+	// Name recorded for logs piped to standard input, followed by a digest of their first line
+	StdinName string
+	Logger    *slog.Logger
+}
+
+// Parse parses the lines appended to each log in the given directories and their subdirectories since it was last parsed.
+func Parse(dsn string, dirs []string, options *Options) (int, error) {
+	// Open database, creating or migrating it as needed
+	store, err := logdb.Open(dsn)
 	if err != nil {
 		return 0, err
 	}
-	defer db.Close()
+	defer store.Close()
 
 	os.Remove(".ignored")
 	// Create file of ignored logs
 	ignored, err := os.Create(".ignored")
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
 	defer ignored.Close()
 
-	var count int
-	for _, dir := range dirs {
-		// Scan directory for logs
-		ls, err := os.ReadDir(dir)
+	count, err := parseDirs(store, dirs, options, ignored)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := ignored.Sync(); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// Follow parses the logs in the given directories every interval, until the context is cancelled.
+func Follow(ctx context.Context, dsn string, dirs []string, options *Options, interval time.Duration) error {
+	// Open database, creating or migrating it as needed
+	store, err := logdb.Open(dsn)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	// Append to file of ignored logs
+	ignored, err := os.OpenFile(".ignored", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer ignored.Close()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		count, err := parseDirs(store, dirs, options, ignored)
 		if err != nil {
-			return 0, err
+			return err
 		}
+		if count > 0 {
+			options.Logger.Info(fmt.Sprintf("Parsed %d Records", count))
+		}
+		select {
+		case <-ctx.Done():
+			return ignored.Sync()
+		case <-ticker.C:
+		}
+	}
+}
 
-		for _, l := range ls {
-			name := path.Join(dir, l.Name())
-			// Check if file has already been parsed
-			row := db.QueryRow(SELECT_FILE_QUERY, name)
-			var (
-				id int
-				n  string
-			)
-			err := row.Scan(&id, &n)
-			if err == nil {
-				// File already parsed
-				continue
-			} else if err != sql.ErrNoRows {
+// logState records where parsing of a log resumes.
+type logState struct {
+	// Log as recorded, with an ID of 0 if it has not been seen before
+	logdb.File
+	// File read, which differs from the name when compressed or piped to standard input
+	path string
+	// Size in bytes, or 0 if unknown until decompressed
+	size int64
+	// Whether the log is no longer written, so a final line without a newline is complete
+	complete bool
+	// Format of the log, or nil to detect
+	format netgo.LogFormat
+	// Logs recorded from within an archive, by name
+	members map[string]*logState
+}
+
+// logEntry is a line read from a log by a worker.
+type logEntry struct {
+	// Log the following entries are read from, when a worker reads several logs from an archive
+	file *logState
+	// Offset of the end of the line
+	offset int64
+	// Line number, counting from 1
+	line   int64
+	record *netgo.RequestRecord
+	// Non-request line
+	ignored string
+	err     error
+}
+
+// logBatch is a run of lines read from a log, parsed by any worker, and written in the order they were read.
+type logBatch struct {
+	// Log the lines are read from
+	state  *logState
+	parser netgo.LineParser
+	lines  []string
+	// Entry for each line, or a single entry which is not a line
+	entries []*logEntry
+	// Closed once the lines have been parsed
+	parsed chan struct{}
+}
+
+// newEntryBatch returns a parsed batch of the single entry.
+func newEntryBatch(e *logEntry) *logBatch {
+	b := &logBatch{
+		entries: []*logEntry{e},
+		parsed:  make(chan struct{}),
+	}
+	close(b.parsed)
+	return b
+}
+
+// parse parses each of the batch's lines into its entry.
+func (b *logBatch) parse(options *Options) {
+	for i, line := range b.lines {
+		parseLine(options, b.state, line, b.parser, b.entries[i])
+	}
+	close(b.parsed)
+}
+
+// parseDirs parses the logs in the given directories, or standard input if a directory is "-".
+// Up to options.Workers logs are read concurrently, and their lines are parsed in batches by a pool of options.Workers workers, while a single writer inserts the entries in directory order, so the database is the same regardless of concurrency.
+// Batches of a large log are parsed in parallel ahead of the writer, so only inserts are serial; lines of logs configured by directives are parsed in order as they are read.
+func parseDirs(store logdb.Store, dirs []string, options *Options, ignored io.Writer) (int, error) {
+	var states []*logState
+	// Logs are recorded under the same name when compressed, so only the first of a compressed and uncompressed copy is read
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		if dir == STDIN_NAME {
+			spool, name, err := spoolStdin(options.StdinName)
+			if err != nil {
 				return 0, err
 			}
-			c, err := parseLog(db, sources, name, func(l string) {
-				if _, err := ignored.WriteString(l + "\n"); err != nil {
-					log.Fatal(err)
-				}
-			})
+			defer os.Remove(spool)
+			state, err := newLogState(name, spool)
 			if err != nil {
 				return 0, err
 			}
-			log.Println(name, c)
-			count += c
+			// Piped logs are complete, and cannot be replaced
+			state.complete = true
+			state.Inode = 0
+			if state, err = loadLogState(store, options, state); err != nil {
+				return 0, err
+			}
+			if state != nil {
+				state.format = options.Formats[dir]
+				states = append(states, state)
+			}
+			continue
+		}
+
+		// Walk directory for logs
+		if err := walkLogs(dir, options, func(name, tag string) error {
+			if seen[logName(name)] {
+				options.Logger.Debug("Skipping Copy of Log", "name", name)
+				return nil
+			}
+			seen[logName(name)] = true
+			state, err := newLogState(logName(name), name)
+			if err != nil {
+				return err
+			}
+			state.Tag = tag
+			if state, err = loadLogState(store, options, state); err != nil {
+				return err
+			}
+			if state != nil {
+				state.format = options.Formats[dir]
+				states = append(states, state)
+			}
+			return nil
+		}); err != nil {
+			return 0, err
 		}
 	}
 
-	if err := ignored.Sync(); err != nil {
-		log.Fatal(err)
+	workers := options.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	batches := make([]chan *logBatch, len(states))
+	for i := range batches {
+		// Read far enough ahead of the writer to keep every worker parsing
+		batches[i] = make(chan *logBatch, 2*workers)
+	}
+	parse := make(chan *logBatch, workers)
+	var parsers sync.WaitGroup
+	for range workers {
+		parsers.Add(1)
+		go func() {
+			defer parsers.Done()
+			for b := range parse {
+				b.parse(options)
+			}
+		}()
 	}
+	var group sync.WaitGroup
+	group.Add(1)
+	go func() {
+		defer group.Done()
+		// Start workers in order, so the log being written always has a worker
+		limit := make(chan struct{}, workers)
+		for i, state := range states {
+			select {
+			case limit <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			group.Add(1)
+			go func() {
+				defer group.Done()
+				defer func() { <-limit }()
+				readLog(ctx, options, state, parse, batches[i])
+			}()
+		}
+	}()
+	defer func() {
+		// Stop readers blocked sending to the writer, and wait for them and the workers before returning
+		cancel()
+		group.Wait()
+		close(parse)
+		parsers.Wait()
+	}()
 
+	var count int
+	for i, state := range states {
+		c, err := writeLog(store, options, state, batches[i], func(l string) error {
+			_, err := io.WriteString(ignored, l+"\n")
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		if c > 0 {
+			options.Logger.Info("Parsed Log", "name", state.Name, "count", c)
+		}
+		count += c
+	}
 	return count, nil
 }
 
-func parseLog(db *sql.DB, sources []string, name string, onIgnore func(string)) (int, error) {
-	f, err := os.Open(name)
+// walkLogs calls fn with the path and tag of each log within the directory and its subdirectories, in lexical order.
+// If options.Tag is set, the tag is the first subdirectory of the log's path, otherwise it is empty.
+// Hidden files and directories are skipped, as are those matching options.Exclude, logs not matching options.Include, and logs last modified before options.ModifiedSince.
+func walkLogs(dir string, options *Options, fn func(name, tag string) error) error {
+	return filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if strings.HasPrefix(entry.Name(), ".") || matchGlobs(options.Exclude, rel) {
+			// Skip hidden files, such as logs being compressed, and excluded files
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		// Follow symbolic links to logs
+		info, err := os.Stat(name)
+		if err != nil {
+			options.Logger.Warn("Skipping Unreadable Log", "name", name, "error", err)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			options.Logger.Debug("Skipping Irregular File", "name", name)
+			return nil
+		}
+		if len(options.Include) > 0 && !matchGlobs(options.Include, rel) {
+			return nil
+		}
+		if info.ModTime().Before(options.ModifiedSince) {
+			options.Logger.Debug("Skipping Unmodified Log", "name", name)
+			return nil
+		}
+		var tag string
+		if options.Tag {
+			if dir, _, ok := strings.Cut(rel, "/"); ok {
+				tag = dir
+			}
+		}
+		return fn(name, tag)
+	})
+}
+
+// matchGlobs returns true if the slash separated path relative to a log directory matches any of the patterns.
+// Patterns containing a slash are matched against the whole path, others against its last element.
+func matchGlobs(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		name := rel
+		if !strings.Contains(p, "/") {
+			name = path.Base(rel)
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// newLogState returns the state of a log recorded under the given name and read from the given path.
+func newLogState(name, p string) (*logState, error) {
+	info, err := os.Stat(p)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	state := &logState{
+		File: logdb.File{
+			Name:  name,
+			Inode: fileInode(info),
+		},
+		path: p,
+		size: info.Size(),
+	}
+	if compression(p) != "" {
+		state.complete = true
+		if !isArchive(p) {
+			// Offsets are into the decompressed log
+			state.size = 0
+		}
+	}
+	return state, nil
+}
+
+// loadLogState returns where parsing of the log resumes from the recorded offset, or nil if there is nothing new to parse.
+// Parsing restarts from the beginning if the file has been truncated, or replaced by a file with a different inode.
+// Compressed logs and archives are read again only once they have a different inode, since they have to be decompressed to find anything new.
+// A log not seen before under its name resumes from the offset of the log it was renamed from, such as app.log rotated to app.log.1.
+func loadLogState(store logdb.Store, options *Options, state *logState) (*logState, error) {
+	file, err := store.File(state.Name)
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		renamed, err := renamedLog(store, state)
+		if err != nil {
+			return nil, err
+		}
+		if renamed != nil {
+			options.Logger.Info("Log Renamed", "name", state.Name, "from", renamed.Name)
+			state.Offset = renamed.Offset
+			state.Lines = renamed.Lines
+		}
+	} else {
+		previous := file.Inode
+		state.ID = file.ID
+		state.Offset = file.Offset
+		state.Lines = file.Lines
+		if !options.Tag {
+			state.Tag = file.Tag
+		} else if state.Tag != file.Tag {
+			// Moved to another subdirectory, or tagged for the first time, so tag the log even if there is nothing new to parse
+			file.Tag = state.Tag
+			if err := store.UpdateFile(file); err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case isArchive(state.path):
+			if state.Offset == state.size && state.Inode == previous {
+				// Nothing new
+				return nil, nil
+			}
+		case compression(state.path) != "":
+			if state.Inode != 0 && state.Inode == previous {
+				// Nothing new since the log was compressed
+				return nil, nil
+			}
+			if state.Offset < 0 {
+				// Parsed completely before offsets were recorded, and compressed since
+				return nil, completeLogState(store, state)
+			}
+		case state.Offset < 0:
+			// Parsed completely before offsets were recorded
+			return nil, completeLogState(store, state)
+		case state.Inode != 0 && previous != 0 && state.Inode != previous:
+			options.Logger.Info("Log Replaced", "name", state.Name)
+			state.Offset = 0
+			state.Lines = 0
+		case state.size < state.Offset:
+			options.Logger.Info("Log Truncated", "name", state.Name)
+			state.Offset = 0
+			state.Lines = 0
+		case state.size == state.Offset:
+			// Nothing new
+			return nil, nil
+		}
+	}
+	if isArchive(state.path) {
+		files, err := store.ArchiveFiles(state.Name)
+		if err != nil {
+			return nil, err
+		}
+		state.members = make(map[string]*logState, len(files))
+		for _, f := range files {
+			state.members[f.Name] = &logState{
+				File:     *f,
+				complete: true,
+			}
+		}
+	}
+	return state, nil
+}
+
+// renamedLog returns the log recorded in the same directory with the inode of the uncompressed log, which has since been renamed, or nil if there is none.
+func renamedLog(store logdb.Store, state *logState) (*logdb.File, error) {
+	if state.Inode == 0 || compression(state.path) != "" {
+		return nil, nil
+	}
+	files, err := store.InodeFiles(state.Inode)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.Offset < 0 || f.Offset > state.size || filepath.Dir(f.Name) != filepath.Dir(state.Name) {
+			continue
+		}
+		if info, err := os.Stat(f.Name); err == nil && fileInode(info) == state.Inode {
+			// Still under the recorded name, so this is a link rather than a rename
+			continue
+		}
+		return f, nil
+	}
+	return nil, nil
+}
+
+// completeLogState records the log as parsed up to its end.
+func completeLogState(store logdb.Store, state *logState) error {
+	size, lines, err := countLines(state.path)
+	if err != nil {
+		return err
+	}
+	state.Offset = size
+	state.Lines = lines
+	return store.UpdateFile(&state.File)
+}
+
+// readLog reads the lines of the log after the state's offset, sending batches of them to be parsed and then written until the context is cancelled.
+func readLog(ctx context.Context, options *Options, state *logState, parse, batches chan<- *logBatch) {
+	defer close(batches)
+	r := &logReader{
+		ctx:     ctx,
+		options: options,
+		parse:   parse,
+		batches: batches,
+	}
+	var err error
+	switch {
+	case isArchive(state.path):
+		err = r.readArchive(state)
+	case compression(state.path) != "":
+		err = r.readCompressed(state)
+	default:
+		err = r.readFile(state)
+	}
+	if err != nil && ctx.Err() == nil {
+		r.send(&logEntry{err: err})
+	}
+}
+
+// logReader sends the batches read from a log to the workers and the writer.
+type logReader struct {
+	ctx     context.Context
+	options *Options
+	// Batches to parse, shared by the readers of all logs
+	parse chan<- *logBatch
+	// Batches to write, in the order they were read
+	batches chan<- *logBatch
+}
+
+// send sends the entry to the writer, returning an error if the context is cancelled first.
+func (r *logReader) send(e *logEntry) error {
+	return r.write(newEntryBatch(e))
+}
+
+// write sends the batch to the writer, returning an error if the context is cancelled first.
+func (r *logReader) write(b *logBatch) error {
+	select {
+	case r.batches <- b:
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+// submit sends the batch to be parsed, and then written, returning an error if the context is cancelled first.
+// Parsers configured by directives depend on the lines before, so their batches are parsed here in order.
+func (r *logReader) submit(b *logBatch) error {
+	if _, ok := b.parser.(netgo.DirectiveParser); ok {
+		b.parse(r.options)
+	} else {
+		select {
+		case r.parse <- b:
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+	return r.write(b)
+}
+
+// readFile parses the log from the state's offset.
+// A trailing partial line is left for the next parse, unless the log is complete.
+func (r *logReader) readFile(state *logState) error {
+	f, err := os.Open(state.path)
+	if err != nil {
+		return err
 	}
 	defer f.Close()
 
-	result, err := db.Exec(INSERT_FILE_QUERY, name)
+	format := state.format
+	if format == nil {
+		if format, err = detectFormat(f, r.options); err != nil {
+			return err
+		}
+	}
+	parser := format.NewParser()
+	start := state.Offset
+	if _, ok := parser.(netgo.DirectiveParser); ok {
+		// Parse the directives before the offset again
+		start = 0
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = r.parseLines(state, f, start, parser)
+	return err
+}
+
+// readCompressed decompresses the log, and parses the lines after the state's offset.
+// Parsing restarts from the beginning if the decompressed log is shorter than the offset.
+func (r *logReader) readCompressed(state *logState) error {
+	in, err := openInput(state.path)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	fileId, err := result.LastInsertId()
+	defer in.Close()
+	end, err := r.parseLines(state, in, 0, nil)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	if end < state.Offset {
+		r.options.Logger.Info("Log Truncated", "name", state.Name)
+		restart := *state
+		restart.Offset = 0
+		restart.Lines = 0
+		return r.readCompressed(&restart)
 	}
+	return nil
+}
 
-	var count int
-	scanner := bufio.NewScanner(f)
-	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
+// readArchive parses the logs within the archive, sending an entry for each log before its lines, and finally one to mark the archive as read.
+func (r *logReader) readArchive(state *logState) error {
+	in, err := openInput(state.path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	archive := tar.NewReader(in)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || strings.HasPrefix(path.Base(header.Name), ".") {
 			continue
 		}
-		if netgo.IsRequestLog(sources, line) {
-			timestamp, request, headers, err := netgo.ParseRequestLog(line)
-			if err != nil {
-				return 0, err
+		name := logName(path.Join(state.Name, path.Clean("/"+header.Name)))
+		member, ok := state.members[name]
+		if !ok {
+			member = &logState{
+				File: logdb.File{
+					Name: name,
+				},
+				complete: true,
 			}
-			result, err := db.Exec(INSERT_REQUEST_QUERY, fileId, timestamp, request[0], request[1], request[2], request[3], request[4], request[5])
-			if err != nil {
-				return 0, err
+		}
+		member.Tag = state.Tag
+		member.format = state.format
+		if compression(header.Name) == "" {
+			if member.Offset >= header.Size {
+				// Nothing new
+				continue
 			}
-			requestId, err := result.LastInsertId()
-			if err != nil {
-				return 0, err
+			member.size = header.Size
+		}
+		if err := r.send(&logEntry{file: member}); err != nil {
+			return err
+		}
+		m, err := decompress(archive, header.Name)
+		if err != nil {
+			return err
+		}
+		end, err := r.parseLines(member, m, 0, nil)
+		if err != nil {
+			return err
+		}
+		if end < member.Offset {
+			r.options.Logger.Warn("Log Shorter than Recorded Offset", "name", name, "offset", member.Offset)
+		}
+	}
+	if err := r.send(&logEntry{file: state}); err != nil {
+		return err
+	}
+	return r.send(&logEntry{offset: state.size})
+}
+
+// parseLines reads the lines from the reader, which starts at the given offset into the log, sending batches of the lines after the state's offset to be parsed.
+// Lines before the state's offset are only parsed if they are directives, and the parser is detected from the first line if nil.
+// Returns the offset reached.
+func (r *logReader) parseLines(state *logState, in io.Reader, start int64, parser netgo.LineParser) (int64, error) {
+	if parser == nil && state.format != nil {
+		parser = state.format.NewParser()
+	}
+	offset := start
+	number := state.Lines
+	batch := &logBatch{state: state}
+	// flush sends the lines batched so far
+	flush := func() error {
+		if len(batch.lines) == 0 {
+			return nil
+		}
+		batch.parser = parser
+		batch.parsed = make(chan struct{})
+		if err := r.submit(batch); err != nil {
+			return err
+		}
+		batch = &logBatch{state: state}
+		return nil
+	}
+	reader := bufio.NewReaderSize(in, 64*1024)
+	for {
+		l, err := reader.ReadString('\n')
+		if err == io.EOF && (l == "" || !state.complete) {
+			// Partial line is still being written
+			return offset, flush()
+		} else if err != nil && err != io.EOF {
+			return offset, err
+		}
+		offset += int64(len(l))
+		line := strings.TrimSpace(l)
+		if parser == nil && line != "" {
+			format := netgo.DetectLogFormat(netgo.LogFormats(r.options.Sources), line)
+			if format == nil {
+				format = &netgo.NetgoFormat{Sources: r.options.Sources}
 			}
-			for k, v := range headers {
-				if _, err := db.Exec(INSERT_HEADER_QUERY, requestId, k, v); err != nil {
-					return 0, err
+			parser = format.NewParser()
+		}
+		// Lines before the offset have been parsed, which excludes the newline if it was a complete log's final line
+		end := offset
+		if strings.HasSuffix(l, "\n") {
+			end--
+		}
+		if end <= state.Offset {
+			if d, ok := parser.(netgo.DirectiveParser); ok && d.IsDirective(line) {
+				if _, err := d.Parse(line); err != nil {
+					return offset, err
 				}
 			}
-			count++
 		} else {
-			onIgnore(line)
+			number++
+			batch.lines = append(batch.lines, line)
+			batch.entries = append(batch.entries, &logEntry{
+				offset: offset,
+				line:   number,
+			})
+			if len(batch.lines) >= BATCH_LINES {
+				if err := flush(); err != nil {
+					return offset, err
+				}
+			}
+		}
+		if err == io.EOF {
+			return offset, flush()
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return 0, err
+}
+
+// parseLine parses the line into its entry.
+func parseLine(options *Options, state *logState, line string, parser netgo.LineParser, entry *logEntry) {
+	number := entry.line
+	if line == "" {
+		// Blank line only advances the offset
+	} else if record, err := parser.Parse(line); err != nil {
+		// Record why the line was ignored, in the form name:line:column: reason: line
+		var p *netgo.ParseError
+		if errors.As(err, &p) {
+			// Parsers only see the line, so its number is set here
+			p.Line = int(number)
+			entry.ignored = fmt.Sprintf("%s:%d:%d: %s: %s", state.Name, p.Line, p.Column, p.Reason, line)
+		} else {
+			entry.ignored = fmt.Sprintf("%s:%d: %s: %s", state.Name, number, err, line)
+		}
+	} else if record != nil {
+		record.IP = options.Anonymiser.AnonymiseIP(record.IP, record.Time)
+		record.Header = options.Redaction.RedactHeader(record.Header)
+		entry.record = record
+	} else {
+		entry.ignored = line
 	}
-	return count, nil
 }
 
-func openDatabase(name string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", name)
+// detectFormat returns the format of the log detected from its first line, defaulting to netgo's own format.
+func detectFormat(f io.Reader, options *Options) (netgo.LogFormat, error) {
+	reader := bufio.NewReaderSize(f, 64*1024)
+	for {
+		l, err := reader.ReadString('\n')
+		if line := strings.TrimSpace(l); line != "" {
+			if format := netgo.DetectLogFormat(netgo.LogFormats(options.Sources), line); format != nil {
+				return format, nil
+			}
+			break
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return &netgo.NetgoFormat{Sources: options.Sources}, nil
+}
+
+// writeLog inserts the entries of the batches read from a log, in order, in a single transaction committed together with the log's offset, so a log is recorded either completely or not at all.
+// If options.BatchSize is set, a transaction is instead committed every options.BatchSize lines, so a failed parse resumes after the last committed batch.
+// Each log within an archive is committed separately.
+func writeLog(store logdb.Store, options *Options, state *logState, batches <-chan *logBatch, onIgnore func(string) error) (int, error) {
+	writer, err := store.NewWriter()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	// Create table for files
-	if _, err = db.Exec(CREATE_FILES_QUERY); err != nil {
-		return nil, err
+	defer writer.Close()
+
+	// Log being written, and how far it has been parsed
+	var (
+		current *logState
+		file    logdb.File
+	)
+	// commit records the offset reached and commits the batch
+	commit := func() error {
+		if err := writer.UpdateFile(&file); err != nil {
+			return err
+		}
+		return writer.Commit()
 	}
-	// Create table for requests
-	if _, err = db.Exec(CREATE_REQUESTS_QUERY); err != nil {
-		return nil, err
+	// open switches to the log, recording it if it has not been seen before
+	open := func(s *logState) error {
+		current = s
+		if s.ID == 0 {
+			if err := writer.AddFile(&s.File); err != nil {
+				return err
+			}
+		}
+		file = s.File
+		return nil
 	}
-	// Create table for headers
-	if _, err = db.Exec(CREATE_HEADERS_QUERY); err != nil {
-		return nil, err
+
+	if err := writer.Begin(); err != nil {
+		return 0, err
+	}
+	defer func() {
+		// No-op once committed
+		writer.Rollback()
+	}()
+	if err := open(state); err != nil {
+		return 0, err
+	}
+	var count, batch, lines int
+	for b := range batches {
+		// Batches are parsed by workers ahead of the writer
+		<-b.parsed
+		for _, entry := range b.entries {
+			if entry.err != nil {
+				return 0, fmt.Errorf("%s: %w", current.Name, entry.err)
+			}
+			if entry.file != nil {
+				if err := commit(); err != nil {
+					return 0, err
+				}
+				if err := writer.Begin(); err != nil {
+					return 0, err
+				}
+				if err := open(entry.file); err != nil {
+					return 0, err
+				}
+				batch = 0
+				continue
+			}
+			file.Offset = entry.offset
+			file.Lines = entry.line
+			if record := entry.record; record != nil {
+				if err := writer.AddRequest(file.ID, record); err != nil {
+					return 0, err
+				}
+				count++
+			} else if entry.ignored != "" {
+				if err := onIgnore(entry.ignored); err != nil {
+					return 0, err
+				}
+			}
+			batch++
+			if options.BatchSize > 0 && batch >= options.BatchSize {
+				if err := commit(); err != nil {
+					return 0, err
+				}
+				batch = 0
+				if err := writer.Begin(); err != nil {
+					return 0, err
+				}
+			}
+			lines++
+			if lines%PROGRESS_LINES == 0 {
+				if current.size > 0 {
+					options.Logger.Info("Parsing Log", "name", current.Name, "count", count, "progress", fmt.Sprintf("%.1f%%", 100*float64(file.Offset)/float64(current.size)))
+				} else {
+					options.Logger.Info("Parsing Log", "name", current.Name, "count", count)
+				}
+			}
+		}
+	}
+	if err := commit(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// countLines returns the number of bytes and lines in the named file, decompressing it if compressed.
+func countLines(name string) (int64, int64, error) {
+	in, err := openInput(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer in.Close()
+	reader := bufio.NewReaderSize(in, 64*1024)
+	var size, count int64
+	for {
+		l, err := reader.ReadSlice('\n')
+		size += int64(len(l))
+		if err == nil {
+			count++
+		} else if err == io.EOF {
+			return size, count, nil
+		} else if err != bufio.ErrBufferFull {
+			return 0, 0, err
+		}
 	}
-	return db, nil
 }
@@ -0,0 +1,807 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"aletheiaware.com/netgo"
+	"aletheiaware.com/netgo/logdb"
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testOptions() *Options {
+	return &Options{
+		Redaction:  netgo.DefaultRedactionPolicy(),
+		Anonymiser: &netgo.Anonymiser{},
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+// requestLines returns n request entries as written by netgo.LogRequest.
+func requestLines(t *testing.T, n int) string {
+	t.Helper()
+	var buffer bytes.Buffer
+	logger := netgo.NewLogger(&buffer, slog.LevelInfo)
+	for i := 0; i < n; i++ {
+		netgo.LogRequest(logger, httptest.NewRequest("GET", fmt.Sprintf("/%d", i), nil))
+	}
+	return buffer.String()
+}
+
+func appendLog(t *testing.T, name, content string) {
+	t.Helper()
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	assert.Nil(t, err)
+	_, err = f.WriteString(content)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+}
+
+func countRequests(t *testing.T, name string) int {
+	t.Helper()
+	db, err := sql.Open(logdb.SQLITE_DRIVER, name)
+	assert.Nil(t, err)
+	defer db.Close()
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM tbl_requests;`).Scan(&count); err != nil {
+		// Tables not yet created
+		return -1
+	}
+	return count
+}
+
+func TestParse_Incremental(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	logs := filepath.Join(dir, "logs")
+	assert.Nil(t, os.Mkdir(logs, 0700))
+	database := filepath.Join(dir, "log.db")
+	log := filepath.Join(logs, "2022-03-04T12:00:00Z")
+
+	lines := requestLines(t, 4)
+	split := bytes.IndexByte([]byte(lines), '\n') + 1
+	partial := split + 10
+
+	t.Run("Partial Line", func(t *testing.T) {
+		appendLog(t, log, lines[:partial])
+		count, err := Parse(database, []string{logs}, testOptions())
+		assert.Nil(t, err)
+		assert.Equal(t, 1, count)
+	})
+	t.Run("Resume", func(t *testing.T) {
+		appendLog(t, log, lines[partial:])
+		count, err := Parse(database, []string{logs}, testOptions())
+		assert.Nil(t, err)
+		assert.Equal(t, 3, count)
+		assert.Equal(t, 4, countRequests(t, database))
+	})
+	t.Run("Unchanged", func(t *testing.T) {
+		count, err := Parse(database, []string{logs}, testOptions())
+		assert.Nil(t, err)
+		assert.Equal(t, 0, count)
+	})
+	t.Run("Truncated", func(t *testing.T) {
+		assert.Nil(t, os.Truncate(log, 0))
+		appendLog(t, log, lines[:split])
+		count, err := Parse(database, []string{logs}, testOptions())
+		assert.Nil(t, err)
+		assert.Equal(t, 1, count)
+		assert.Equal(t, 5, countRequests(t, database))
+	})
+	t.Run("Replaced", func(t *testing.T) {
+		// Rename keeps the old inode alive so the new file cannot reuse it
+		assert.Nil(t, os.Rename(log, filepath.Join(dir, "old")))
+		appendLog(t, log, lines)
+		count, err := Parse(database, []string{logs}, testOptions())
+		assert.Nil(t, err)
+		assert.Equal(t, 4, count)
+		assert.Equal(t, 9, countRequests(t, database))
+	})
+}
+
+func TestParse_Renamed(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	logs := filepath.Join(dir, "logs")
+	assert.Nil(t, os.Mkdir(logs, 0700))
+	database := filepath.Join(dir, "log.db")
+	log := filepath.Join(logs, "app.log")
+
+	lines := requestLines(t, 4)
+	split := bytes.IndexByte([]byte(lines), '\n') + 1
+
+	appendLog(t, log, lines[:split])
+	count, err := Parse(database, []string{logs}, testOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	t.Run("Rotated", func(t *testing.T) {
+		// Lines written before rotation, and to the new log after
+		appendLog(t, log, lines[split:])
+		assert.Nil(t, os.Rename(log, log+".1"))
+		appendLog(t, log, lines[:split])
+		count, err := Parse(database, []string{logs}, testOptions())
+		assert.Nil(t, err)
+		assert.Equal(t, 4, count)
+		assert.Equal(t, 5, countRequests(t, database))
+	})
+	t.Run("Unchanged", func(t *testing.T) {
+		count, err := Parse(database, []string{logs}, testOptions())
+		assert.Nil(t, err)
+		assert.Equal(t, 0, count)
+	})
+	t.Run("Linked", func(t *testing.T) {
+		// A link to a parsed log is a different log, so is parsed from the beginning
+		assert.Nil(t, os.Link(log, filepath.Join(logs, "copy.log")))
+		count, err := Parse(database, []string{logs}, testOptions())
+		assert.Nil(t, err)
+		assert.Equal(t, 1, count)
+	})
+}
+
+func TestParse_LegacyDatabase(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	logs := filepath.Join(dir, "logs")
+	assert.Nil(t, os.Mkdir(logs, 0700))
+	database := filepath.Join(dir, "log.db")
+	log := filepath.Join(logs, "2022-03-04T12:00:00Z")
+	appendLog(t, log, requestLines(t, 2))
+
+	// Database created before offsets were recorded, with the log already parsed
+	db, err := sql.Open(logdb.SQLITE_DRIVER, database)
+	assert.Nil(t, err)
+	_, err = db.Exec(`CREATE TABLE tbl_files (id INTEGER NOT NULL PRIMARY KEY, name TEXT NOT NULL UNIQUE);`)
+	assert.Nil(t, err)
+	_, err = db.Exec(`INSERT INTO tbl_files (name) VALUES (?);`, log)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	count, err := Parse(database, []string{logs}, testOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// Lines appended afterwards are parsed
+	appendLog(t, log, requestLines(t, 1))
+	count, err = Parse(database, []string{logs}, testOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestFollow(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	logs := filepath.Join(dir, "logs")
+	assert.Nil(t, os.Mkdir(logs, 0700))
+	database := filepath.Join(dir, "log.db")
+	log := filepath.Join(logs, "2022-03-04T12:00:00Z")
+	appendLog(t, log, requestLines(t, 1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- Follow(ctx, database, []string{logs}, testOptions(), 10*time.Millisecond)
+	}()
+	assert.Eventually(t, func() bool {
+		return countRequests(t, database) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	appendLog(t, log, requestLines(t, 2))
+	assert.Eventually(t, func() bool {
+		return countRequests(t, database) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.Nil(t, <-result)
+}
+
+func TestParse_Unparseable(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	logs := filepath.Join(dir, "logs")
+	assert.Nil(t, os.Mkdir(logs, 0700))
+	database := filepath.Join(dir, "log.db")
+	log := filepath.Join(logs, "2022-03-04T12:00:00Z")
+	appendLog(t, log, requestLines(t, 2))
+	// Request with an invalid address
+	invalid := `{"time":"2022-03-04T12:00:00Z","type":"request","address":"invalid"}`
+	appendLog(t, log, invalid+"\n")
+	appendLog(t, log, requestLines(t, 1))
+
+	count, err := Parse(database, []string{logs}, testOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	ignored, err := os.ReadFile(".ignored")
+	assert.Nil(t, err)
+	assert.Equal(t, log+":3:1: Invalid Address: "+invalid+"\n", string(ignored))
+
+	// Line numbers continue from where parsing resumes
+	appendLog(t, log, invalid+"\n")
+	count, err = Parse(database, []string{logs}, testOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+	ignored, err = os.ReadFile(".ignored")
+	assert.Nil(t, err)
+	assert.Equal(t, log+":5:1: Invalid Address: "+invalid+"\n", string(ignored))
+}
+
+func TestParse_Formats(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	nginx := filepath.Join(dir, "nginx")
+	iis := filepath.Join(dir, "iis")
+	assert.Nil(t, os.Mkdir(nginx, 0700))
+	assert.Nil(t, os.Mkdir(iis, 0700))
+	database := filepath.Join(dir, "log.db")
+	access := filepath.Join(nginx, "access.log")
+	appendLog(t, access, `192.0.2.1 - - [04/Mar/2022:12:00:00 +0000] "GET / HTTP/1.1" 200 612 "-" "curl/7.68.0"`+"\n")
+	w3c := filepath.Join(iis, "u_ex220304.log")
+	appendLog(t, w3c, "#Version: 1.0\n#Fields: date time c-ip cs-method cs-uri-stem cs-version\n2022-03-04 12:00:00 192.0.2.2 GET /a HTTP/1.1\n")
+
+	// Formats are detected
+	count, err := Parse(database, []string{nginx, iis}, testOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	// Directives are parsed again when resuming
+	appendLog(t, w3c, "2022-03-04 12:00:01 192.0.2.3 GET /b HTTP/1.1\n")
+	options := testOptions()
+	options.Formats = map[string]netgo.LogFormat{
+		iis: &netgo.W3CFormat{},
+	}
+	count, err = Parse(database, []string{nginx, iis}, options)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	db, err := sql.Open(logdb.SQLITE_DRIVER, database)
+	assert.Nil(t, err)
+	defer db.Close()
+	var address, url, agent string
+	assert.Nil(t, db.QueryRow(`SELECT tbl_requests.address, tbl_requests.url, tbl_header_values.value FROM tbl_requests INNER JOIN tbl_headers ON tbl_headers.request = tbl_requests.id INNER JOIN tbl_header_keys ON tbl_header_keys.id = tbl_headers.key_id INNER JOIN tbl_header_values ON tbl_header_values.id = tbl_headers.value_id WHERE tbl_requests.source = "combined" AND tbl_header_keys.key = "User-Agent";`).Scan(&address, &url, &agent))
+	assert.Equal(t, "192.0.2.1", address)
+	assert.Equal(t, "/", url)
+	assert.Equal(t, "curl/7.68.0", agent)
+	assert.Nil(t, db.QueryRow(`SELECT address, url FROM tbl_requests WHERE source = "w3c" ORDER BY id DESC LIMIT 1;`).Scan(&address, &url))
+	assert.Equal(t, "192.0.2.3", address)
+	assert.Equal(t, "/b", url)
+}
+
+func writeCompressed(t *testing.T, name, content string) {
+	t.Helper()
+	f, err := os.Create(name)
+	assert.Nil(t, err)
+	var w io.WriteCloser
+	switch filepath.Ext(name) {
+	case ".gz", ".tgz":
+		w = gzip.NewWriter(f)
+	case ".zst":
+		w, err = zstd.NewWriter(f)
+		assert.Nil(t, err)
+	default:
+		t.Fatalf("Unsupported compression: %s", name)
+	}
+	_, err = io.WriteString(w, content)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	assert.Nil(t, f.Close())
+}
+
+func writeArchive(t *testing.T, name string, members map[string]string) {
+	t.Helper()
+	var buffer bytes.Buffer
+	w := tar.NewWriter(&buffer)
+	assert.Nil(t, w.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "sub/", Mode: 0700}))
+	for _, n := range slices.Sorted(maps.Keys(members)) {
+		assert.Nil(t, w.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: n, Mode: 0600, Size: int64(len(members[n]))}))
+		_, err := io.WriteString(w, members[n])
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, w.Close())
+	writeCompressed(t, name, buffer.String())
+}
+
+func compressString(t *testing.T, content string) string {
+	t.Helper()
+	var buffer bytes.Buffer
+	w := gzip.NewWriter(&buffer)
+	_, err := io.WriteString(w, content)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	return buffer.String()
+}
+
+func TestParse_Compressed(t *testing.T) {
+	bz2, err := os.ReadFile(filepath.Join("testdata", "access.log.bz2"))
+	assert.Nil(t, err)
+	dir := t.TempDir()
+	t.Chdir(dir)
+	logs := filepath.Join(dir, "logs")
+	assert.Nil(t, os.Mkdir(logs, 0700))
+	database := filepath.Join(dir, "log.db")
+	log := filepath.Join(logs, "2022-03-04T12:00:00Z")
+	lines := requestLines(t, 4)
+	split := bytes.IndexByte([]byte(lines), '\n') + 1
+
+	appendLog(t, log, lines[:split])
+	count, err := Parse(database, []string{logs}, testOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	t.Run("Rotated", func(t *testing.T) {
+		// Lines written before the log was compressed are parsed once
+		writeCompressed(t, log+".gz", lines)
+		assert.Nil(t, os.Remove(log))
+		count, err := Parse(database, []string{logs}, testOptions())
+		assert.Nil(t, err)
+		assert.Equal(t, 3, count)
+		assert.Equal(t, 4, countRequests(t, database))
+
+		count, err = Parse(database, []string{logs}, testOptions())
+		assert.Nil(t, err)
+		assert.Equal(t, 0, count)
+	})
+	t.Run("Copies", func(t *testing.T) {
+		// Only one of a log and its compressed copy is parsed
+		copied := filepath.Join(logs, "2022-03-05T12:00:00Z")
+		appendLog(t, copied, lines)
+		writeCompressed(t, copied+".gz", lines)
+		count, err := Parse(database, []string{logs}, testOptions())
+		assert.Nil(t, err)
+		assert.Equal(t, 4, count)
+	})
+	t.Run("Zstandard", func(t *testing.T) {
+		writeCompressed(t, filepath.Join(logs, "2022-03-06T12:00:00Z.zst"), lines)
+		count, err := Parse(database, []string{logs}, testOptions())
+		assert.Nil(t, err)
+		assert.Equal(t, 4, count)
+	})
+	t.Run("Bzip2", func(t *testing.T) {
+		assert.Nil(t, os.WriteFile(filepath.Join(logs, "access.log.bz2"), bz2, 0600))
+		count, err := Parse(database, []string{logs}, testOptions())
+		assert.Nil(t, err)
+		assert.Equal(t, 2, count)
+	})
+}
+
+func TestParse_Archive(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	logs := filepath.Join(dir, "logs")
+	assert.Nil(t, os.Mkdir(logs, 0700))
+	database := filepath.Join(dir, "log.db")
+	archive := filepath.Join(logs, "2022-03.tar.gz")
+	lines := requestLines(t, 3)
+	split := bytes.IndexByte([]byte(lines), '\n') + 1
+
+	writeArchive(t, archive, map[string]string{
+		"a":        lines[:split],
+		"sub/b.gz": compressString(t, lines),
+	})
+	count, err := Parse(database, []string{logs}, testOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, 4, count)
+
+	count, err = Parse(database, []string{logs}, testOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// Replaced archive only has new lines parsed
+	assert.Nil(t, os.Rename(archive, filepath.Join(dir, "old.tar.gz")))
+	writeArchive(t, archive, map[string]string{
+		"a":        lines,
+		"sub/b.gz": compressString(t, lines),
+	})
+	count, err = Parse(database, []string{logs}, testOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 6, countRequests(t, database))
+
+	db, err := sql.Open(logdb.SQLITE_DRIVER, database)
+	assert.Nil(t, err)
+	defer db.Close()
+	rows, err := db.Query(`SELECT name FROM tbl_files ORDER BY name;`)
+	assert.Nil(t, err)
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		assert.Nil(t, rows.Scan(&name))
+		names = append(names, name)
+	}
+	assert.Equal(t, []string{archive[:len(archive)-3], archive[:len(archive)-3] + "/a", archive[:len(archive)-3] + "/sub/b"}, names)
+}
+
+func TestParse_Stdin(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	database := filepath.Join(dir, "log.db")
+	lines := requestLines(t, 3)
+	split := bytes.IndexByte([]byte(lines), '\n') + 1
+	options := testOptions()
+	options.StdinName = "journal"
+
+	pipe := func(content string) {
+		r, w, err := os.Pipe()
+		assert.Nil(t, err)
+		go func() {
+			io.WriteString(w, content)
+			w.Close()
+		}()
+		stdin := os.Stdin
+		os.Stdin = r
+		t.Cleanup(func() {
+			os.Stdin = stdin
+			r.Close()
+		})
+	}
+
+	// Final line without a newline is complete
+	pipe(strings.TrimSuffix(lines[:split], "\n"))
+	count, err := Parse(database, []string{STDIN_NAME}, options)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	// Lines already parsed are skipped when piped again
+	pipe(lines)
+	count, err = Parse(database, []string{STDIN_NAME}, options)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 3, countRequests(t, database))
+
+	// A different log of the same length is parsed from the beginning
+	other := strings.ReplaceAll(lines, "/0", "/9")
+	assert.NotEqual(t, lines, other)
+	pipe(other)
+	count, err = Parse(database, []string{STDIN_NAME}, options)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	// A longer different log is parsed from the beginning, not resumed from the previous offset
+	pipe(requestLines(t, 4))
+	count, err = Parse(database, []string{STDIN_NAME}, options)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, count)
+	assert.Equal(t, 10, countRequests(t, database))
+}
+
+func TestParse_StdinCompressed(t *testing.T) {
+	for name, compress := range map[string]func(io.Writer) io.WriteCloser{
+		"gzip": func(w io.Writer) io.WriteCloser {
+			return gzip.NewWriter(w)
+		},
+		"zstd": func(w io.Writer) io.WriteCloser {
+			z, err := zstd.NewWriter(w)
+			assert.Nil(t, err)
+			return z
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Chdir(dir)
+			database := filepath.Join(dir, "log.db")
+			var buffer bytes.Buffer
+			w := compress(&buffer)
+			_, err := io.WriteString(w, requestLines(t, 2))
+			assert.Nil(t, err)
+			assert.Nil(t, w.Close())
+
+			r, pw, err := os.Pipe()
+			assert.Nil(t, err)
+			go func() {
+				pw.Write(buffer.Bytes())
+				pw.Close()
+			}()
+			stdin := os.Stdin
+			os.Stdin = r
+			defer func() {
+				os.Stdin = stdin
+				r.Close()
+			}()
+
+			count, err := Parse(database, []string{STDIN_NAME}, testOptions())
+			assert.Nil(t, err)
+			assert.Equal(t, 2, count)
+			assert.Equal(t, 2, countRequests(t, database))
+		})
+	}
+}
+
+func TestParse_Walk(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	logs := filepath.Join(dir, "logs")
+	database := filepath.Join(dir, "log.db")
+	lines := requestLines(t, 1)
+	for _, name := range []string{"a", "host1/b", "host2/nginx/c", "host2/old", "a.swp", ".hidden/d", "excluded/e"} {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(logs, name)), 0700))
+		appendLog(t, filepath.Join(logs, name), lines)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	assert.Nil(t, os.Chtimes(filepath.Join(logs, "host2", "old"), old, old))
+	assert.Nil(t, os.Symlink(filepath.Join(logs, "missing"), filepath.Join(logs, "broken")))
+
+	options := testOptions()
+	options.Exclude = []string{"*.swp", "excluded"}
+	options.ModifiedSince = time.Now().Add(-24 * time.Hour)
+	options.Tag = true
+	count, err := Parse(database, []string{logs}, options)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	tags := map[string]string{
+		filepath.Join(logs, "a"):             "",
+		filepath.Join(logs, "host1/b"):       "host1",
+		filepath.Join(logs, "host2/nginx/c"): "host2",
+	}
+	assert.Equal(t, tags, fileTags(t, database))
+
+	// Only included logs are parsed
+	options.Include = []string{"host1/*"}
+	options.ModifiedSince = time.Time{}
+	appendLog(t, filepath.Join(logs, "a"), lines)
+	appendLog(t, filepath.Join(logs, "host1", "b"), lines)
+	count, err = Parse(database, []string{logs}, options)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	// Tags are kept when parsing without tagging
+	options.Include = nil
+	options.ModifiedSince = time.Now().Add(-24 * time.Hour)
+	options.Tag = false
+	_, err = Parse(database, []string{logs}, options)
+	assert.Nil(t, err)
+	assert.Equal(t, tags, fileTags(t, database))
+}
+
+func TestParse_Retag(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	logs := filepath.Join(dir, "logs")
+	log := filepath.Join(logs, "host1", "access.log")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(log), 0700))
+	appendLog(t, log, requestLines(t, 1))
+	database := filepath.Join(dir, "log.db")
+
+	options := testOptions()
+	count, err := Parse(database, []string{logs}, options)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, map[string]string{log: ""}, fileTags(t, database))
+
+	// Logs already parsed are tagged, even with nothing new to parse
+	options.Tag = true
+	count, err = Parse(database, []string{logs}, options)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+	assert.Equal(t, map[string]string{log: "host1"}, fileTags(t, database))
+}
+
+// fileTags returns the tag of each log recorded in the database, by name.
+func fileTags(t *testing.T, database string) map[string]string {
+	t.Helper()
+	db, err := sql.Open(logdb.SQLITE_DRIVER, database)
+	assert.Nil(t, err)
+	defer db.Close()
+	rows, err := db.Query(`SELECT name, tag FROM tbl_files ORDER BY name;`)
+	assert.Nil(t, err)
+	defer rows.Close()
+	tags := make(map[string]string)
+	for rows.Next() {
+		var name, tag string
+		assert.Nil(t, rows.Scan(&name, &tag))
+		tags[name] = tag
+	}
+	assert.Nil(t, rows.Err())
+	return tags
+}
+
+func TestParse_HeaderDictionary(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	logs := filepath.Join(dir, "logs")
+	assert.Nil(t, os.Mkdir(logs, 0700))
+	database := filepath.Join(dir, "log.db")
+	for i, agent := range []string{"curl/7.68.0", "Wget/1.20.3", "curl/7.68.0"} {
+		appendLog(t, filepath.Join(logs, "access.log"), fmt.Sprintf(`192.0.2.%d - - [04/Mar/2022:12:00:00 +0000] "GET / HTTP/1.1" 200 612 "-" "%s"`+"\n", i, agent))
+	}
+	count, err := Parse(database, []string{logs}, testOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	// Each header key and value is stored once
+	db, err := sql.Open(logdb.SQLITE_DRIVER, database)
+	assert.Nil(t, err)
+	defer db.Close()
+	var headers, keys, values int
+	assert.Nil(t, db.QueryRow(`SELECT COUNT(*) FROM tbl_headers;`).Scan(&headers))
+	assert.Nil(t, db.QueryRow(`SELECT COUNT(*) FROM tbl_header_keys;`).Scan(&keys))
+	assert.Nil(t, db.QueryRow(`SELECT COUNT(*) FROM tbl_header_values;`).Scan(&values))
+	assert.Equal(t, 3, headers)
+	assert.Equal(t, 1, keys)
+	assert.Equal(t, 2, values)
+}
+
+// failedEntries returns three request entries followed by a read error.
+func failedEntries() chan *logBatch {
+	entries := make(chan *logBatch, 4)
+	for i := 1; i <= 3; i++ {
+		entries <- newEntryBatch(&logEntry{
+			offset: int64(10 * i),
+			line:   int64(i),
+			record: &netgo.RequestRecord{
+				Time:     time.Date(2022, 3, 4, 12, 0, i, 0, time.UTC),
+				Source:   netgo.REQUEST_LOG,
+				IP:       "192.0.2.1",
+				Port:     4567,
+				Protocol: "HTTP/1.1",
+				Method:   "GET",
+				Host:     "example.com",
+				URL:      &url.URL{Path: "/"},
+			},
+		})
+	}
+	entries <- newEntryBatch(&logEntry{err: errors.New("Read Failed")})
+	close(entries)
+	return entries
+}
+
+func TestWriteLog_Atomic(t *testing.T) {
+	store, err := logdb.Open(filepath.Join(t.TempDir(), "log.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+	db := store.(*logdb.SQLStore).DB()
+
+	_, err = writeLog(store, testOptions(), &logState{File: logdb.File{Name: "test"}}, failedEntries(), func(string) error { return nil })
+	assert.NotNil(t, err)
+
+	// Nothing is committed, not even the log
+	var requests, files int64
+	assert.Nil(t, db.QueryRow(`SELECT COUNT(*) FROM tbl_requests;`).Scan(&requests))
+	assert.Nil(t, db.QueryRow(`SELECT COUNT(*) FROM tbl_files;`).Scan(&files))
+	assert.Equal(t, int64(0), requests)
+	assert.Equal(t, int64(0), files)
+}
+
+func TestWriteLog_Batch(t *testing.T) {
+	store, err := logdb.Open(filepath.Join(t.TempDir(), "log.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+	db := store.(*logdb.SQLStore).DB()
+
+	options := testOptions()
+	options.BatchSize = 2
+	_, err = writeLog(store, options, &logState{File: logdb.File{Name: "test"}}, failedEntries(), func(string) error { return nil })
+	assert.NotNil(t, err)
+
+	// Only the first batch is committed, together with its offset
+	var requests, offset, lines int64
+	assert.Nil(t, db.QueryRow(`SELECT COUNT(*) FROM tbl_requests;`).Scan(&requests))
+	assert.Nil(t, db.QueryRow(`SELECT byte_offset, line_count FROM tbl_files WHERE name = "test";`).Scan(&offset, &lines))
+	assert.Equal(t, int64(2), requests)
+	assert.Equal(t, int64(20), offset)
+	assert.Equal(t, int64(2), lines)
+}
+
+func TestParse_Workers(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	logs := filepath.Join(dir, "logs")
+	assert.Nil(t, os.Mkdir(logs, 0700))
+	for i := 0; i < 8; i++ {
+		appendLog(t, filepath.Join(logs, fmt.Sprintf("2022-03-%02dT00:00:00Z", i+1)), requestLines(t, 10*(i+1)))
+	}
+	// Large log is parsed in several batches
+	appendLog(t, filepath.Join(logs, "2022-03-09T00:00:00Z"), requestLines(t, 2*BATCH_LINES+1))
+
+	dump := func(workers int) (int, []string) {
+		database := filepath.Join(dir, fmt.Sprintf("log%d.db", workers))
+		options := testOptions()
+		options.BatchSize = 7
+		options.Workers = workers
+		count, err := Parse(database, []string{logs}, options)
+		assert.Nil(t, err)
+		db, err := sql.Open(logdb.SQLITE_DRIVER, database)
+		assert.Nil(t, err)
+		defer db.Close()
+		rows, err := db.Query(`SELECT tbl_requests.id, tbl_files.name, tbl_requests.url FROM tbl_requests INNER JOIN tbl_files ON tbl_requests.file = tbl_files.id ORDER BY tbl_requests.id;`)
+		assert.Nil(t, err)
+		defer rows.Close()
+		var results []string
+		for rows.Next() {
+			var (
+				id        int64
+				name, url string
+			)
+			assert.Nil(t, rows.Scan(&id, &name, &url))
+			results = append(results, fmt.Sprint(id, name, url))
+		}
+		return count, results
+	}
+
+	expectedCount, expected := dump(1)
+	assert.Equal(t, 360+2*BATCH_LINES+1, expectedCount)
+	actualCount, actual := dump(4)
+	assert.Equal(t, expectedCount, actualCount)
+	assert.Equal(t, expected, actual)
+}
+
+var benchmarkLines = flag.Int("benchmark-lines", 2000000, "Number of Lines in Benchmark Log")
+
+func BenchmarkParse(b *testing.B) {
+	dir := b.TempDir()
+	b.Chdir(dir)
+	logs := filepath.Join(dir, "logs")
+	if err := os.Mkdir(logs, 0700); err != nil {
+		b.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(logs, "2022-03-04T12:00:00Z"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	writer := bufio.NewWriter(f)
+	start := time.Date(2022, 3, 4, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < *benchmarkLines; i++ {
+		fmt.Fprintf(writer, `{"time":"%s","level":"INFO","msg":"request","type":"request","address":"192.0.2.%d:%d","protocol":"HTTP/1.1","method":"GET","host":"example.com","url":"/%d","headers":{"Accept":["*/*"],"User-Agent":["benchmark/%d"]}}`+"\n",
+			start.Add(time.Duration(i)*time.Millisecond).Format(time.RFC3339Nano), i%256, 1024+i%60000, i%1000, i%10)
+	}
+	if err := writer.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		b.Fatal(err)
+	}
+	// Compare a single worker with one per CPU parsing the same log
+	for _, workers := range slices.Compact([]int{1, runtime.NumCPU()}) {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			options := testOptions()
+			options.Workers = workers
+			for i := 0; i < b.N; i++ {
+				// Each iteration parses the whole log into a new database
+				count, err := Parse(filepath.Join(dir, fmt.Sprintf("log%d-%d.db", workers, i)), []string{logs}, options)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if count != *benchmarkLines {
+					b.Fatalf("Incorrect count; expected %d, got %d", *benchmarkLines, count)
+				}
+			}
+			b.ReportMetric(float64(*benchmarkLines)*float64(b.N)/b.Elapsed().Seconds(), "lines/s")
+		})
+	}
+}
@@ -1,5 +1,32 @@
 const cornerRadius = 1;
 
+// Literal returns a filter expression matching the value exactly, quoting it if it contains characters with special meaning.
+function Literal(value) {
+    if (/^[-~"]|[|*\\]/.test(value)) {
+        return '"' + value.replace(/[\\"]/g, '\\$&') + '"';
+    }
+    return value;
+}
+
+// EscapeHTML returns the text with characters that have special meaning in HTML replaced by entities.
+function EscapeHTML(text) {
+    return String(text).replace(/[&<>"']/g, function(c) {
+        return '&#' + c.charCodeAt(0) + ';';
+    });
+}
+
+// LoadJSON fetches JSON, rejecting with the server's explanation if the request failed.
+function LoadJSON(url) {
+    return fetch(url).then(function(response) {
+        if (!response.ok) {
+            return response.text().then(function(text) {
+                throw new Error(text.trim());
+            });
+        }
+        return response.json();
+    });
+}
+
 function HBar(id, width, min, max, data, value, label, click) {
     const barHeight = 18;
     const barPadding = 4;
@@ -61,7 +88,8 @@ function HBar(id, width, min, max, data, value, label, click) {
         .text(value);
 }
 
-function Histogram(id, width, height, min, max, data, value, label, click) {
+// Histogram draws the buckets of a time series, stacking those of the same time with different values.
+function Histogram(id, width, height, min, max, data, label, click) {
     const margin = {top: 10, right: 10, bottom: 60, left: 60};
 
     var tooltip = d3.select('#tooltip')
@@ -71,6 +99,25 @@ function Histogram(id, width, height, min, max, data, value, label, click) {
         .domain([new Date(min * 1000), new Date(max * 1000)])
         .range([0, width - margin.right - margin.left]);
 
+    // Stack the buckets of each time, in the order of their values
+    const totals = new Map();
+    const stacked = data.map(function(bucket) {
+        const y0 = totals.get(bucket.start) || 0;
+        totals.set(bucket.start, y0 + bucket.count);
+        return Object.assign({y0: y0, y1: y0 + bucket.count}, bucket);
+    });
+
+    const y = d3.scaleLinear()
+        .domain([0, d3.max(totals.values()) || 0])
+        .range([height - margin.top - margin.bottom, 0]);
+
+    const values = Array.from(new Set(data.map(function(bucket) {
+        return bucket.value || '';
+    })));
+    const color = d3.scaleOrdinal()
+        .domain(values)
+        .range(d3.schemeTableau10);
+
     const chart = d3.select(id)
         .attr('width', width)
         .attr('height', height);
@@ -86,20 +133,94 @@ function Histogram(id, width, height, min, max, data, value, label, click) {
         .attr('dy', '.15em')
         .attr('transform', 'rotate(-60)');
 
-    const histogram = d3.histogram()
-        .value(function(data) {
-            return new Date(value(data) * 1000);
+    chart.append('g')
+        .attr('transform', `translate(${margin.left}, ${margin.top})`)
+        .call(d3.axisLeft(y));
+
+    chart.append('g')
+        .attr('transform', `translate(${margin.left}, ${margin.top})`)
+        .selectAll('rect')
+        .data(stacked)
+        .enter()
+        .append('rect')
+        .attr('rx', cornerRadius)
+        .attr('x', function(data) {
+            return x(new Date(data.start * 1000)) + 1;
+        })
+        .attr('y', function(data) {
+            return y(data.y1);
+        })
+        .attr('width', function(data) {
+            return Math.max(x(new Date(data.end * 1000)) - x(new Date(data.start * 1000)) - 1, 1);
+        })
+        .attr('height', function(data) {
+            return y(data.y0) - y(data.y1);
+        })
+        .style('fill', function(data) {
+            // Styled by the stylesheet unless split
+            return values.length > 1 ? color(data.value || '') : null;
+        })
+        .on('mouseover', function(event, data) {
+            tooltip.transition()
+                .duration(50)
+                .style('opacity', 1);
+            tooltip.html(label(data));
+            positionTooltip(tooltip, event);
         })
-        .domain(x.domain())
-        .thresholds(x.ticks(Math.floor((width - margin.right - margin.left) / 9)));
+        .on('mouseout', function(event, data) {
+            tooltip.transition()
+               .duration(50)
+               .style('opacity', 0);
+        })
+        .on('click', click);
 
-    const bins = histogram(data);
+    if (values.length > 1) {
+        chart.append('g')
+            .attr('transform', `translate(${width - margin.right}, ${margin.top})`)
+            .selectAll('text')
+            .data(values)
+            .enter()
+            .append('text')
+            .attr('y', function(data, index) {
+                return index * 16;
+            })
+            .attr('dy', '.8em')
+            .attr('text-anchor', 'end')
+            .style('fill', color)
+            .text(function(data) {
+                return data;
+            });
+    }
+}
 
-    const y = d3.scaleLinear()
-        .domain([0, d3.max(bins, function(data) {
-            return data.length;
-        })])
-        .range([height - margin.top - margin.bottom, 0]);
+function Timeline(id, width, min, max, data, row, start, end, label, click) {
+    const barHeight = 18;
+    const barPadding = 4;
+    const barSeparation = barHeight + barPadding;
+    const margin = {top: 30, right: 10, bottom: 10, left: 240};
+
+    var tooltip = d3.select('#tooltip')
+        .style('opacity', 0);
+
+    const rows = Array.from(new Set(data.map(row)));
+
+    const x = d3.scaleUtc()
+        .domain([new Date(min * 1000), new Date(max * 1000)])
+        .range([0, width - margin.right - margin.left]);
+
+    const y = d3.scaleBand()
+        .domain(rows)
+        .range([0, barSeparation * rows.length]);
+
+    const chart = d3.select(id)
+        .attr('width', width)
+        .attr('height', margin.top + barSeparation * rows.length + margin.bottom);
+
+    chart.selectAll('g').remove();
+
+    chart.append('g')
+        .attr('transform', `translate(${margin.left}, ${margin.top})`)
+        .call(d3.axisTop(x));
 
     chart.append('g')
         .attr('transform', `translate(${margin.left}, ${margin.top})`)
@@ -108,24 +229,21 @@ function Histogram(id, width, height, min, max, data, value, label, click) {
     chart.append('g')
         .attr('transform', `translate(${margin.left}, ${margin.top})`)
         .selectAll('rect')
-        .data(bins)
+        .data(data)
         .enter()
         .append('rect')
         .attr('rx', cornerRadius)
-        .attr('x', 1)
-        .attr('transform', function(data) {
-            return `translate(${x(data.x0)}, ${y(data.length)})`;
+        .attr('x', function(data) {
+            return x(new Date(start(data) * 1000));
         })
-        .attr('width', function(data) {
-            var w = x(data.x1) - x(data.x0) - 1;
-            if (w < 0) {
-                w = 0;
-            }
-            return w;
+        .attr('y', function(data) {
+            return y(row(data)) + barPadding / 2;
         })
-        .attr('height', function(data) {
-            return height - margin.top - margin.bottom - y(data.length);
+        .attr('width', function(data) {
+            // Sessions of a single request are still visible
+            return Math.max(x(new Date(end(data) * 1000)) - x(new Date(start(data) * 1000)), 2);
         })
+        .attr('height', barHeight)
         .on('mouseover', function(event, data) {
             tooltip.transition()
                 .duration(50)
@@ -0,0 +1,456 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"aletheiaware.com/netgo"
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SESSION_COOKIE  = "logserver-session"
+	STATE_COOKIE    = "logserver-state"
+	NONCE_COOKIE    = "logserver-nonce"
+	SESSION_TIMEOUT = 12 * time.Hour
+)
+
+var (
+	ErrInvalidSession = errors.New("Invalid Session")
+	ErrNoOIDCUsers    = errors.New("OpenID Connect Requires Allowed Users")
+	ErrNoAuth         = errors.New("Authentication Required (use -credentials or -oidc-issuer, or -insecure-no-auth to serve without)")
+)
+
+// Credentials maps usernames to bcrypt or argon2 password hashes.
+type Credentials map[string]string
+
+// LoadCredentials reads a file of "username:hash" lines, where hash is either a bcrypt hash (as produced by htpasswd -B) or an argon2i/argon2id hash in PHC string format.
+func LoadCredentials(path string) (Credentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	credentials := make(Credentials)
+	scanner := bufio.NewScanner(f)
+	var number int
+	for scanner.Scan() {
+		number++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexRune(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected username:hash", path, number)
+		}
+		credentials[line[:i]] = line[i+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// dummyHash is compared with the password of an unknown username, so it takes as long to refuse as that of a known username.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
+// Verify returns true if the password matches the hash stored for the username.
+func (c Credentials) Verify(username, password string, logger *slog.Logger) bool {
+	hash, ok := c[username]
+	if !ok {
+		// Take as long as a wrong password, so the response does not reveal whether the username exists
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$argon2"):
+		ok, err := verifyArgon2(hash, password)
+		if err != nil {
+			logger.Warn("Invalid Password Hash", "user", username, "error", err)
+		}
+		return ok
+	default:
+		logger.Warn("Unsupported Password Hash", "user", username)
+		return false
+	}
+}
+
+// verifyArgon2 checks a password against a hash of the form $argon2id$v=19$m=65536,t=3,p=4$salt$key
+func verifyArgon2(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, errors.New("Malformed Argon2 Hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, err
+	}
+	if version != argon2.Version {
+		return false, fmt.Errorf("Unsupported Argon2 Version: %d", version)
+	}
+	var (
+		memory  uint32
+		time    uint32
+		threads uint8
+	)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+	var derived []byte
+	switch parts[1] {
+	case "argon2id":
+		derived = argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	case "argon2i":
+		derived = argon2.Key([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	default:
+		return false, fmt.Errorf("Unsupported Argon2 Variant: %s", parts[1])
+	}
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
+
+// Sessions issues and verifies HMAC signed session cookies.
+type Sessions struct {
+	key []byte
+}
+
+// NewSessions creates a session signer with the secret key read from the given file, or with a random key if no file is given, in which case sessions do not survive a restart.
+func NewSessions(path string) (*Sessions, error) {
+	if path == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		return &Sessions{key}, nil
+	}
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = []byte(strings.TrimSpace(string(key)))
+	if len(key) < 32 {
+		return nil, errors.New("Session Key Too Short")
+	}
+	return &Sessions{key}, nil
+}
+
+func (s *Sessions) sign(value string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Encode returns a signed token identifying the user until the expiry.
+func (s *Sessions) Encode(user string, expiry time.Time) string {
+	value := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + strconv.FormatInt(expiry.Unix(), 10)
+	return value + "." + s.sign(value)
+}
+
+// Decode verifies the token and returns the user it identifies.
+func (s *Sessions) Decode(token string, now time.Time) (string, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", ErrInvalidSession
+	}
+	value, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(s.sign(value))) {
+		return "", ErrInvalidSession
+	}
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return "", ErrInvalidSession
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now.Unix() > expiry {
+		return "", ErrInvalidSession
+	}
+	user, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidSession
+	}
+	return string(user), nil
+}
+
+// Set writes a session cookie for the user.
+func (s *Sessions) Set(w http.ResponseWriter, r *http.Request, user string) {
+	expiry := time.Now().Add(SESSION_TIMEOUT)
+	http.SetCookie(w, &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    s.Encode(user, expiry),
+		Path:     "/",
+		Expires:  expiry,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// User returns the user identified by the request's session cookie.
+func (s *Sessions) User(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(SESSION_COOKIE)
+	if err != nil {
+		return "", err
+	}
+	return s.Decode(cookie.Value, time.Now())
+}
+
+// Clear removes the session cookie.
+func (s *Sessions) Clear(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// OIDC authenticates users with an OpenID Connect provider using the authorization code flow.
+type OIDC struct {
+	config   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	// Allowed emails, or domains prefixed with '@', in lower case.
+	allowed []string
+}
+
+// NewOIDC returns an OIDC authenticator for the issuer which only admits users with a verified email in the allowed list.
+// The list must not be empty, as the issuer may authenticate anyone with an account.
+func NewOIDC(ctx context.Context, issuer, id, secret, redirect string, allowed []string) (*OIDC, error) {
+	var users []string
+	for _, a := range allowed {
+		if a = strings.ToLower(strings.TrimSpace(a)); a != "" {
+			users = append(users, a)
+		}
+	}
+	if len(users) == 0 {
+		return nil, ErrNoOIDCUsers
+	}
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &OIDC{
+		config: oauth2.Config{
+			ClientID:     id,
+			ClientSecret: secret,
+			RedirectURL:  redirect,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: id}),
+		allowed:  users,
+	}, nil
+}
+
+func (o *OIDC) isAllowed(email string) bool {
+	email = strings.ToLower(email)
+	for _, a := range o.allowed {
+		if strings.HasPrefix(a, "@") {
+			if strings.HasSuffix(email, a) {
+				return true
+			}
+		} else if a == email {
+			return true
+		}
+	}
+	return false
+}
+
+// Auth requires requests to be authenticated by session cookie, HTTP basic auth, or an OpenID Connect login.
+type Auth struct {
+	Credentials Credentials
+	Sessions    *Sessions
+	OIDC        *OIDC
+	Logger      *slog.Logger
+	// Insecure serves unauthenticated requests when no authentication method has been configured, rather than rejecting them
+	Insecure bool
+}
+
+// Enabled returns true if any authentication method has been configured.
+func (a *Auth) Enabled() bool {
+	return a.Credentials != nil || a.OIDC != nil
+}
+
+// Attach registers the login, callback and logout handlers.
+func (a *Auth) Attach(m *http.ServeMux) {
+	m.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		a.Sessions.Clear(w)
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+	if a.OIDC == nil {
+		return
+	}
+	m.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		// State protects the callback from cross-site requests, nonce binds the ID token to this login
+		var values [2]string
+		for i := range values {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				a.Logger.Error("Random Failed", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			values[i] = base64.RawURLEncoding.EncodeToString(b)
+		}
+		state, nonce := values[0], values[1]
+		for _, c := range []*http.Cookie{
+			{Name: STATE_COOKIE, Value: state},
+			{Name: NONCE_COOKIE, Value: nonce},
+		} {
+			c.Path = "/"
+			c.MaxAge = 600
+			c.HttpOnly = true
+			c.Secure = r.TLS != nil
+			c.SameSite = http.SameSiteLaxMode
+			http.SetCookie(w, c)
+		}
+		http.Redirect(w, r, a.OIDC.config.AuthCodeURL(state, oidc.Nonce(nonce)), http.StatusFound)
+	})
+	m.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		state, err := r.Cookie(STATE_COOKIE)
+		if err != nil || state.Value == "" || r.URL.Query().Get("state") != state.Value {
+			http.Error(w, "Invalid State", http.StatusBadRequest)
+			return
+		}
+		nonce, err := r.Cookie(NONCE_COOKIE)
+		if err != nil || nonce.Value == "" {
+			http.Error(w, "Invalid Nonce", http.StatusBadRequest)
+			return
+		}
+		token, err := a.OIDC.config.Exchange(r.Context(), r.URL.Query().Get("code"))
+		if err != nil {
+			a.Logger.Warn("OIDC Exchange Failed", "error", err)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		raw, ok := token.Extra("id_token").(string)
+		if !ok {
+			http.Error(w, "Missing ID Token", http.StatusUnauthorized)
+			return
+		}
+		id, err := a.OIDC.verifier.Verify(r.Context(), raw)
+		if err != nil {
+			a.Logger.Warn("OIDC Verification Failed", "error", err)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(id.Nonce), []byte(nonce.Value)) != 1 {
+			a.Logger.Warn("OIDC Nonce Mismatch")
+			http.Error(w, "Invalid Nonce", http.StatusUnauthorized)
+			return
+		}
+		var claims struct {
+			Email    string `json:"email"`
+			Verified bool   `json:"email_verified"`
+		}
+		if err := id.Claims(&claims); err != nil {
+			a.Logger.Warn("OIDC Claims Failed", "error", err)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if !claims.Verified || !a.OIDC.isAllowed(claims.Email) {
+			a.Logger.Warn("OIDC User Not Allowed", "email", claims.Email)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		for _, name := range []string{STATE_COOKIE, NONCE_COOKIE} {
+			http.SetCookie(w, &http.Cookie{
+				Name:   name,
+				Path:   "/",
+				MaxAge: -1,
+			})
+		}
+		a.Sessions.Set(w, r, strings.ToLower(claims.Email))
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+}
+
+// Handler rejects unauthenticated requests. Requests for data (.json) receive 401 Unauthorized, while page requests are redirected to the OpenID Connect login if configured, or challenged for basic auth.
+// Every request is rejected if no authentication method has been configured, unless Insecure is set.
+func (a *Auth) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled() {
+			if a.Insecure {
+				h.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/login", "/callback", "/logout":
+			h.ServeHTTP(w, r)
+			return
+		}
+		if _, err := a.Sessions.User(r); err == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if a.Credentials != nil {
+			if username, password, ok := r.BasicAuth(); ok {
+				if a.Credentials.Verify(username, password, a.Logger) {
+					a.Sessions.Set(w, r, username)
+					h.ServeHTTP(w, r)
+					return
+				}
+				a.Logger.Warn("Authentication Failed", "address", netgo.LogAnonymiser.AnonymiseAddress(r.RemoteAddr, time.Now()), "user", username)
+			}
+		}
+		if a.OIDC != nil && !strings.HasSuffix(r.URL.Path, ".json") {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		if a.Credentials != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="logserver", charset="UTF-8"`)
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	BCRYPT_SECRET = "$2a$04$e8LjpcYqwlqQAknbZLrSHescpR89Pf8iEV7ndOZ2Nb.FTDBHj/any"
+	ARGON2_SECRET = "$argon2id$v=19$m=64,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg$pbviq+1UUgwZCmLIr4Hgk7mEMsxnRLuOb2HfvIaBwGY"
+)
+
+func TestCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	assert.Nil(t, os.WriteFile(path, []byte("# users\nalice:"+BCRYPT_SECRET+"\nbob:"+ARGON2_SECRET+"\n"), 0600))
+	credentials, err := LoadCredentials(path)
+	assert.Nil(t, err)
+	logger := slog.New(slog.DiscardHandler)
+	assert.True(t, credentials.Verify("alice", "secret", logger))
+	assert.False(t, credentials.Verify("alice", "wrong", logger))
+	assert.True(t, credentials.Verify("bob", "secret", logger))
+	assert.False(t, credentials.Verify("bob", "wrong", logger))
+	assert.False(t, credentials.Verify("eve", "secret", logger))
+	// Unknown usernames are compared with a hash as costly as a known one's
+	cost, err := bcrypt.Cost(dummyHash())
+	assert.Nil(t, err)
+	assert.Equal(t, bcrypt.DefaultCost, cost)
+}
+
+func TestSessions(t *testing.T) {
+	sessions, err := NewSessions("")
+	assert.Nil(t, err)
+	now := time.Now()
+	token := sessions.Encode("alice", now.Add(time.Hour))
+	t.Run("Valid", func(t *testing.T) {
+		user, err := sessions.Decode(token, now)
+		assert.Nil(t, err)
+		assert.Equal(t, "alice", user)
+	})
+	t.Run("Expired", func(t *testing.T) {
+		_, err := sessions.Decode(token, now.Add(2*time.Hour))
+		assert.Equal(t, ErrInvalidSession, err)
+	})
+	t.Run("Tampered", func(t *testing.T) {
+		_, err := sessions.Decode("Ym9i"+token[len("YWxpY2U"):], now)
+		assert.Equal(t, ErrInvalidSession, err)
+	})
+	t.Run("Other Key", func(t *testing.T) {
+		other, err := NewSessions("")
+		assert.Nil(t, err)
+		_, err = other.Decode(token, now)
+		assert.Equal(t, ErrInvalidSession, err)
+	})
+}
+
+func TestOIDC(t *testing.T) {
+	t.Run("No Users", func(t *testing.T) {
+		_, err := NewOIDC(context.Background(), "https://issuer.invalid", "id", "secret", "https://logs.example.com/callback", []string{""})
+		assert.Equal(t, ErrNoOIDCUsers, err)
+	})
+	t.Run("Allowed", func(t *testing.T) {
+		o := &OIDC{
+			allowed: []string{"alice@example.com", "@example.org"},
+		}
+		assert.True(t, o.isAllowed("alice@example.com"))
+		assert.True(t, o.isAllowed("Alice@Example.COM"))
+		assert.True(t, o.isAllowed("bob@EXAMPLE.org"))
+		assert.False(t, o.isAllowed("bob@example.com"))
+		assert.False(t, o.isAllowed("eve@evilexample.org.invalid"))
+		assert.False(t, o.isAllowed(""))
+	})
+}
+
+func TestAuth(t *testing.T) {
+	sessions, err := NewSessions("")
+	assert.Nil(t, err)
+	auth := &Auth{
+		Credentials: Credentials{
+			"alice": BCRYPT_SECRET,
+		},
+		Sessions: sessions,
+		Logger:   slog.Default(),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	auth.Attach(mux)
+	h := auth.Handler(mux)
+	t.Run("Unauthenticated Data", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/requests.json", nil)
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+		assert.Equal(t, `Basic realm="logserver", charset="UTF-8"`, response.Header().Get("WWW-Authenticate"))
+	})
+	t.Run("Wrong Password", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/requests.json", nil)
+		request.SetBasicAuth("alice", "wrong")
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+	})
+	t.Run("Basic Auth", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/requests.json", nil)
+		request.SetBasicAuth("alice", "secret")
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusOK, response.Code)
+
+		// Session cookie authenticates subsequent requests
+		cookies := response.Result().Cookies()
+		assert.Equal(t, 1, len(cookies))
+		request = httptest.NewRequest(http.MethodGet, "/addresses.json", nil)
+		request.AddCookie(cookies[0])
+		response = httptest.NewRecorder()
+		h.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusOK, response.Code)
+	})
+	t.Run("Unconfigured", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/requests.json", nil)
+		response := httptest.NewRecorder()
+		(&Auth{Sessions: sessions}).Handler(mux).ServeHTTP(response, request)
+		assert.Equal(t, http.StatusUnauthorized, response.Code)
+	})
+	t.Run("Insecure", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/requests.json", nil)
+		response := httptest.NewRecorder()
+		(&Auth{Sessions: sessions, Insecure: true}).Handler(mux).ServeHTTP(response, request)
+		assert.Equal(t, http.StatusOK, response.Code)
+	})
+}
+
+func TestStart_NoAuth(t *testing.T) {
+	// Default flags configure no authentication
+	assert.ErrorIs(t, start(slog.New(slog.DiscardHandler)), ErrNoAuth)
+}
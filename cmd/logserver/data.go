@@ -17,20 +17,63 @@
 package main
 
 type Requests struct {
-	Total int        `json:"total"`
-	Start int64      `json:"start"`
-	End   int64      `json:"end"`
-	Rows  []*Request `json:"rows"`
-}
-
-type Request struct {
-	Timestamp int64             `json:"timestamp"`
-	Address   string            `json:"address"`
-	Protocol  string            `json:"protocol"`
-	Method    string            `json:"method"`
-	Host      string            `json:"host"`
-	URL       string            `json:"url"`
-	Headers   map[string]string `json:"headers"`
+	Total int              `json:"total"`
+	Start int64            `json:"start"`
+	End   int64            `json:"end"`
+	Rows  []map[string]any `json:"rows"`
+	// Cursor to request the next page after, if there may be one
+	Next string `json:"next,omitempty"`
+}
+
+type TimeSeries struct {
+	Total    int       `json:"total"`
+	Start    int64     `json:"start"`
+	End      int64     `json:"end"`
+	Interval string    `json:"interval"`
+	Timezone string    `json:"timezone"`
+	Split    string    `json:"split,omitempty"`
+	Rows     []*Bucket `json:"rows"`
+}
+
+type Bucket struct {
+	Start int64  `json:"start"`
+	End   int64  `json:"end"`
+	Value string `json:"value,omitempty"`
+	Count int    `json:"count"`
+}
+
+type VisitorSessions struct {
+	Total int               `json:"total"`
+	Start int64             `json:"start"`
+	End   int64             `json:"end"`
+	Rows  []*VisitorSession `json:"rows"`
+	// Whether there are earlier sessions than those in the total
+	More bool `json:"more,omitempty"`
+}
+
+type VisitorSession struct {
+	Address   string `json:"address"`
+	UserAgent string `json:"user_agent"`
+	Start     int64  `json:"start"`
+	End       int64  `json:"end"`
+	Duration  int64  `json:"duration"`
+	Requests  int    `json:"requests"`
+	Pages     int    `json:"pages"`
+	Entry     string `json:"entry"`
+	Exit      string `json:"exit"`
+	Referrer  string `json:"referrer"`
+}
+
+type Exclusions struct {
+	Rows []*Exclusion `json:"rows"`
+}
+
+type Exclusion struct {
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	URL       string `json:"url"`
+	UserAgent string `json:"user_agent"`
+	BuiltIn   bool   `json:"built_in"`
 }
 
 type Addresses struct {
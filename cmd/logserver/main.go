@@ -17,18 +17,85 @@
 package main
 
 import (
+	"aletheiaware.com/netgo"
+	"context"
 	"flag"
 	"log"
+	"log/slog"
+	"os"
+	"strings"
+	// Time series are bucketed in the browser's timezone, even on hosts without a timezone database
+	_ "time/tzdata"
 )
 
 var sqlite = flag.String("sqlite", "log.db", "Sqlite Database Name")
+var dsn = flag.String("dsn", "", "Database DSN (eg. postgres://user@host/logs or duckdb://log.duckdb), overrides -sqlite")
+var ipfilter = flag.String("ip-filter", "", "IP Filter Rules File")
+var geoip = flag.String("geoip", "", "MaxMind GeoIP Database")
+var credentials = flag.String("credentials", "", "Basic Auth Credentials File (username:bcrypt/argon2 hash)")
+var sessionKey = flag.String("session-key", "", "Session Signing Key File")
+var oidcIssuer = flag.String("oidc-issuer", "", "OpenID Connect Issuer URL")
+var oidcClientID = flag.String("oidc-client-id", "", "OpenID Connect Client ID")
+var oidcRedirectURL = flag.String("oidc-redirect-url", "", "OpenID Connect Redirect URL (eg. https://logs.example.com/callback)")
+var oidcUsers = flag.String("oidc-users", "", "OpenID Connect Allowed Emails or @Domains (required with -oidc-issuer)")
+var insecureNoAuth = flag.Bool("insecure-no-auth", false, "Serve Logs to Anyone when Neither -credentials nor -oidc-issuer is Given")
 
 func main() {
 	flag.Parse()
 
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-
-	if err := Serve(*sqlite); err != nil {
+	// Configure Logging
+	logger, logFile, err := netgo.SetupLogger()
+	if err != nil {
 		log.Fatal(err)
 	}
+	defer logFile.Close()
+	logger.Info("Log File", "name", logFile.Name())
+
+	if err := start(logger); err != nil {
+		logger.Error("Server Failed", "error", err)
+		logFile.Close()
+		os.Exit(1)
+	}
+}
+
+func start(logger *slog.Logger) error {
+	sessions, err := NewSessions(*sessionKey)
+	if err != nil {
+		return err
+	}
+	auth := &Auth{
+		Sessions: sessions,
+		Logger:   logger,
+	}
+	if *credentials != "" {
+		c, err := LoadCredentials(*credentials)
+		if err != nil {
+			return err
+		}
+		auth.Credentials = c
+	}
+	if *oidcIssuer != "" {
+		// Allowed users are required, NewOIDC refuses to start without them
+		users := strings.Split(*oidcUsers, ",")
+		// Client Secret is read from the environment to keep it out of the process list
+		o, err := NewOIDC(context.Background(), *oidcIssuer, *oidcClientID, os.Getenv("OIDC_CLIENT_SECRET"), *oidcRedirectURL, users)
+		if err != nil {
+			return err
+		}
+		auth.OIDC = o
+	}
+	if !auth.Enabled() {
+		// Fail closed, logs are only served without authentication when explicitly asked
+		if !*insecureNoAuth {
+			return ErrNoAuth
+		}
+		auth.Insecure = true
+		logger.Warn("Authentication Disabled")
+	}
+
+	database := *dsn
+	if database == "" {
+		database = *sqlite
+	}
+	return Serve(logger, database, *ipfilter, *geoip, auth)
 }
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"aletheiaware.com/netgo"
+	"aletheiaware.com/netgo/handler"
+	"aletheiaware.com/netgo/logdb"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PAGE_SIZE is the default number of requests in each page of /requests.json.
+	PAGE_SIZE = 100
+	// MAX_PAGE_SIZE limits the number of requests in each page of /requests.json, which is built in memory.
+	MAX_PAGE_SIZE = 10000
+	// FLUSH_ROWS is the number of requests streamed by /requests.ndjson between flushes.
+	FLUSH_ROWS = 1000
+)
+
+// REQUEST_COLUMNS are the columns of requests that can be selected, with the cursor of each request to resume after it.
+var REQUEST_COLUMNS = []string{"cursor", "timestamp", "time", "source", "address", "port", "protocol", "method", "host", "url"}
+
+// DEFAULT_REQUEST_COLUMNS are the columns of requests selected by default.
+var DEFAULT_REQUEST_COLUMNS = []string{"timestamp", "time", "address", "port", "protocol", "method", "host", "url"}
+
+// requestsHandler serves a page of the requests matching the filter, with their number and time span.
+func requestsHandler(logger *slog.Logger, store logdb.Store) http.Handler {
+	return handler.Log(handler.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter, err := filterFromQuery(logger, store, query)
+		if err != nil {
+			storeError(logger, w, err)
+			return
+		}
+		page, err := pageFromQuery(query, PAGE_SIZE, MAX_PAGE_SIZE)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		columns, err := columnsFromQuery(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		summary, err := store.Summarise(filter)
+		if err != nil {
+			storeError(logger, w, err)
+			return
+		}
+		result := &Requests{
+			Total: summary.Count,
+			Start: summary.Start,
+			End:   summary.End,
+			Rows:  []map[string]any{},
+		}
+		var last logdb.Cursor
+		if err := store.ScanRequests(filter, page, func(c logdb.Cursor, record *netgo.RequestRecord) error {
+			result.Rows = append(result.Rows, requestRow(columns, c, record))
+			last = c
+			return nil
+		}); err != nil {
+			storeError(logger, w, err)
+			return
+		}
+		if page.Limit > 0 && len(result.Rows) == page.Limit {
+			// Another page may follow
+			result.Next = last.String()
+		}
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			logger.Error("Encoding Failed", "error", err)
+		}
+	}), logger), logger)
+}
+
+// requestsStreamHandler streams the requests matching the filter as newline delimited JSON, writing each as it is read.
+func requestsStreamHandler(logger *slog.Logger, store logdb.Store) http.Handler {
+	return handler.Log(handler.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter, err := filterFromQuery(logger, store, query)
+		if err != nil {
+			storeError(logger, w, err)
+			return
+		}
+		// All requests by default, as they are not held in memory
+		page, err := pageFromQuery(query, 0, 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		columns, err := columnsFromQuery(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		controller := http.NewResponseController(w)
+		encoder := json.NewEncoder(w)
+		count := 0
+		if err := store.ScanRequests(filter, page, func(c logdb.Cursor, record *netgo.RequestRecord) error {
+			if count == 0 {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+			}
+			count++
+			if err := encoder.Encode(requestRow(columns, c, record)); err != nil {
+				return err
+			}
+			if count%FLUSH_ROWS == 0 {
+				controller.Flush()
+			}
+			return nil
+		}); err != nil {
+			if count == 0 {
+				storeError(logger, w, err)
+				return
+			}
+			// Too late to respond with an error, the stream ends early
+			logger.Error("Streaming Failed", "error", err)
+		}
+	}), logger), logger)
+}
+
+// pageFromQuery returns the page given by the query parameters; the cursor of the request to start after, the maximum number of requests, and the order.
+// The number of requests is the given default if unspecified, and is limited to the given maximum if not 0.
+func pageFromQuery(query url.Values, size, max int) (*logdb.Page, error) {
+	page := &logdb.Page{
+		Limit: size,
+	}
+	if a := netgo.QueryParameter(query, "after"); a != "" {
+		c, err := logdb.ParseCursor(a)
+		if err != nil {
+			return nil, err
+		}
+		page.After = c
+	}
+	if l := netgo.QueryParameter(query, "limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 0 || (max > 0 && (limit == 0 || limit > max)) {
+			return nil, fmt.Errorf("Invalid Limit: %s", l)
+		}
+		page.Limit = limit
+	}
+	switch o := netgo.QueryParameter(query, "order"); o {
+	case "", "asc":
+	case "desc":
+		page.Descending = true
+	default:
+		return nil, fmt.Errorf("Invalid Order: %s", o)
+	}
+	return page, nil
+}
+
+// columnsFromQuery returns the comma separated columns given by the query parameters, or the default columns.
+func columnsFromQuery(query url.Values) ([]string, error) {
+	c := netgo.QueryParameter(query, "columns")
+	if c == "" {
+		return DEFAULT_REQUEST_COLUMNS, nil
+	}
+	columns := strings.Split(c, ",")
+	for _, column := range columns {
+		if !slices.Contains(REQUEST_COLUMNS, column) {
+			return nil, fmt.Errorf("Invalid Column: %s", column)
+		}
+	}
+	return columns, nil
+}
+
+// requestRow returns the columns of the request.
+func requestRow(columns []string, c logdb.Cursor, r *netgo.RequestRecord) map[string]any {
+	row := make(map[string]any, len(columns))
+	for _, column := range columns {
+		switch column {
+		case "cursor":
+			row[column] = c.String()
+		case "timestamp":
+			row[column] = r.Time.Unix()
+		case "time":
+			row[column] = r.Time
+		case "source":
+			row[column] = r.Source
+		case "address":
+			row[column] = r.IP
+		case "port":
+			row[column] = r.Port
+		case "protocol":
+			row[column] = r.Protocol
+		case "method":
+			row[column] = r.Method
+		case "host":
+			row[column] = r.Host
+		case "url":
+			row[column] = r.URL.String()
+		}
+	}
+	return row
+}
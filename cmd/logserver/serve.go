@@ -19,295 +19,302 @@ package main
 import (
 	"aletheiaware.com/netgo"
 	"aletheiaware.com/netgo/handler"
-	"database/sql"
+	"aletheiaware.com/netgo/logdb"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
 	"html/template"
 	"io/fs"
-	"log"
+	"log/slog"
 	"math"
 	"net/http"
 	"net/url"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
 //go:embed assets
 var embeddedFS embed.FS
 
-func Serve(name string) error {
-	// Configure Logging
-	logFile, err := netgo.SetupLogging()
+// COUNT_LIMIT is the maximum number of values counted by each endpoint.
+const COUNT_LIMIT = 1000
+
+// MAX_BUCKETS is the number of buckets a time series is divided into when the interval is not given.
+const MAX_BUCKETS = 500
+
+// SESSION_GAP is the default inactivity after which a visitor's next request starts a new session.
+const SESSION_GAP = 30 * time.Minute
+
+func Serve(logger *slog.Logger, dsn, ipfilter, geoip string, auth *Auth) error {
+	// Schema is only changed by logparser
+	store, err := logdb.OpenLatest(dsn)
 	if err != nil {
 		return err
 	}
-	defer logFile.Close()
-	log.Println("Log File:", logFile.Name())
+	defer store.Close()
 
-	db, err := sql.Open("sqlite3", name)
+	mux, err := NewMux(logger, store)
 	if err != nil {
 		return err
 	}
 
+	// Authenticate Requests
+	auth.Attach(mux)
+	h := auth.Handler(mux)
+
+	// Filter Clients
+	if ipfilter != "" {
+		var lookup handler.CountryLookup
+		if geoip != "" {
+			l, err := handler.OpenMaxMindLookup(geoip)
+			if err != nil {
+				return err
+			}
+			defer l.Close()
+			lookup = l
+		}
+		rules, err := handler.NewIPRules(ipfilter, lookup, logger)
+		if err != nil {
+			return err
+		}
+		defer rules.Watch(10 * time.Second)()
+		logger.Info("IP Filter", "rules", ipfilter)
+		h = handler.IPFilter(h, rules, logger)
+	}
+
+	// Serve HTTP Requests
+	logger.Info("HTTP Server Listening", "address", ":80")
+	if err := http.ListenAndServe(":80", h); err != nil {
+		return err
+	}
+	return nil
+}
+
+// NewMux returns a multiplexer serving the assets, and the data of the requests in the store.
+func NewMux(logger *slog.Logger, store logdb.Store) (*http.ServeMux, error) {
 	// Create Multiplexer
 	mux := http.NewServeMux()
 
 	// Handle Static Assets
 	staticFS, err := fs.Sub(embeddedFS, path.Join("assets", "static"))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	handler.AttachStaticFSHandler(mux, staticFS, false, fmt.Sprintf("public, max-age=%d", 60*60*24*7*52)) // 52 week max-age
+	handler.AttachStaticFSHandler(mux, staticFS, false, fmt.Sprintf("public, max-age=%d", 60*60*24*7*52), logger) // 52 week max-age
 
 	// Parse Templates
 	templateFS, err := fs.Sub(embeddedFS, path.Join("assets", "template"))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	templates, err := template.ParseFS(templateFS, "*.go.html")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// TODO support exclude filters
-
-	// TODO sessions - how a single address interacted with the server over time
-
 	// Handle Request Data
-	mux.Handle("/requests.json", handler.Log(handler.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		raw := `SELECT tbl_requests.timestamp, tbl_requests.address, tbl_requests.protocol, tbl_requests.method, tbl_requests.host, tbl_requests.url FROM tbl_requests`
-		raw += requestFiltersFromQuery(r.URL.Query())
-		rows, err := db.Query(raw)
+	mux.Handle("/requests.json", requestsHandler(logger, store))
+	mux.Handle("/requests.ndjson", requestsStreamHandler(logger, store))
+	// Handle Time Series Data
+	mux.Handle("/timeseries.json", handler.Log(handler.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter, err := filterFromQuery(logger, store, query)
 		if err != nil {
-			log.Fatal(err)
-		}
-		defer rows.Close()
-
-		result := &Requests{
-			Start: math.MaxInt64,
+			storeError(logger, w, err)
+			return
 		}
-		for rows.Next() {
-			r := &Request{}
-			err = rows.Scan(&r.Timestamp, &r.Address, &r.Protocol, &r.Method, &r.Host, &r.URL)
+		location := time.UTC
+		if tz := netgo.QueryParameter(query, "timezone"); tz != "" {
+			l, err := time.LoadLocation(tz)
 			if err != nil {
-				log.Fatal(err)
-			}
-			result.Total++
-			if r.Timestamp < result.Start {
-				result.Start = r.Timestamp
+				http.Error(w, "Invalid Timezone: "+tz, http.StatusBadRequest)
+				return
 			}
-			if r.Timestamp > result.End {
-				result.End = r.Timestamp
-			}
-			result.Rows = append(result.Rows, r)
-		}
-		if err := rows.Err(); err != nil {
-			log.Fatal(err)
+			location = l
 		}
-		if err := json.NewEncoder(w).Encode(result); err != nil {
-			log.Fatal(err)
+		split := netgo.QueryParameter(query, "split")
+		if _, ok := logdb.SPLITS[split]; split != "" && !ok {
+			http.Error(w, "Invalid Split: "+split, http.StatusBadRequest)
+			return
 		}
-	}))))
-	// Handle Address Data
-	mux.Handle("/addresses.json", handler.Log(handler.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		raw := `SELECT tbl_requests.address, COUNT(tbl_requests.id) AS count FROM tbl_requests`
-		raw += requestFiltersFromQuery(r.URL.Query())
-		raw += ` GROUP BY tbl_requests.address`
-		raw += ` ORDER BY count DESC`
-		raw += ` LIMIT 1000`
-		rows, err := db.Query(raw)
+		summary, err := store.Summarise(filter)
 		if err != nil {
-			log.Fatal(err)
-		}
-		defer rows.Close()
-
-		result := &Addresses{}
-		for rows.Next() {
-			a := &Address{}
-			err = rows.Scan(&a.Address, &a.Count)
-			if err != nil {
-				log.Fatal(err)
+			storeError(logger, w, err)
+			return
+		}
+		interval := logdb.IntervalFor(summary.Start, summary.End, MAX_BUCKETS)
+		if i := netgo.QueryParameter(query, "interval"); i != "" {
+			if interval, err = logdb.ParseInterval(i); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
-			result.Total += a.Count
-			if a.Count > result.Limit {
-				result.Limit = a.Count
-			}
-			result.Rows = append(result.Rows, a)
-		}
-		if err := rows.Err(); err != nil {
-			log.Fatal(err)
 		}
-		if err := json.NewEncoder(w).Encode(result); err != nil {
-			log.Fatal(err)
-		}
-	}))))
-	// Handle Protocol Data
-	mux.Handle("/protocols.json", handler.Log(handler.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		raw := `SELECT tbl_requests.protocol, COUNT(tbl_requests.id) AS count FROM tbl_requests`
-		raw += requestFiltersFromQuery(r.URL.Query())
-		raw += ` GROUP BY tbl_requests.protocol`
-		raw += ` ORDER BY count DESC`
-		raw += ` LIMIT 1000`
-		rows, err := db.Query(raw)
+		buckets, err := store.TimeSeries(filter, interval, location, split)
 		if err != nil {
-			log.Fatal(err)
+			storeError(logger, w, err)
+			return
 		}
-		defer rows.Close()
-
-		result := &Protocols{}
-		for rows.Next() {
-			p := &Protocol{}
-			err = rows.Scan(&p.Protocol, &p.Count)
-			if err != nil {
-				log.Fatal(err)
-			}
-			result.Total += p.Count
-			if p.Count > result.Limit {
-				result.Limit = p.Count
-			}
-			result.Rows = append(result.Rows, p)
+		result := &TimeSeries{
+			Total:    summary.Count,
+			Start:    summary.Start,
+			End:      summary.End,
+			Interval: string(interval),
+			Timezone: location.String(),
+			Split:    split,
+			Rows:     []*Bucket{},
 		}
-		if err := rows.Err(); err != nil {
-			log.Fatal(err)
+		for _, b := range buckets {
+			result.Rows = append(result.Rows, &Bucket{Start: b.Start, End: b.End, Value: b.Value, Count: b.Count})
 		}
 		if err := json.NewEncoder(w).Encode(result); err != nil {
-			log.Fatal(err)
-		}
-	}))))
-	// Handle Method Data
-	mux.Handle("/methods.json", handler.Log(handler.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		raw := `SELECT tbl_requests.method, COUNT(tbl_requests.id) AS count FROM tbl_requests`
-		raw += requestFiltersFromQuery(r.URL.Query())
-		raw += ` GROUP BY tbl_requests.method`
-		raw += ` ORDER BY count DESC`
-		raw += ` LIMIT 1000`
-		rows, err := db.Query(raw)
-		if err != nil {
-			log.Fatal(err)
+			logger.Error("Encoding Failed", "error", err)
+		}
+	}), logger), logger))
+	// Handle Session Data
+	mux.Handle("/sessions.json", handler.Log(handler.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		gap := SESSION_GAP
+		if g := netgo.QueryParameter(query, "gap"); g != "" {
+			d, err := time.ParseDuration(g)
+			if err != nil || d <= 0 {
+				http.Error(w, "Invalid Session Gap: "+g, http.StatusBadRequest)
+				return
+			}
+			gap = d
 		}
-		defer rows.Close()
-
-		result := &Methods{}
-		for rows.Next() {
-			m := &Method{}
-			err = rows.Scan(&m.Method, &m.Count)
+		var byAgent bool
+		if a := netgo.QueryParameter(query, "agent"); a != "" {
+			b, err := strconv.ParseBool(a)
 			if err != nil {
-				log.Fatal(err)
+				http.Error(w, "Invalid Session Agent: "+a, http.StatusBadRequest)
+				return
 			}
-			result.Total += m.Count
-			if m.Count > result.Limit {
-				result.Limit = m.Count
-			}
-			result.Rows = append(result.Rows, m)
-		}
-		if err := rows.Err(); err != nil {
-			log.Fatal(err)
+			byAgent = b
 		}
-		if err := json.NewEncoder(w).Encode(result); err != nil {
-			log.Fatal(err)
+		filter, err := filterFromQuery(logger, store, query)
+		if err != nil {
+			storeError(logger, w, err)
+			return
 		}
-	}))))
-	// Handle URL Data
-	mux.Handle("/urls.json", handler.Log(handler.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		raw := `SELECT tbl_requests.url, COUNT(tbl_requests.id) AS count FROM tbl_requests`
-		raw += requestFiltersFromQuery(r.URL.Query())
-		raw += ` GROUP BY tbl_requests.url`
-		raw += ` ORDER BY count DESC`
-		raw += ` LIMIT 1000`
-		rows, err := db.Query(raw)
+		// One more than the limit shows whether there are more
+		sessions, err := store.Sessions(filter, gap, byAgent, COUNT_LIMIT+1)
 		if err != nil {
-			log.Fatal(err)
+			storeError(logger, w, err)
+			return
 		}
-		defer rows.Close()
-
-		result := &URLs{}
-		for rows.Next() {
-			u := &URL{}
-			err = rows.Scan(&u.URL, &u.Count)
-			if err != nil {
-				log.Fatal(err)
+		result := &VisitorSessions{
+			Start: math.MaxInt64,
+		}
+		if len(sessions) > COUNT_LIMIT {
+			sessions = sessions[:COUNT_LIMIT]
+			result.More = true
+		}
+		result.Total = len(sessions)
+		for _, s := range sessions {
+			if s.Start < result.Start {
+				result.Start = s.Start
 			}
-			result.Total += u.Count
-			if u.Count > result.Limit {
-				result.Limit = u.Count
+			if s.End > result.End {
+				result.End = s.End
 			}
-			result.Rows = append(result.Rows, u)
 		}
-		if err := rows.Err(); err != nil {
-			log.Fatal(err)
+		for _, s := range sessions {
+			result.Rows = append(result.Rows, &VisitorSession{
+				Address:   s.Address,
+				UserAgent: s.UserAgent,
+				Start:     s.Start,
+				End:       s.End,
+				Duration:  s.End - s.Start,
+				Requests:  s.Requests,
+				Pages:     s.Pages,
+				Entry:     s.Entry,
+				Exit:      s.Exit,
+				Referrer:  s.Referrer,
+			})
 		}
 		if err := json.NewEncoder(w).Encode(result); err != nil {
-			log.Fatal(err)
+			logger.Error("Encoding Failed", "error", err)
 		}
-	}))))
-	// Handle Header Key Data
-	mux.Handle("/header-keys.json", handler.Log(handler.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		raw := `SELECT tbl_headers.key, COUNT(tbl_headers.id) AS count FROM tbl_headers`
-		raw += headerFiltersFromQuery(r.URL.Query())
-		raw += ` GROUP BY tbl_headers.key`
-		raw += ` ORDER BY count DESC`
-		raw += ` LIMIT 1000`
-		rows, err := db.Query(raw)
+	}), logger), logger))
+	// Handle Exclusion Data
+	mux.Handle("/exclusions.json", handler.Log(handler.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exclusions, err := store.Exclusions()
 		if err != nil {
-			log.Fatal(err)
+			internalError(logger, w, err)
+			return
+		}
+		result := &Exclusions{}
+		for _, e := range exclusions {
+			result.Rows = append(result.Rows, &Exclusion{
+				Name:      e.Name,
+				Address:   e.Address,
+				URL:       e.URL,
+				UserAgent: e.UserAgent,
+				BuiltIn:   e.BuiltIn,
+			})
 		}
-		defer rows.Close()
-
-		result := &Headers{}
-		for rows.Next() {
-			h := &Header{}
-			err = rows.Scan(&h.Key, &h.Count)
-			if err != nil {
-				log.Fatal(err)
-			}
-			result.Total += h.Count
-			if h.Count > result.Limit {
-				result.Limit = h.Count
-			}
-			result.Rows = append(result.Rows, h)
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			logger.Error("Encoding Failed", "error", err)
 		}
-		if err := rows.Err(); err != nil {
-			log.Fatal(err)
+	}), logger), logger))
+	// Handle Address Data
+	mux.Handle("/addresses.json", countHandler(logger, store, store.Addresses, func(counts []*logdb.Count) any {
+		result := &Addresses{}
+		result.Total, result.Limit = totalAndLimit(counts)
+		for _, c := range counts {
+			result.Rows = append(result.Rows, &Address{Address: c.Value, Count: c.Count})
 		}
-		if err := json.NewEncoder(w).Encode(result); err != nil {
-			log.Fatal(err)
+		return result
+	}))
+	// Handle Protocol Data
+	mux.Handle("/protocols.json", countHandler(logger, store, store.Protocols, func(counts []*logdb.Count) any {
+		result := &Protocols{}
+		result.Total, result.Limit = totalAndLimit(counts)
+		for _, c := range counts {
+			result.Rows = append(result.Rows, &Protocol{Protocol: c.Value, Count: c.Count})
 		}
-	}))))
-	// Handle Header Value Data
-	mux.Handle("/header-values.json", handler.Log(handler.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		raw := `SELECT tbl_headers.value, COUNT(tbl_headers.id) AS count FROM tbl_headers`
-		raw += headerFiltersFromQuery(r.URL.Query())
-		raw += ` GROUP BY tbl_headers.value`
-		raw += ` ORDER BY count DESC`
-		raw += ` LIMIT 1000`
-		rows, err := db.Query(raw)
-		if err != nil {
-			log.Fatal(err)
+		return result
+	}))
+	// Handle Method Data
+	mux.Handle("/methods.json", countHandler(logger, store, store.Methods, func(counts []*logdb.Count) any {
+		result := &Methods{}
+		result.Total, result.Limit = totalAndLimit(counts)
+		for _, c := range counts {
+			result.Rows = append(result.Rows, &Method{Method: c.Value, Count: c.Count})
 		}
-		defer rows.Close()
-
-		result := &Headers{}
-		for rows.Next() {
-			h := &Header{}
-			err = rows.Scan(&h.Value, &h.Count)
-			if err != nil {
-				log.Fatal(err)
-			}
-			result.Total += h.Count
-			if h.Count > result.Limit {
-				result.Limit = h.Count
-			}
-			result.Rows = append(result.Rows, h)
+		return result
+	}))
+	// Handle URL Data
+	mux.Handle("/urls.json", countHandler(logger, store, store.URLs, func(counts []*logdb.Count) any {
+		result := &URLs{}
+		result.Total, result.Limit = totalAndLimit(counts)
+		for _, c := range counts {
+			result.Rows = append(result.Rows, &URL{URL: c.Value, Count: c.Count})
 		}
-		if err := rows.Err(); err != nil {
-			log.Fatal(err)
+		return result
+	}))
+	// Handle Header Key Data
+	mux.Handle("/header-keys.json", countHandler(logger, store, store.HeaderKeys, func(counts []*logdb.Count) any {
+		result := &Headers{}
+		result.Total, result.Limit = totalAndLimit(counts)
+		for _, c := range counts {
+			result.Rows = append(result.Rows, &Header{Key: c.Value, Count: c.Count})
 		}
-		if err := json.NewEncoder(w).Encode(result); err != nil {
-			log.Fatal(err)
+		return result
+	}))
+	// Handle Header Value Data
+	mux.Handle("/header-values.json", countHandler(logger, store, store.HeaderValues, func(counts []*logdb.Count) any {
+		result := &Headers{}
+		result.Total, result.Limit = totalAndLimit(counts)
+		for _, c := range counts {
+			result.Rows = append(result.Rows, &Header{Value: c.Value, Count: c.Count})
 		}
-	}))))
+		return result
+	}))
 
 	// Handle Index
 	mux.Handle("/", handler.Log(handler.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -316,170 +323,93 @@ func Serve(name string) error {
 		}{
 			Live: netgo.IsLive(),
 		}); err != nil {
-			log.Println(err)
+			logger.Error("Template Failed", "error", err)
 		}
-	}))))
+	}), logger), logger))
 
-	// Serve HTTP Requests
-	log.Println("HTTP Server Listening on :80")
-	if err := http.ListenAndServe(":80", mux); err != nil {
-		return err
-	}
-	return nil
+	return mux, nil
 }
 
-func requestFiltersFromQuery(query url.Values) (result string) {
-	var (
-		filter        string
-		headerfilters []string
-	)
-	hkey := netgo.QueryParameter(query, "header-key")
-	if hkey != "" {
-		if strings.HasPrefix(hkey, "-") {
-			filter = fmt.Sprintf(`tbl_headers.key != '%s'`, hkey[1:])
-		} else {
-			filter = fmt.Sprintf(`tbl_headers.key = '%s'`, hkey)
-		}
-		headerfilters = append(headerfilters, filter)
-	}
-	hvalue := netgo.QueryParameter(query, "header-value")
-	if hvalue != "" {
-		if strings.HasPrefix(hvalue, "-") {
-			filter = fmt.Sprintf(`tbl_headers.value != '%s'`, hvalue[1:])
-		} else {
-			filter = fmt.Sprintf(`tbl_headers.value = '%s'`, hvalue)
-		}
-		headerfilters = append(headerfilters, filter)
-	}
-	if len(headerfilters) > 0 {
-		result += ` INNER JOIN tbl_headers ON tbl_requests.id = tbl_headers.request AND ` + strings.Join(headerfilters, ` AND `)
-	}
+// ErrUnknownExclusion is returned when a filter excludes requests with an exclusion that does not exist.
+var ErrUnknownExclusion = errors.New("Unknown Exclusion")
 
-	var requestfilters []string
-	start := netgo.ParseInt(netgo.QueryParameter(query, "start"))
-	if start != 0 {
-		requestfilters = append(requestfilters, fmt.Sprintf(`tbl_requests.timestamp >= %d`, start))
-	}
-	end := netgo.ParseInt(netgo.QueryParameter(query, "end"))
-	if end != 0 {
-		requestfilters = append(requestfilters, fmt.Sprintf(`tbl_requests.timestamp <= %d`, end))
-	}
-	address := netgo.QueryParameter(query, "address")
-	if address != "" {
-		if strings.HasPrefix(address, "-") {
-			filter = fmt.Sprintf(`tbl_requests.address != '%s'`, address[1:])
-		} else {
-			filter = fmt.Sprintf(`tbl_requests.address = '%s'`, address)
-		}
-		requestfilters = append(requestfilters, filter)
+// storeError responds with the reason a filter is invalid, or otherwise an internal error.
+func storeError(logger *slog.Logger, w http.ResponseWriter, err error) {
+	var e *logdb.ExpressionError
+	if errors.As(err, &e) {
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
 	}
-	protocol := netgo.QueryParameter(query, "protocol")
-	if protocol != "" {
-		if strings.HasPrefix(protocol, "-") {
-			filter = fmt.Sprintf(`tbl_requests.protocol != '%s'`, protocol[1:])
-		} else {
-			filter = fmt.Sprintf(`tbl_requests.protocol = '%s'`, protocol)
-		}
-		requestfilters = append(requestfilters, filter)
+	if errors.Is(err, ErrUnknownExclusion) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	method := netgo.QueryParameter(query, "method")
-	if method != "" {
-		if strings.HasPrefix(method, "-") {
-			filter = fmt.Sprintf(`tbl_requests.method != '%s'`, method[1:])
-		} else {
-			filter = fmt.Sprintf(`tbl_requests.method = '%s'`, method)
-		}
-		requestfilters = append(requestfilters, filter)
-	}
-	url := netgo.QueryParameter(query, "url")
-	if url != "" {
-		if strings.HasPrefix(url, "-") {
-			filter = fmt.Sprintf(`tbl_requests.url != '%s'`, url[1:])
-		} else {
-			filter = fmt.Sprintf(`tbl_requests.url = '%s'`, url)
-		}
-		requestfilters = append(requestfilters, filter)
-	}
-	if len(requestfilters) > 0 {
-		result += ` WHERE ` + strings.Join(requestfilters, ` AND `)
-	}
-	return
+	internalError(logger, w, err)
 }
 
-func headerFiltersFromQuery(query url.Values) (result string) {
-	var (
-		filter         string
-		requestfilters []string
-	)
-	start := netgo.ParseInt(netgo.QueryParameter(query, "start"))
-	if start != 0 {
-		requestfilters = append(requestfilters, fmt.Sprintf(`tbl_requests.timestamp >= %d`, start))
-	}
-	end := netgo.ParseInt(netgo.QueryParameter(query, "end"))
-	if end != 0 {
-		requestfilters = append(requestfilters, fmt.Sprintf(`tbl_requests.timestamp <= %d`, end))
-	}
-	address := netgo.QueryParameter(query, "address")
-	if address != "" {
-		if strings.HasPrefix(address, "-") {
-			filter = fmt.Sprintf(`tbl_requests.address != '%s'`, address)
-		} else {
-			filter = fmt.Sprintf(`tbl_requests.address = '%s'`, address)
-		}
-		requestfilters = append(requestfilters, filter)
-	}
-	protocol := netgo.QueryParameter(query, "protocol")
-	if protocol != "" {
-		if strings.HasPrefix(protocol, "-") {
-			filter = fmt.Sprintf(`tbl_requests.protocol != '%s'`, protocol)
-		} else {
-			filter = fmt.Sprintf(`tbl_requests.protocol = '%s'`, protocol)
-		}
-		requestfilters = append(requestfilters, filter)
-	}
-	method := netgo.QueryParameter(query, "method")
-	if method != "" {
-		if strings.HasPrefix(method, "-") {
-			filter = fmt.Sprintf(`tbl_requests.method != '%s'`, method)
-		} else {
-			filter = fmt.Sprintf(`tbl_requests.method = '%s'`, method)
-		}
-		requestfilters = append(requestfilters, filter)
-	}
-	url := netgo.QueryParameter(query, "url")
-	if url != "" {
-		if strings.HasPrefix(url, "-") {
-			filter = fmt.Sprintf(`tbl_requests.url != '%s'`, url)
-		} else {
-			filter = fmt.Sprintf(`tbl_requests.url = '%s'`, url)
-		}
-		requestfilters = append(requestfilters, filter)
-	}
-	if len(requestfilters) > 0 {
-		result += ` INNER JOIN tbl_requests ON tbl_requests.id = tbl_headers.request AND ` + strings.Join(requestfilters, ` AND `)
-	}
+func internalError(logger *slog.Logger, w http.ResponseWriter, err error) {
+	logger.Error("Internal Error", "error", err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
 
-	var headerfilters []string
-	hkey := netgo.QueryParameter(query, "header-key")
-	if hkey != "" {
-		if strings.HasPrefix(hkey, "-") {
-			filter = fmt.Sprintf(`tbl_headers.key != '%s'`, hkey)
-		} else {
-			filter = fmt.Sprintf(`tbl_headers.key = '%s'`, hkey)
-		}
-		headerfilters = append(headerfilters, filter)
+// countHandler serves the values counted by the store, encoded as the result.
+func countHandler(logger *slog.Logger, store logdb.Store, count func(*logdb.Filter, int) ([]*logdb.Count, error), result func([]*logdb.Count) any) http.Handler {
+	return handler.Log(handler.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter, err := filterFromQuery(logger, store, r.URL.Query())
+		if err != nil {
+			storeError(logger, w, err)
+			return
+		}
+		counts, err := count(filter, COUNT_LIMIT)
+		if err != nil {
+			storeError(logger, w, err)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(result(counts)); err != nil {
+			logger.Error("Encoding Failed", "error", err)
+		}
+	}), logger), logger)
+}
+
+// totalAndLimit returns the sum and the maximum of the counts.
+func totalAndLimit(counts []*logdb.Count) (total, limit int) {
+	for _, c := range counts {
+		total += c.Count
+		if c.Count > limit {
+			limit = c.Count
+		}
 	}
-	hvalue := netgo.QueryParameter(query, "header-value")
-	if hvalue != "" {
-		if strings.HasPrefix(hvalue, "-") {
-			filter = fmt.Sprintf(`tbl_headers.value != '%s'`, hvalue)
-		} else {
-			filter = fmt.Sprintf(`tbl_headers.value = '%s'`, hvalue)
-		}
-		headerfilters = append(headerfilters, filter)
+	return
+}
+
+// filterFromQuery returns the filter given by the query parameters, excluding requests with the comma separated names of exclusions.
+func filterFromQuery(logger *slog.Logger, store logdb.Store, query url.Values) (*logdb.Filter, error) {
+	f := &logdb.Filter{
+		Start:       netgo.ParseInt(netgo.QueryParameter(query, "start"), logger),
+		End:         netgo.ParseInt(netgo.QueryParameter(query, "end"), logger),
+		Address:     netgo.QueryParameter(query, "address"),
+		Port:        netgo.QueryParameter(query, "port"),
+		Protocol:    netgo.QueryParameter(query, "protocol"),
+		Method:      netgo.QueryParameter(query, "method"),
+		URL:         netgo.QueryParameter(query, "url"),
+		HeaderKey:   netgo.QueryParameter(query, "header-key"),
+		HeaderValue: netgo.QueryParameter(query, "header-value"),
+		Tag:         netgo.QueryParameter(query, "tag"),
 	}
-	if len(headerfilters) > 0 {
-		result += ` WHERE ` + strings.Join(headerfilters, ` AND `)
+	if names := netgo.QueryParameter(query, "exclude"); names != "" {
+		exclusions, err := store.Exclusions()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range strings.Split(names, ",") {
+			i := slices.IndexFunc(exclusions, func(e *logdb.Exclusion) bool {
+				return e.Name == name
+			})
+			if i < 0 {
+				return nil, fmt.Errorf("%w: %s", ErrUnknownExclusion, name)
+			}
+			f.Exclude = append(f.Exclude, exclusions[i])
+		}
 	}
-	return
+	return f, nil
 }
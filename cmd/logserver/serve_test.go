@@ -0,0 +1,582 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"aletheiaware.com/netgo"
+	"aletheiaware.com/netgo/logdb"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// HOSTILE_VALUES would break, or inject into, queries built by formatting values into SQL.
+var HOSTILE_VALUES = []string{
+	`'`,
+	`O'Brien`,
+	`' OR '1'='1`,
+	`'; DROP TABLE tbl_requests; --`,
+	`-' OR 1=1 --`,
+	`?`,
+	`$1`,
+	`\`,
+	`"`,
+	`%_`,
+}
+
+// DATA_ENDPOINTS serve the data of requests, and accept the same filter parameters.
+var DATA_ENDPOINTS = []string{
+	"/requests.json",
+	"/timeseries.json",
+	"/sessions.json",
+	"/addresses.json",
+	"/protocols.json",
+	"/methods.json",
+	"/urls.json",
+	"/header-keys.json",
+	"/header-values.json",
+}
+
+// FILTER_PARAMETERS are the query parameters accepted by each data endpoint.
+var FILTER_PARAMETERS = []string{
+	"address",
+	"protocol",
+	"method",
+	"url",
+	"header-key",
+	"header-value",
+}
+
+func TestServe_HostileValues(t *testing.T) {
+	store, err := logdb.Open(filepath.Join(t.TempDir(), "log.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	// Record a request with each hostile value in every field
+	w, err := store.NewWriter()
+	assert.Nil(t, err)
+	assert.Nil(t, w.Begin())
+	f := &logdb.File{Name: "test.log"}
+	assert.Nil(t, w.AddFile(f))
+	for i, v := range HOSTILE_VALUES {
+		assert.Nil(t, w.AddRequest(f.ID, &netgo.RequestRecord{
+			Time:     time.Unix(int64(i+1), 0),
+			Source:   netgo.REQUEST_LOG,
+			IP:       v,
+			Protocol: v,
+			Method:   v,
+			Host:     "example.com",
+			URL:      &url.URL{Path: v},
+			Header:   http.Header{v: []string{v}},
+		}))
+	}
+	assert.Nil(t, w.Commit())
+	assert.Nil(t, w.Close())
+
+	mux, err := NewMux(slog.New(slog.DiscardHandler), store)
+	assert.Nil(t, err)
+
+	for _, endpoint := range DATA_ENDPOINTS {
+		for _, parameter := range FILTER_PARAMETERS {
+			for _, v := range HOSTILE_VALUES {
+				if parameter == "url" {
+					// URLs are recorded escaped
+					v = (&url.URL{Path: v}).String()
+				}
+				t.Run(endpoint+"?"+parameter+"="+v, func(t *testing.T) {
+					// Expressions are either valid, or rejected
+					response := httptest.NewRecorder()
+					mux.ServeHTTP(response, httptest.NewRequest(http.MethodGet, endpoint+"?"+url.Values{parameter: []string{v}}.Encode(), nil))
+					assert.Contains(t, []int{http.StatusOK, http.StatusBadRequest}, response.Code)
+
+					// Only the request with the value matches it as a literal
+					response = httptest.NewRecorder()
+					mux.ServeHTTP(response, httptest.NewRequest(http.MethodGet, endpoint+"?"+url.Values{parameter: []string{literal(v)}}.Encode(), nil))
+					assert.Equal(t, http.StatusOK, response.Code)
+					var result struct {
+						Total int               `json:"total"`
+						Rows  []json.RawMessage `json:"rows"`
+					}
+					assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &result))
+					assert.Equal(t, 1, result.Total)
+					assert.Equal(t, 1, len(result.Rows))
+				})
+			}
+		}
+	}
+
+	// Nothing was dropped
+	records, err := store.Requests(&logdb.Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, len(HOSTILE_VALUES), len(records))
+}
+
+func TestServe_InvalidFilter(t *testing.T) {
+	store, err := logdb.Open(filepath.Join(t.TempDir(), "log.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	mux, err := NewMux(slog.New(slog.DiscardHandler), store)
+	assert.Nil(t, err)
+
+	for _, endpoint := range DATA_ENDPOINTS {
+		t.Run(endpoint, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			mux.ServeHTTP(response, httptest.NewRequest(http.MethodGet, endpoint+"?method=GET&port=80|http", nil))
+			assert.Equal(t, http.StatusBadRequest, response.Code)
+			assert.Equal(t, "Invalid Port Filter at Column 4: Invalid Number\n", response.Body.String())
+		})
+	}
+}
+
+func TestServe_Sessions(t *testing.T) {
+	store, err := logdb.Open(filepath.Join(t.TempDir(), "log.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	w, err := store.NewWriter()
+	assert.Nil(t, err)
+	assert.Nil(t, w.Begin())
+	f := &logdb.File{Name: "test.log"}
+	assert.Nil(t, w.AddFile(f))
+	for _, r := range []struct {
+		timestamp int64
+		path      string
+	}{
+		{100, "/"},
+		{400, "/about"},
+		{1000, "/contact"},
+	} {
+		assert.Nil(t, w.AddRequest(f.ID, &netgo.RequestRecord{
+			Time:     time.Unix(r.timestamp, 0),
+			Source:   netgo.REQUEST_LOG,
+			IP:       "192.0.2.1",
+			Protocol: "HTTP/1.1",
+			Method:   "GET",
+			Host:     "example.com",
+			URL:      &url.URL{Path: r.path},
+			Header:   http.Header{"User-Agent": []string{"curl"}},
+		}))
+	}
+	assert.Nil(t, w.Commit())
+	assert.Nil(t, w.Close())
+
+	mux, err := NewMux(slog.New(slog.DiscardHandler), store)
+	assert.Nil(t, err)
+
+	for name, test := range map[string]struct {
+		query    string
+		expected []*VisitorSession
+	}{
+		"Default": {"", []*VisitorSession{
+			{Address: "192.0.2.1", UserAgent: "curl", Start: 100, End: 1000, Duration: 900, Requests: 3, Pages: 3, Entry: "/", Exit: "/contact"},
+		}},
+		"Gap": {"?gap=5m", []*VisitorSession{
+			{Address: "192.0.2.1", UserAgent: "curl", Start: 1000, End: 1000, Requests: 1, Pages: 1, Entry: "/contact", Exit: "/contact"},
+			{Address: "192.0.2.1", UserAgent: "curl", Start: 100, End: 400, Duration: 300, Requests: 2, Pages: 2, Entry: "/", Exit: "/about"},
+		}},
+		"Agent": {"?agent=true&url=-/about", []*VisitorSession{
+			{Address: "192.0.2.1", UserAgent: "curl", Start: 100, End: 1000, Duration: 900, Requests: 2, Pages: 2, Entry: "/", Exit: "/contact"},
+		}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			mux.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/sessions.json"+test.query, nil))
+			assert.Equal(t, http.StatusOK, response.Code)
+			var result VisitorSessions
+			assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &result))
+			assert.Equal(t, len(test.expected), result.Total)
+			assert.False(t, result.More)
+			assert.Equal(t, int64(100), result.Start)
+			assert.Equal(t, test.expected, result.Rows)
+		})
+	}
+	for _, query := range []string{"?gap=soon", "?gap=-1m", "?agent=maybe"} {
+		t.Run(query, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			mux.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/sessions.json"+query, nil))
+			assert.Equal(t, http.StatusBadRequest, response.Code)
+		})
+	}
+}
+
+func TestServe_SessionsLimit(t *testing.T) {
+	store, err := logdb.Open(filepath.Join(t.TempDir(), "log.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	// One more visitor than the limit
+	w, err := store.NewWriter()
+	assert.Nil(t, err)
+	assert.Nil(t, w.Begin())
+	f := &logdb.File{Name: "test.log"}
+	assert.Nil(t, w.AddFile(f))
+	for i := range COUNT_LIMIT + 1 {
+		assert.Nil(t, w.AddRequest(f.ID, &netgo.RequestRecord{
+			Time:     time.Unix(int64(i+1), 0),
+			Source:   netgo.REQUEST_LOG,
+			IP:       fmt.Sprintf("10.0.%d.%d", i/256, i%256),
+			Protocol: "HTTP/1.1",
+			Method:   "GET",
+			Host:     "example.com",
+			URL:      &url.URL{Path: "/"},
+		}))
+	}
+	assert.Nil(t, w.Commit())
+	assert.Nil(t, w.Close())
+
+	mux, err := NewMux(slog.New(slog.DiscardHandler), store)
+	assert.Nil(t, err)
+
+	response := httptest.NewRecorder()
+	mux.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/sessions.json", nil))
+	assert.Equal(t, http.StatusOK, response.Code)
+	var result VisitorSessions
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &result))
+	assert.Equal(t, COUNT_LIMIT, result.Total)
+	assert.True(t, result.More)
+	assert.Equal(t, COUNT_LIMIT, len(result.Rows))
+	// Latest sessions are shown, newest first
+	assert.Equal(t, int64(2), result.Start)
+	assert.Equal(t, int64(COUNT_LIMIT+1), result.End)
+	assert.Equal(t, int64(COUNT_LIMIT+1), result.Rows[0].Start)
+}
+
+func TestServe_Exclusions(t *testing.T) {
+	store, err := logdb.Open(filepath.Join(t.TempDir(), "log.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	w, err := store.NewWriter()
+	assert.Nil(t, err)
+	assert.Nil(t, w.Begin())
+	f := &logdb.File{Name: "test.log"}
+	assert.Nil(t, w.AddFile(f))
+	for i, r := range []struct {
+		address, path, agent string
+	}{
+		{"192.0.2.1", "/", "Mozilla/5.0"},
+		{"192.0.2.2", "/", "Googlebot/2.1"},
+		{"192.0.2.3", "/health", "kube-probe/1.30"},
+		{"198.51.100.1", "/", "Mozilla/5.0"},
+	} {
+		assert.Nil(t, w.AddRequest(f.ID, &netgo.RequestRecord{
+			Time:     time.Unix(int64(i+1), 0),
+			Source:   netgo.REQUEST_LOG,
+			IP:       r.address,
+			Protocol: "HTTP/1.1",
+			Method:   "GET",
+			Host:     "example.com",
+			URL:      &url.URL{Path: r.path},
+			Header:   http.Header{"User-Agent": []string{r.agent}},
+		}))
+	}
+	assert.Nil(t, w.Commit())
+	assert.Nil(t, w.Close())
+	assert.Nil(t, store.SaveExclusion(&logdb.Exclusion{Name: "office", Address: "198.51.100.0/24"}))
+
+	mux, err := NewMux(slog.New(slog.DiscardHandler), store)
+	assert.Nil(t, err)
+
+	response := httptest.NewRecorder()
+	mux.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/exclusions.json", nil))
+	assert.Equal(t, http.StatusOK, response.Code)
+	var exclusions Exclusions
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &exclusions))
+	var names []string
+	for _, e := range exclusions.Rows {
+		names = append(names, e.Name)
+	}
+	assert.Equal(t, []string{logdb.EXCLUSION_BOTS, logdb.EXCLUSION_HEALTH, "office"}, names)
+
+	for query, expected := range map[string][]*Address{
+		"":                           {{"192.0.2.1", 1}, {"192.0.2.2", 1}, {"192.0.2.3", 1}, {"198.51.100.1", 1}},
+		"?exclude=office":            {{"192.0.2.1", 1}, {"192.0.2.2", 1}, {"192.0.2.3", 1}},
+		"?exclude=bots,health":       {{"192.0.2.1", 1}, {"198.51.100.1", 1}},
+		"?exclude=bots,office&url=/": {{"192.0.2.1", 1}},
+	} {
+		t.Run(query, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			mux.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/addresses.json"+query, nil))
+			assert.Equal(t, http.StatusOK, response.Code)
+			var result Addresses
+			assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &result))
+			assert.ElementsMatch(t, expected, result.Rows)
+		})
+	}
+
+	for _, endpoint := range DATA_ENDPOINTS {
+		t.Run(endpoint, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			mux.ServeHTTP(response, httptest.NewRequest(http.MethodGet, endpoint+"?exclude=bots,nope", nil))
+			assert.Equal(t, http.StatusBadRequest, response.Code)
+			assert.Equal(t, "Unknown Exclusion: nope\n", response.Body.String())
+		})
+	}
+}
+
+func TestServe_Tag(t *testing.T) {
+	store, err := logdb.Open(filepath.Join(t.TempDir(), "log.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	w, err := store.NewWriter()
+	assert.Nil(t, err)
+	assert.Nil(t, w.Begin())
+	for i, r := range []struct {
+		tag, address string
+	}{
+		{"host1", "192.0.2.1"},
+		{"host2", "192.0.2.2"},
+		{"", "192.0.2.3"},
+	} {
+		f := &logdb.File{Name: fmt.Sprintf("%d.log", i), Tag: r.tag}
+		assert.Nil(t, w.AddFile(f))
+		assert.Nil(t, w.AddRequest(f.ID, &netgo.RequestRecord{
+			Time:     time.Unix(int64(i+1), 0),
+			Source:   netgo.REQUEST_LOG,
+			IP:       r.address,
+			Protocol: "HTTP/1.1",
+			Method:   "GET",
+			Host:     "example.com",
+			URL:      &url.URL{Path: "/"},
+		}))
+	}
+	assert.Nil(t, w.Commit())
+	assert.Nil(t, w.Close())
+
+	mux, err := NewMux(slog.New(slog.DiscardHandler), store)
+	assert.Nil(t, err)
+
+	for query, expected := range map[string][]*Address{
+		"":           {{"192.0.2.1", 1}, {"192.0.2.2", 1}, {"192.0.2.3", 1}},
+		"?tag=host1": {{"192.0.2.1", 1}},
+		"?tag=host2": {{"192.0.2.2", 1}},
+		"?tag=host3": nil,
+	} {
+		t.Run(query, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			mux.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/addresses.json"+query, nil))
+			assert.Equal(t, http.StatusOK, response.Code)
+			var result Addresses
+			assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &result))
+			assert.ElementsMatch(t, expected, result.Rows)
+		})
+	}
+}
+
+func TestServe_RequestPages(t *testing.T) {
+	store, err := logdb.Open(filepath.Join(t.TempDir(), "log.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	w, err := store.NewWriter()
+	assert.Nil(t, err)
+	assert.Nil(t, w.Begin())
+	f := &logdb.File{Name: "test.log"}
+	assert.Nil(t, w.AddFile(f))
+	for i := range 5 {
+		assert.Nil(t, w.AddRequest(f.ID, &netgo.RequestRecord{
+			Time:     time.Unix(int64(10+i), 0),
+			Source:   netgo.REQUEST_LOG,
+			IP:       "192.0.2.1",
+			Protocol: "HTTP/1.1",
+			Method:   "GET",
+			Host:     "example.com",
+			URL:      &url.URL{Path: fmt.Sprintf("/%d", i)},
+		}))
+	}
+	assert.Nil(t, w.Commit())
+	assert.Nil(t, w.Close())
+
+	mux, err := NewMux(slog.New(slog.DiscardHandler), store)
+	assert.Nil(t, err)
+
+	get := func(t *testing.T, target string) *httptest.ResponseRecorder {
+		t.Helper()
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, httptest.NewRequest(http.MethodGet, target, nil))
+		return response
+	}
+
+	t.Run("Pages", func(t *testing.T) {
+		var urls []any
+		target := "/requests.json?limit=2&order=desc&columns=url"
+		for pages := 0; ; pages++ {
+			assert.Less(t, pages, 3)
+			response := get(t, target)
+			assert.Equal(t, http.StatusOK, response.Code)
+			var result Requests
+			assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &result))
+			assert.Equal(t, 5, result.Total)
+			assert.Equal(t, int64(10), result.Start)
+			assert.Equal(t, int64(14), result.End)
+			for _, row := range result.Rows {
+				assert.Equal(t, 1, len(row))
+				urls = append(urls, row["url"])
+			}
+			if result.Next == "" {
+				break
+			}
+			target = "/requests.json?limit=2&order=desc&columns=url&after=" + result.Next
+		}
+		assert.Equal(t, []any{"/4", "/3", "/2", "/1", "/0"}, urls)
+	})
+	t.Run("Default", func(t *testing.T) {
+		response := get(t, "/requests.json?url=/0")
+		assert.Equal(t, http.StatusOK, response.Code)
+		var result struct {
+			Rows []*netgo.RequestRecord `json:"rows"`
+		}
+		assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &result))
+		assert.Equal(t, 1, len(result.Rows))
+		assert.Equal(t, "192.0.2.1", result.Rows[0].IP)
+		assert.Equal(t, "/0", result.Rows[0].URL.String())
+		assert.Equal(t, int64(10), result.Rows[0].Time.Unix())
+	})
+	t.Run("Stream", func(t *testing.T) {
+		response := get(t, "/requests.ndjson?columns=cursor,timestamp&url=-/2")
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.Equal(t, "application/x-ndjson", response.Header().Get("Content-Type"))
+		lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+		assert.Equal(t, 4, len(lines))
+		var row struct {
+			Cursor    string `json:"cursor"`
+			Timestamp int64  `json:"timestamp"`
+		}
+		assert.Nil(t, json.Unmarshal([]byte(lines[3]), &row))
+		assert.Equal(t, int64(14), row.Timestamp)
+
+		// Resumed after the cursor
+		response = get(t, "/requests.ndjson?columns=url&after="+url.QueryEscape(row.Cursor))
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.Empty(t, response.Body.String())
+	})
+	for name, target := range map[string]string{
+		"Limit":        "/requests.json?limit=0",
+		"LimitMax":     fmt.Sprintf("/requests.json?limit=%d", MAX_PAGE_SIZE+1),
+		"LimitStream":  "/requests.ndjson?limit=-1",
+		"Order":        "/requests.json?order=random",
+		"Cursor":       "/requests.json?after=yesterday",
+		"Column":       "/requests.json?columns=url,password",
+		"FilterStream": "/requests.ndjson?port=http",
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, http.StatusBadRequest, get(t, target).Code)
+		})
+	}
+}
+
+func TestServe_TimeSeries(t *testing.T) {
+	store, err := logdb.Open(filepath.Join(t.TempDir(), "log.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	w, err := store.NewWriter()
+	assert.Nil(t, err)
+	assert.Nil(t, w.Begin())
+	f := &logdb.File{Name: "test.log"}
+	assert.Nil(t, w.AddFile(f))
+	for _, r := range []struct {
+		time   time.Time
+		method string
+	}{
+		{time.Date(2024, 7, 4, 22, 30, 0, 0, time.UTC), "GET"},
+		{time.Date(2024, 7, 4, 23, 30, 0, 0, time.UTC), "GET"},
+		{time.Date(2024, 7, 5, 1, 0, 0, 0, time.UTC), "POST"},
+	} {
+		assert.Nil(t, w.AddRequest(f.ID, &netgo.RequestRecord{
+			Time:     r.time,
+			Source:   netgo.REQUEST_LOG,
+			IP:       "192.0.2.1",
+			Protocol: "HTTP/1.1",
+			Method:   r.method,
+			Host:     "example.com",
+			URL:      &url.URL{Path: "/"},
+		}))
+	}
+	assert.Nil(t, w.Commit())
+	assert.Nil(t, w.Close())
+
+	mux, err := NewMux(slog.New(slog.DiscardHandler), store)
+	assert.Nil(t, err)
+
+	get := func(t *testing.T, target string) *httptest.ResponseRecorder {
+		t.Helper()
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, httptest.NewRequest(http.MethodGet, target, nil))
+		return response
+	}
+	day := func(month time.Month, day int, location *time.Location) int64 {
+		return time.Date(2024, month, day, 0, 0, 0, 0, location).Unix()
+	}
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	assert.Nil(t, err)
+
+	for name, test := range map[string]struct {
+		query    string
+		interval string
+		timezone string
+		expected []*Bucket
+	}{
+		"Auto": {"", "minute", "UTC", []*Bucket{
+			{Start: day(7, 4, time.UTC) + 22*3600 + 30*60, End: day(7, 4, time.UTC) + 22*3600 + 31*60, Count: 1},
+			{Start: day(7, 4, time.UTC) + 23*3600 + 30*60, End: day(7, 4, time.UTC) + 23*3600 + 31*60, Count: 1},
+			{Start: day(7, 5, time.UTC) + 3600, End: day(7, 5, time.UTC) + 3600 + 60, Count: 1},
+		}},
+		"Day": {"?interval=day", "day", "UTC", []*Bucket{
+			{Start: day(7, 4, time.UTC), End: day(7, 5, time.UTC), Count: 2},
+			{Start: day(7, 5, time.UTC), End: day(7, 6, time.UTC), Count: 1},
+		}},
+		"Timezone": {"?interval=day&timezone=Asia/Tokyo", "day", "Asia/Tokyo", []*Bucket{
+			{Start: day(7, 5, tokyo), End: day(7, 6, tokyo), Count: 3},
+		}},
+		"Split": {"?interval=week&split=method&method=-PUT", "week", "UTC", []*Bucket{
+			{Start: day(7, 1, time.UTC), End: day(7, 8, time.UTC), Value: "GET", Count: 2},
+			{Start: day(7, 1, time.UTC), End: day(7, 8, time.UTC), Value: "POST", Count: 1},
+		}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			response := get(t, "/timeseries.json"+test.query)
+			assert.Equal(t, http.StatusOK, response.Code)
+			var result TimeSeries
+			assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &result))
+			assert.Equal(t, 3, result.Total)
+			assert.Equal(t, test.interval, result.Interval)
+			assert.Equal(t, test.timezone, result.Timezone)
+			assert.Equal(t, test.expected, result.Rows)
+		})
+	}
+	for _, query := range []string{"?interval=fortnight", "?timezone=Mars/Olympus", "?split=password"} {
+		t.Run(query, func(t *testing.T) {
+			assert.Equal(t, http.StatusBadRequest, get(t, "/timeseries.json"+query).Code)
+		})
+	}
+}
+
+// literal returns the expression matching the value exactly.
+func literal(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
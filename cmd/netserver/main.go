@@ -23,11 +23,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 func main() {
@@ -35,11 +36,11 @@ func main() {
 		switch os.Args[1] {
 		case "start":
 			if err := start(); err != nil {
-				log.Println(err)
+				slog.Error("Server Failed", "error", err)
 				return
 			}
 		default:
-			log.Println("Cannot handle", os.Args[1])
+			slog.Error("Cannot handle", "command", os.Args[1])
 		}
 	} else {
 		PrintUsage(os.Stdout)
@@ -48,12 +49,12 @@ func main() {
 
 func start() error {
 	// Configure Logging
-	logFile, err := netgo.SetupLogging()
+	logger, logFile, err := netgo.SetupLogger()
 	if err != nil {
 		return err
 	}
 	defer logFile.Close()
-	log.Println("Log File:", logFile.Name())
+	logger.Info("Log File", "name", logFile.Name())
 
 	content, ok := os.LookupEnv("CONTENT_DIRECTORY")
 	if !ok {
@@ -62,14 +63,39 @@ func start() error {
 
 	// Serve Web Requests
 	mux := http.NewServeMux()
-	mux.Handle("/", handler.Log(handler.StaticDir(content, true)))
+	mux.Handle("/", handler.Log(handler.StaticDir(content, true), logger))
+
+	// Filter Clients
+	filter := func(h http.Handler) http.Handler {
+		return h
+	}
+	if rules, ok := os.LookupEnv("IP_FILTER"); ok {
+		var lookup handler.CountryLookup
+		if geoip, ok := os.LookupEnv("GEOIP_DATABASE"); ok {
+			l, err := handler.OpenMaxMindLookup(geoip)
+			if err != nil {
+				return err
+			}
+			defer l.Close()
+			lookup = l
+		}
+		r, err := handler.NewIPRules(rules, lookup, logger)
+		if err != nil {
+			return err
+		}
+		defer r.Watch(10 * time.Second)()
+		logger.Info("IP Filter", "rules", rules)
+		filter = func(h http.Handler) http.Handler {
+			return handler.IPFilter(h, r, logger)
+		}
+	}
 
 	if netgo.IsSecure() {
 		certificates, ok := os.LookupEnv("CERTIFICATE_DIRECTORY")
 		if !ok {
 			certificates = "certificates"
 		}
-		log.Println("Certificate Directory:", certificates)
+		logger.Info("Certificate Directory", "name", certificates)
 
 		host, ok := os.LookupEnv("HOST")
 		if !ok {
@@ -86,15 +112,15 @@ func start() error {
 		}
 
 		// Redirect HTTP Requests to HTTPS
-		go http.ListenAndServe(":80", http.HandlerFunc(netgo.HTTPSRedirect(host, routeMap)))
+		go http.ListenAndServe(":80", filter(http.HandlerFunc(netgo.HTTPSRedirect(host, routeMap, logger))))
 
 		// Serve HTTPS Requests
 		config := &tls.Config{MinVersion: tls.VersionTLS12}
-		server := &http.Server{Addr: ":443", Handler: mux, TLSConfig: config}
+		server := &http.Server{Addr: ":443", Handler: filter(mux), TLSConfig: config}
 		return server.ListenAndServeTLS(filepath.Join(certificates, "fullchain.pem"), filepath.Join(certificates, "privkey.pem"))
 	} else {
-		log.Println("HTTP Server Listening on :80")
-		return http.ListenAndServe(":80", mux)
+		logger.Info("HTTP Server Listening", "address", ":80")
+		return http.ListenAndServe(":80", filter(mux))
 	}
 }
 
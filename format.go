@@ -0,0 +1,510 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FORMAT_NETGO          = "netgo"
+	FORMAT_COMBINED       = "combined"
+	FORMAT_VHOST_COMBINED = "vhost_combined"
+	FORMAT_CADDY          = "caddy"
+	FORMAT_W3C            = "w3c"
+)
+
+// LogFormat parses the requests recorded in logs of a particular format.
+type LogFormat interface {
+	Name() string
+	// Detect returns true if the first line of a log appears to be in this format
+	Detect(line string) bool
+	// NewParser returns a parser for a single log
+	NewParser() LineParser
+}
+
+// LineParser parses the lines of a log.
+type LineParser interface {
+	// Parse returns the request recorded by the line, nil if the line does not record a request, or a *ParseError if the line is malformed.
+	Parse(line string) (*RequestRecord, error)
+}
+
+// DirectiveParser is implemented by parsers configured by directive lines, such as W3C's #Fields, which must be parsed again when parsing resumes part way through a log.
+type DirectiveParser interface {
+	LineParser
+	IsDirective(line string) bool
+}
+
+// LogFormats returns the supported formats in the order they are detected, with netgo's own format matching request entries from the given legacy sources.
+func LogFormats(sources []string) []LogFormat {
+	return []LogFormat{
+		&W3CFormat{},
+		&CaddyFormat{},
+		&NetgoFormat{Sources: sources},
+		&CombinedFormat{},
+		&CombinedFormat{VirtualHost: true},
+	}
+}
+
+// ParseLogFormat returns the format with the given name; netgo, combined (also common, clf, and nginx), vhost_combined, caddy, or w3c.
+func ParseLogFormat(name string, sources []string) (LogFormat, error) {
+	switch strings.ToLower(name) {
+	case FORMAT_NETGO:
+		return &NetgoFormat{Sources: sources}, nil
+	case FORMAT_COMBINED, "common", "clf", "nginx":
+		return &CombinedFormat{}, nil
+	case FORMAT_VHOST_COMBINED:
+		return &CombinedFormat{VirtualHost: true}, nil
+	case FORMAT_CADDY:
+		return &CaddyFormat{}, nil
+	case FORMAT_W3C:
+		return &W3CFormat{}, nil
+	}
+	return nil, fmt.Errorf("Unrecognized Log Format: %s", name)
+}
+
+// DetectLogFormat returns the first of the formats which detects the line, or nil.
+func DetectLogFormat(formats []LogFormat, line string) LogFormat {
+	for _, f := range formats {
+		if f.Detect(line) {
+			return f
+		}
+	}
+	return nil
+}
+
+// NetgoFormat parses the request entries written by LogRequest, and by earlier versions of netgo.
+type NetgoFormat struct {
+	// Prefixes identifying request lines written before entries were tagged
+	Sources []string
+}
+
+func (f *NetgoFormat) Name() string {
+	return FORMAT_NETGO
+}
+
+func (f *NetgoFormat) Detect(line string) bool {
+	if strings.HasPrefix(line, "{") {
+		var entry struct {
+			Time  *time.Time `json:"time"`
+			Level *string    `json:"level"`
+			Msg   *string    `json:"msg"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return false
+		}
+		return entry.Time != nil && entry.Level != nil && entry.Msg != nil
+	}
+	if len(line) <= len(LEGACY_TIME_FORMAT) {
+		return false
+	}
+	_, err := time.Parse(LEGACY_TIME_FORMAT, line[:len(LEGACY_TIME_FORMAT)])
+	return err == nil
+}
+
+func (f *NetgoFormat) NewParser() LineParser {
+	return f
+}
+
+func (f *NetgoFormat) Parse(line string) (*RequestRecord, error) {
+	if !IsRequestLog(f.Sources, line) {
+		return nil, nil
+	}
+	return ParseRequestRecord(line)
+}
+
+// CombinedFormat parses the Common and Combined Log Formats written by Apache and nginx, eg.
+//
+//	192.0.2.1 - frank [04/Mar/2022:12:00:00 +0000] "GET /index.html HTTP/1.1" 200 2326 "https://example.com/" "curl/7.68.0"
+//
+// The status and size are not recorded, and the Referer and User-Agent are recorded as headers.
+//
+// The request line only has the path, so Host is left empty unless lines start with the virtual host, as in Apache's vhost_combined, eg.
+//
+//	example.com:443 192.0.2.1 - frank [04/Mar/2022:12:00:00 +0000] "GET /index.html HTTP/1.1" 200 2326 "https://example.com/" "curl/7.68.0"
+type CombinedFormat struct {
+	// Whether lines start with the virtual host and port
+	VirtualHost bool
+}
+
+func (f *CombinedFormat) Name() string {
+	if f.VirtualHost {
+		return FORMAT_VHOST_COMBINED
+	}
+	return FORMAT_COMBINED
+}
+
+func (f *CombinedFormat) Detect(line string) bool {
+	_, err := f.Parse(line)
+	return err == nil
+}
+
+func (f *CombinedFormat) NewParser() LineParser {
+	return f
+}
+
+func (f *CombinedFormat) Parse(line string) (*RequestRecord, error) {
+	s := &scanner{line: line}
+	// Host is not in the request line, so is only known from the virtual host
+	var host string
+	if f.VirtualHost {
+		vhost, column := s.field()
+		if vhost == "" {
+			return nil, &ParseError{Column: column, Reason: "Missing Virtual Host"}
+		}
+		host = vhost
+		if h, _, err := net.SplitHostPort(vhost); err == nil {
+			host = h
+		}
+	}
+	address, column := s.field()
+	if address == "" {
+		return nil, &ParseError{Column: column, Reason: "Missing Address"}
+	}
+	ip, port := address, 0
+	if h, p, err := splitAddress(address); err == nil {
+		ip, port = h, p
+	} else if net.ParseIP(address) == nil {
+		return nil, &ParseError{Column: column, Reason: "Invalid Address"}
+	}
+	// Identity and User
+	s.field()
+	s.field()
+	timestamp, column, ok := s.delimited('[', ']')
+	if !ok {
+		return nil, &ParseError{Column: column, Reason: "Missing Timestamp"}
+	}
+	t, err := time.Parse("02/Jan/2006:15:04:05 -0700", timestamp)
+	if err != nil {
+		return nil, &ParseError{Column: column, Reason: "Invalid Timestamp"}
+	}
+	request, column, ok := s.quoted()
+	if !ok {
+		return nil, &ParseError{Column: column, Reason: "Missing Request Line"}
+	}
+	parts := strings.Split(request, " ")
+	if len(parts) != 3 {
+		return nil, &ParseError{Column: column, Reason: "Invalid Request Line"}
+	}
+	u, err := url.Parse(parts[1])
+	if err != nil {
+		return nil, &ParseError{Column: column, Reason: "Invalid URL"}
+	}
+	// Status and Size
+	if status, column := s.field(); status == "" {
+		return nil, &ParseError{Column: column, Reason: "Missing Status"}
+	}
+	s.field()
+	record := &RequestRecord{
+		Time:     t,
+		Source:   FORMAT_COMBINED,
+		IP:       ip,
+		Port:     port,
+		Protocol: parts[2],
+		Method:   parts[0],
+		Host:     host,
+		URL:      u,
+		Header:   make(http.Header),
+	}
+	if referer, _, ok := s.quoted(); ok {
+		if referer != "-" && referer != "" {
+			record.Header.Set("Referer", referer)
+		}
+		if agent, _, ok := s.quoted(); ok && agent != "-" && agent != "" {
+			record.Header.Set("User-Agent", agent)
+		}
+	}
+	return record, nil
+}
+
+// scanner splits a line into space separated fields.
+type scanner struct {
+	line string
+	pos  int
+}
+
+func (s *scanner) skipSpaces() {
+	for s.pos < len(s.line) && s.line[s.pos] == ' ' {
+		s.pos++
+	}
+}
+
+// field returns the next space separated field, and its column.
+func (s *scanner) field() (string, int) {
+	s.skipSpaces()
+	start := s.pos
+	for s.pos < len(s.line) && s.line[s.pos] != ' ' {
+		s.pos++
+	}
+	return s.line[start:s.pos], start + 1
+}
+
+// delimited returns the contents of the next field enclosed by the given delimiters.
+func (s *scanner) delimited(open, close byte) (string, int, bool) {
+	s.skipSpaces()
+	column := s.pos + 1
+	if s.pos >= len(s.line) || s.line[s.pos] != open {
+		return "", column, false
+	}
+	end := strings.IndexByte(s.line[s.pos+1:], close)
+	if end < 0 {
+		return "", column, false
+	}
+	value := s.line[s.pos+1 : s.pos+1+end]
+	s.pos += end + 2
+	return value, column, true
+}
+
+// quoted returns the contents of the next double-quoted field, unescaping backslash escapes.
+func (s *scanner) quoted() (string, int, bool) {
+	s.skipSpaces()
+	column := s.pos + 1
+	if s.pos >= len(s.line) || s.line[s.pos] != '"' {
+		return "", column, false
+	}
+	var b strings.Builder
+	for i := s.pos + 1; i < len(s.line); i++ {
+		switch c := s.line[i]; c {
+		case '\\':
+			if i+1 < len(s.line) {
+				i++
+				b.WriteByte(s.line[i])
+			}
+		case '"':
+			s.pos = i + 1
+			return b.String(), column, true
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", column, false
+}
+
+// CaddyFormat parses the JSON access logs written by Caddy 2.
+type CaddyFormat struct{}
+
+// caddyEntry is the structure of an entry written by Caddy's access logger.
+type caddyEntry struct {
+	Timestamp json.RawMessage `json:"ts"`
+	Logger    string          `json:"logger"`
+	Request   *struct {
+		RemoteIP   string      `json:"remote_ip"`
+		RemotePort string      `json:"remote_port"`
+		RemoteAddr string      `json:"remote_addr"`
+		ClientIP   string      `json:"client_ip"`
+		Proto      string      `json:"proto"`
+		Method     string      `json:"method"`
+		Host       string      `json:"host"`
+		URI        string      `json:"uri"`
+		Headers    http.Header `json:"headers"`
+	} `json:"request"`
+}
+
+func (f *CaddyFormat) Name() string {
+	return FORMAT_CADDY
+}
+
+func (f *CaddyFormat) Detect(line string) bool {
+	if !strings.HasPrefix(line, "{") {
+		return false
+	}
+	var entry caddyEntry
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return false
+	}
+	return strings.HasPrefix(entry.Logger, "http.log.access") && entry.Request != nil
+}
+
+func (f *CaddyFormat) NewParser() LineParser {
+	return f
+}
+
+func (f *CaddyFormat) Parse(line string) (*RequestRecord, error) {
+	var entry caddyEntry
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return nil, &ParseError{Column: 1, Reason: "Invalid JSON: " + err.Error()}
+	}
+	if !strings.HasPrefix(entry.Logger, "http.log.access") || entry.Request == nil {
+		// Not an access log entry
+		return nil, nil
+	}
+	t, err := parseCaddyTimestamp(entry.Timestamp)
+	if err != nil {
+		return nil, &ParseError{Column: 1, Reason: "Invalid Timestamp"}
+	}
+	r := entry.Request
+	ip, port := r.ClientIP, 0
+	if r.RemoteAddr != "" {
+		h, p, err := splitAddress(r.RemoteAddr)
+		if err != nil {
+			return nil, &ParseError{Column: 1, Reason: "Invalid Address"}
+		}
+		if ip == "" {
+			ip = h
+		}
+		port = p
+	} else {
+		if ip == "" {
+			ip = r.RemoteIP
+		}
+		port, _ = strconv.Atoi(r.RemotePort)
+	}
+	if ip == "" {
+		return nil, &ParseError{Column: 1, Reason: "Missing Address"}
+	}
+	u, err := url.Parse(r.URI)
+	if err != nil {
+		return nil, &ParseError{Column: 1, Reason: "Invalid URL"}
+	}
+	return &RequestRecord{
+		Time:     t,
+		Source:   FORMAT_CADDY,
+		IP:       ip,
+		Port:     port,
+		Protocol: r.Proto,
+		Method:   r.Method,
+		Host:     r.Host,
+		URL:      u,
+		Header:   r.Headers,
+	}, nil
+}
+
+// parseCaddyTimestamp parses the default Unix seconds timestamp, or a timestamp formatted as RFC 3339.
+func parseCaddyTimestamp(raw json.RawMessage) (time.Time, error) {
+	var seconds float64
+	if err := json.Unmarshal(raw, &seconds); err == nil {
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(fraction*1e9)).UTC(), nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// W3CFormat parses W3C Extended Log Files, such as those written by IIS, with fields declared by the #Fields directive.
+type W3CFormat struct{}
+
+func (f *W3CFormat) Name() string {
+	return FORMAT_W3C
+}
+
+func (f *W3CFormat) Detect(line string) bool {
+	return strings.HasPrefix(line, "#Software:") || strings.HasPrefix(line, "#Version:") || strings.HasPrefix(line, "#Fields:")
+}
+
+func (f *W3CFormat) NewParser() LineParser {
+	return &w3cParser{}
+}
+
+type w3cParser struct {
+	fields []string
+}
+
+func (p *w3cParser) IsDirective(line string) bool {
+	return strings.HasPrefix(line, "#")
+}
+
+func (p *w3cParser) Parse(line string) (*RequestRecord, error) {
+	if strings.HasPrefix(line, "#Fields:") {
+		p.fields = strings.Fields(line[len("#Fields:"):])
+		return nil, nil
+	}
+	if p.IsDirective(line) {
+		return nil, nil
+	}
+	if p.fields == nil {
+		return nil, &ParseError{Column: 1, Reason: "Missing Fields Directive"}
+	}
+	values := strings.Fields(line)
+	if len(values) != len(p.fields) {
+		return nil, &ParseError{Column: 1, Reason: fmt.Sprintf("Expected %d Fields, got %d", len(p.fields), len(values))}
+	}
+	record := &RequestRecord{
+		Source: FORMAT_W3C,
+		Header: make(http.Header),
+		URL:    &url.URL{},
+	}
+	var date, clock, query string
+	column := 1
+	for i, field := range p.fields {
+		value := values[i]
+		if value == "-" {
+			value = ""
+		}
+		switch field {
+		case "date":
+			date = value
+		case "time":
+			clock = value
+		case "c-ip":
+			record.IP = value
+		case "c-port":
+			record.Port, _ = strconv.Atoi(value)
+		case "cs-method":
+			record.Method = value
+		case "cs-uri-stem":
+			record.URL.Path = value
+		case "cs-uri-query":
+			query = value
+		case "cs-uri":
+			u, err := url.Parse(value)
+			if err != nil {
+				return nil, &ParseError{Column: column, Reason: "Invalid URL"}
+			}
+			record.URL = u
+		case "cs-version":
+			record.Protocol = value
+		case "cs-host":
+			record.Host = value
+		default:
+			if strings.HasPrefix(field, "cs(") && strings.HasSuffix(field, ")") && value != "" {
+				name := field[len("cs(") : len(field)-1]
+				if http.CanonicalHeaderKey(name) == "User-Agent" {
+					// Spaces in user agents are written as +
+					value = strings.ReplaceAll(value, "+", " ")
+				}
+				record.Header.Add(name, value)
+			}
+		}
+		column += len(values[i]) + 1
+	}
+	if query != "" {
+		record.URL.RawQuery = query
+	}
+	if record.Host == "" {
+		record.Host = record.Header.Get("Host")
+	}
+	if record.IP == "" {
+		return nil, &ParseError{Column: 1, Reason: "Missing Address"}
+	}
+	t, err := time.Parse("2006-01-02 15:04:05", date+" "+clock)
+	if err != nil {
+		return nil, &ParseError{Column: 1, Reason: "Invalid Timestamp"}
+	}
+	record.Time = t
+	return record, nil
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netgo_test
+
+import (
+	"aletheiaware.com/netgo"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	COMBINED_LINE = `192.0.2.1 - frank [04/Mar/2022:12:00:00 +0000] "GET /index.html?a=1 HTTP/1.1" 200 2326 "https://example.com/" "Mozilla/5.0 (X11; \"Linux\")"`
+	COMMON_LINE   = `2001:db8::1 - - [04/Mar/2022:13:00:00 +0100] "POST /form HTTP/1.0" 302 -`
+	VHOST_LINE    = `example.com:443 192.0.2.1 - - [04/Mar/2022:12:00:00 +0000] "GET / HTTP/1.1" 200 2326 "-" "curl/7.68.0"`
+	CADDY_LINE    = `{"level":"info","ts":1646395200.5,"logger":"http.log.access.log0","msg":"handled request","request":{"remote_ip":"192.0.2.1","remote_port":"4567","client_ip":"192.0.2.1","proto":"HTTP/2.0","method":"GET","host":"example.com","uri":"/index.html","headers":{"User-Agent":["curl/7.68.0"]}},"status":200}`
+	W3C_LOG       = "#Software: Microsoft Internet Information Services 10.0\n" +
+		"#Version: 1.0\n" +
+		"#Fields: date time s-ip cs-method cs-uri-stem cs-uri-query s-port c-ip cs-version cs(User-Agent) cs-host sc-status\n" +
+		"2022-03-04 12:00:00 198.51.100.1 GET /index.html a=1 443 192.0.2.1 HTTP/1.1 Mozilla/5.0+(Windows+NT+10.0) example.com 200"
+)
+
+func assertRecord(t *testing.T, expected, actual *netgo.RequestRecord) {
+	t.Helper()
+	if !expected.Time.Equal(actual.Time) {
+		t.Errorf("Incorrect time; expected '%v', got '%v'", expected.Time, actual.Time)
+	}
+	if expected.Source != actual.Source || expected.IP != actual.IP || expected.Port != actual.Port || expected.Protocol != actual.Protocol || expected.Method != actual.Method || expected.Host != actual.Host {
+		t.Errorf("Incorrect record; expected '%+v', got '%+v'", expected, actual)
+	}
+	if expected.URL.String() != actual.URL.String() {
+		t.Errorf("Incorrect URL; expected '%s', got '%s'", expected.URL, actual.URL)
+	}
+	if !reflect.DeepEqual(expected.Header, actual.Header) {
+		t.Errorf("Incorrect header; expected '%v', got '%v'", expected.Header, actual.Header)
+	}
+}
+
+func parseLine(t *testing.T, parser netgo.LineParser, line string) *netgo.RequestRecord {
+	t.Helper()
+	record, err := parser.Parse(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record == nil {
+		t.Fatalf("Not a request; got '%s'", line)
+	}
+	return record
+}
+
+func TestCombinedFormat(t *testing.T) {
+	format := &netgo.CombinedFormat{}
+	t.Run("Combined", func(t *testing.T) {
+		assertRecord(t, &netgo.RequestRecord{
+			Time:     time.Date(2022, 3, 4, 12, 0, 0, 0, time.UTC),
+			Source:   netgo.FORMAT_COMBINED,
+			IP:       "192.0.2.1",
+			Protocol: "HTTP/1.1",
+			Method:   "GET",
+			URL:      mustParseURL(t, "/index.html?a=1"),
+			Header: http.Header{
+				"Referer":    {"https://example.com/"},
+				"User-Agent": {`Mozilla/5.0 (X11; "Linux")`},
+			},
+		}, parseLine(t, format.NewParser(), COMBINED_LINE))
+	})
+	t.Run("Common", func(t *testing.T) {
+		assertRecord(t, &netgo.RequestRecord{
+			Time:     time.Date(2022, 3, 4, 12, 0, 0, 0, time.UTC),
+			Source:   netgo.FORMAT_COMBINED,
+			IP:       "2001:db8::1",
+			Protocol: "HTTP/1.0",
+			Method:   "POST",
+			URL:      mustParseURL(t, "/form"),
+			Header:   http.Header{},
+		}, parseLine(t, format.NewParser(), COMMON_LINE))
+	})
+	t.Run("Host", func(t *testing.T) {
+		// Host is left empty, even when the request line has an absolute URL
+		record := parseLine(t, format.NewParser(), `192.0.2.1 - - [04/Mar/2022:12:00:00 +0000] "GET http://example.com/ HTTP/1.1" 200 0`)
+		if record.Host != "" {
+			t.Errorf("Incorrect host; expected '', got '%s'", record.Host)
+		}
+	})
+	t.Run("Virtual Host", func(t *testing.T) {
+		assertRecord(t, &netgo.RequestRecord{
+			Time:     time.Date(2022, 3, 4, 12, 0, 0, 0, time.UTC),
+			Source:   netgo.FORMAT_COMBINED,
+			IP:       "192.0.2.1",
+			Protocol: "HTTP/1.1",
+			Method:   "GET",
+			Host:     "example.com",
+			URL:      mustParseURL(t, "/"),
+			Header: http.Header{
+				"User-Agent": {"curl/7.68.0"},
+			},
+		}, parseLine(t, (&netgo.CombinedFormat{VirtualHost: true}).NewParser(), VHOST_LINE))
+		if _, err := (&netgo.CombinedFormat{VirtualHost: true}).Parse(COMBINED_LINE); err == nil {
+			t.Errorf("Expected error for line without virtual host")
+		}
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		for _, line := range []string{
+			"",
+			"example",
+			`192.0.2.1 - - [04/Mar/2022:12:00:00 +0000]`,
+			`192.0.2.1 - - [04/Mar/2022:12:00:00 +0000] "-" 400 0`,
+			`192.0.2.1 - - [yesterday] "GET / HTTP/1.1" 200 0`,
+		} {
+			_, err := format.Parse(line)
+			var p *netgo.ParseError
+			if !errors.As(err, &p) {
+				t.Errorf("Incorrect error for '%s'; got '%v'", line, err)
+			}
+		}
+	})
+}
+
+func TestCaddyFormat(t *testing.T) {
+	format := &netgo.CaddyFormat{}
+	assertRecord(t, &netgo.RequestRecord{
+		Time:     time.Date(2022, 3, 4, 12, 0, 0, 500000000, time.UTC),
+		Source:   netgo.FORMAT_CADDY,
+		IP:       "192.0.2.1",
+		Port:     4567,
+		Protocol: "HTTP/2.0",
+		Method:   "GET",
+		Host:     "example.com",
+		URL:      mustParseURL(t, "/index.html"),
+		Header: http.Header{
+			"User-Agent": {"curl/7.68.0"},
+		},
+	}, parseLine(t, format.NewParser(), CADDY_LINE))
+
+	// Other entries are not requests
+	record, err := format.Parse(`{"level":"info","ts":1646395200.5,"logger":"tls","msg":"certificate obtained"}`)
+	if record != nil || err != nil {
+		t.Errorf("Incorrect result; expected nil, got '%v' and '%v'", record, err)
+	}
+}
+
+func TestW3CFormat(t *testing.T) {
+	format := &netgo.W3CFormat{}
+	parser := format.NewParser()
+	var record *netgo.RequestRecord
+	for _, line := range splitLines(W3C_LOG) {
+		r, err := parser.Parse(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != nil {
+			record = r
+		}
+	}
+	if record == nil {
+		t.Fatal("Missing request")
+	}
+	assertRecord(t, &netgo.RequestRecord{
+		Time:     time.Date(2022, 3, 4, 12, 0, 0, 0, time.UTC),
+		Source:   netgo.FORMAT_W3C,
+		IP:       "192.0.2.1",
+		Protocol: "HTTP/1.1",
+		Method:   "GET",
+		Host:     "example.com",
+		URL:      mustParseURL(t, "/index.html?a=1"),
+		Header: http.Header{
+			"User-Agent": {"Mozilla/5.0 (Windows NT 10.0)"},
+		},
+	}, record)
+
+	// Requests before the fields are declared cannot be parsed
+	_, err := format.NewParser().Parse("2022-03-04 12:00:00 GET /")
+	var p *netgo.ParseError
+	if !errors.As(err, &p) {
+		t.Errorf("Incorrect error; got '%v'", err)
+	}
+}
+
+func TestDetectLogFormat(t *testing.T) {
+	formats := netgo.LogFormats([]string{"log.go:"})
+	for line, expected := range map[string]string{
+		LEGACY_LINE:                   netgo.FORMAT_NETGO,
+		JSON_LINE:                     netgo.FORMAT_NETGO,
+		`2022/03/04 12:00:00 Started`: netgo.FORMAT_NETGO,
+		`{"time":"2022-03-04T12:00:00Z","level":"INFO","msg":"Log File"}`: netgo.FORMAT_NETGO,
+		COMBINED_LINE:             netgo.FORMAT_COMBINED,
+		COMMON_LINE:               netgo.FORMAT_COMBINED,
+		VHOST_LINE:                netgo.FORMAT_VHOST_COMBINED,
+		CADDY_LINE:                netgo.FORMAT_CADDY,
+		splitLines(W3C_LOG)[0]:    netgo.FORMAT_W3C,
+		"#Fields: date time c-ip": netgo.FORMAT_W3C,
+	} {
+		format := netgo.DetectLogFormat(formats, line)
+		if format == nil {
+			t.Errorf("Undetected format for '%s'; expected '%s'", line, expected)
+		} else if actual := format.Name(); actual != expected {
+			t.Errorf("Incorrect format for '%s'; expected '%s', got '%s'", line, expected, actual)
+		}
+	}
+	if format := netgo.DetectLogFormat(formats, "unknown"); format != nil {
+		t.Errorf("Incorrect format; expected nil, got '%s'", format.Name())
+	}
+}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func splitLines(s string) []string {
+	return strings.Split(s, "\n")
+}
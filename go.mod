@@ -1,8 +1,15 @@
 module aletheiaware.com/netgo
 
-go 1.16
+go 1.21
 
 require (
-	github.com/mattn/go-sqlite3 v1.14.11
-	github.com/stretchr/testify v1.7.0
+	github.com/oschwald/maxminddb-golang v1.13.1
+	github.com/stretchr/testify v1.11.1
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
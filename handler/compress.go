@@ -2,7 +2,7 @@ package handler
 
 import (
 	"compress/gzip"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 )
@@ -39,7 +39,7 @@ func (w *gzipResponseWriter) WriteHeader(status int) {
 	w.ResponseWriter.WriteHeader(status)
 }
 
-func Compress(h http.Handler) http.Handler {
+func Compress(h http.Handler, logger *slog.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
 			h.ServeHTTP(w, r)
@@ -56,7 +56,7 @@ func Compress(h http.Handler) http.Handler {
 			case http.StatusNotModified:
 			default:
 				if err := grw.writer.Close(); err != nil {
-					log.Println(err)
+					logger.Error("Compression Failed", "error", err)
 				}
 			}
 		}()
@@ -5,6 +5,7 @@ import (
 	"compress/gzip"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -17,7 +18,7 @@ func TestCompress(t *testing.T) {
 	})
 	t.Run("ContentNoCompression", func(t *testing.T) {
 		mux := http.NewServeMux()
-		mux.Handle("/", handler.Compress(testhandler))
+		mux.Handle("/", handler.Compress(testhandler, slog.Default()))
 		request := httptest.NewRequest(http.MethodGet, "/", nil)
 		response := httptest.NewRecorder()
 		mux.ServeHTTP(response, request)
@@ -31,7 +32,7 @@ func TestCompress(t *testing.T) {
 	})
 	t.Run("ContentGzip", func(t *testing.T) {
 		mux := http.NewServeMux()
-		mux.Handle("/", handler.Compress(testhandler))
+		mux.Handle("/", handler.Compress(testhandler, slog.Default()))
 		request := httptest.NewRequest(http.MethodGet, "/", nil)
 		request.Header.Set("Accept-Encoding", "gzip")
 		response := httptest.NewRecorder()
@@ -50,7 +51,7 @@ func TestCompress(t *testing.T) {
 		mux := http.NewServeMux()
 		mux.Handle("/", handler.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusNoContent)
-		})))
+		}), slog.Default()))
 		request := httptest.NewRequest(http.MethodGet, "/", nil)
 		request.Header.Set("Accept-Encoding", "gzip")
 		response := httptest.NewRecorder()
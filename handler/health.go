@@ -1,11 +1,12 @@
 package handler
 
 import (
+	"log/slog"
 	"net/http"
 )
 
-func AttachHealthHandler(m *http.ServeMux) {
-	m.Handle("/health", Log(Health()))
+func AttachHealthHandler(m *http.ServeMux, logger *slog.Logger) {
+	m.Handle("/health", Log(Health(), logger))
 }
 
 func Health() http.Handler {
@@ -4,6 +4,7 @@ import (
 	"aletheiaware.com/netgo/handler"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -12,7 +13,7 @@ import (
 func TestHealth(t *testing.T) {
 	t.Run("Returns 200", func(t *testing.T) {
 		mux := http.NewServeMux()
-		handler.AttachHealthHandler(mux)
+		handler.AttachHealthHandler(mux, slog.Default())
 		request := httptest.NewRequest(http.MethodGet, "/health", nil)
 		response := httptest.NewRecorder()
 		mux.ServeHTTP(response, request)
@@ -0,0 +1,264 @@
+package handler
+
+import (
+	"aletheiaware.com/netgo"
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/oschwald/maxminddb-golang"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoCountryLookup is returned when the rules contain country rules but no CountryLookup was given.
+var ErrNoCountryLookup = errors.New("Country Rules Require A GeoIP Database")
+
+// CountryLookup resolves an IP address to an ISO 3166-1 alpha-2 country code.
+type CountryLookup interface {
+	Country(net.IP) (string, error)
+}
+
+// MaxMindLookup is a CountryLookup backed by a local MaxMind-format database, such as GeoLite2-Country.mmdb.
+type MaxMindLookup struct {
+	reader *maxminddb.Reader
+}
+
+func OpenMaxMindLookup(path string) (*MaxMindLookup, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &MaxMindLookup{reader}, nil
+}
+
+func (l *MaxMindLookup) Country(ip net.IP) (string, error) {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := l.reader.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+	return record.Country.ISOCode, nil
+}
+
+func (l *MaxMindLookup) Close() error {
+	return l.reader.Close()
+}
+
+// IPRules decides whether a client may access the server based on CIDR allow/deny lists and, when a CountryLookup is given, country allow/deny lists.
+//
+// Rules are read from a file with one rule per line;
+//
+//	# office range
+//	allow 203.0.113.0/24
+//	deny 198.51.100.7
+//	allow-country NZ
+//	deny-country XX
+//
+// A request is blocked if its address matches a deny rule, if allow rules exist and none match, if its country matches a deny-country rule, if allow-country rules exist and none match, or if country rules exist and its country cannot be looked up.
+// An address matching an allow rule skips the country checks.
+// Country rules require a CountryLookup; reading them without one is an error.
+type IPRules struct {
+	path     string
+	lookup   CountryLookup
+	logger   *slog.Logger
+	mutex    sync.RWMutex
+	modified time.Time
+	allow    []*net.IPNet
+	deny     []*net.IPNet
+	// Country codes
+	allowCountries map[string]bool
+	denyCountries  map[string]bool
+}
+
+func NewIPRules(path string, lookup CountryLookup, logger *slog.Logger) (*IPRules, error) {
+	r := &IPRules{
+		path:   path,
+		lookup: lookup,
+		logger: logger,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the rules file again if it has been modified since it was last read.
+func (r *IPRules) Reload() error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+	r.mutex.RLock()
+	modified := r.modified
+	r.mutex.RUnlock()
+	if info.ModTime().Equal(modified) {
+		return nil
+	}
+	f, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	allow, deny, allowCountries, denyCountries, err := parseIPRules(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", r.path, err)
+	}
+	if r.lookup == nil && (len(allowCountries) > 0 || len(denyCountries) > 0) {
+		return fmt.Errorf("%s: %w", r.path, ErrNoCountryLookup)
+	}
+	r.mutex.Lock()
+	r.modified = info.ModTime()
+	r.allow = allow
+	r.deny = deny
+	r.allowCountries = allowCountries
+	r.denyCountries = denyCountries
+	r.mutex.Unlock()
+	return nil
+}
+
+// Watch periodically reloads the rules file until the returned function is called.
+func (r *IPRules) Watch(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.Reload(); err != nil {
+					r.logger.Error("IP Rules Reload Failed", "error", err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// Check returns true if the given address is allowed, otherwise false and the reason it was blocked.
+func (r *IPRules) Check(ip net.IP) (bool, string) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, n := range r.deny {
+		if n.Contains(ip) {
+			return false, "deny " + n.String()
+		}
+	}
+	for _, n := range r.allow {
+		if n.Contains(ip) {
+			return true, ""
+		}
+	}
+	if len(r.allow) > 0 {
+		return false, "not allowed"
+	}
+	if len(r.allowCountries) == 0 && len(r.denyCountries) == 0 {
+		return true, ""
+	}
+	country, err := r.lookup.Country(ip)
+	if err != nil {
+		r.logger.Warn("Country Lookup Failed", "ip", ip.String(), "error", err)
+		return false, "country lookup failed"
+	}
+	if r.denyCountries[country] {
+		return false, "deny-country " + country
+	}
+	if len(r.allowCountries) > 0 && !r.allowCountries[country] {
+		return false, "not allowed country " + country
+	}
+	return true, ""
+}
+
+func parseIPRules(reader io.Reader) (allow, deny []*net.IPNet, allowCountries, denyCountries map[string]bool, err error) {
+	allowCountries = make(map[string]bool)
+	denyCountries = make(map[string]bool)
+	scanner := bufio.NewScanner(reader)
+	var number int
+	for scanner.Scan() {
+		number++
+		line := scanner.Text()
+		if i := strings.IndexRune(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			err = fmt.Errorf("line %d: expected rule and value, got '%s'", number, line)
+			return
+		}
+		switch fields[0] {
+		case "allow", "deny":
+			var n *net.IPNet
+			n, err = parseIPNet(fields[1])
+			if err != nil {
+				err = fmt.Errorf("line %d: %w", number, err)
+				return
+			}
+			if fields[0] == "allow" {
+				allow = append(allow, n)
+			} else {
+				deny = append(deny, n)
+			}
+		case "allow-country":
+			allowCountries[strings.ToUpper(fields[1])] = true
+		case "deny-country":
+			denyCountries[strings.ToUpper(fields[1])] = true
+		default:
+			err = fmt.Errorf("line %d: unrecognized rule '%s'", number, fields[0])
+			return
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.ContainsRune(s, '/') {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address '%s'", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// IPFilter responds with 403 Forbidden to requests from clients blocked by the given rules.
+// Blocked requests are logged as entries of type netgo.BLOCKED_LOG with the reason, so they are not parsed as served requests.
+func IPFilter(h http.Handler, rules *IPRules, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		reason := "invalid address"
+		ok := false
+		if ip := net.ParseIP(host); ip != nil {
+			ok, reason = rules.Check(ip)
+		}
+		if !ok {
+			logger.LogAttrs(r.Context(), slog.LevelWarn, "blocked", append([]slog.Attr{slog.String(netgo.LOG_TYPE, netgo.BLOCKED_LOG), slog.String("reason", reason)}, netgo.RequestAttrs(r)...)...)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,100 @@
+package handler_test
+
+import (
+	"aletheiaware.com/netgo/handler"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCountryLookup map[string]string
+
+func (l testCountryLookup) Country(ip net.IP) (string, error) {
+	c, ok := l[ip.String()]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return c, nil
+}
+
+func writeRules(t *testing.T, path, rules string, modified time.Time) {
+	t.Helper()
+	assert.Nil(t, os.WriteFile(path, []byte(rules), 0600))
+	assert.Nil(t, os.Chtimes(path, modified, modified))
+}
+
+func assertIPFilter(t *testing.T, rules *handler.IPRules, address string, expected int) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle("/", handler.IPFilter(handler.Health(), rules, slog.Default()))
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = address
+	response := httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, expected, response.Result().StatusCode)
+}
+
+func TestIPFilter(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules")
+	t.Run("Deny", func(t *testing.T) {
+		writeRules(t, path, "# abusive\ndeny 192.0.2.0/24\ndeny 2001:db8::1\n", time.Now())
+		rules, err := handler.NewIPRules(path, nil, slog.Default())
+		assert.Nil(t, err)
+		assertIPFilter(t, rules, "192.0.2.1:1234", http.StatusForbidden)
+		assertIPFilter(t, rules, "[2001:db8::1]:1234", http.StatusForbidden)
+		assertIPFilter(t, rules, "[2001:db8::2]:1234", http.StatusOK)
+		assertIPFilter(t, rules, "198.51.100.1:1234", http.StatusOK)
+	})
+	t.Run("Allow", func(t *testing.T) {
+		writeRules(t, path, "allow 203.0.113.0/24\n", time.Now())
+		rules, err := handler.NewIPRules(path, nil, slog.Default())
+		assert.Nil(t, err)
+		assertIPFilter(t, rules, "203.0.113.9:1234", http.StatusOK)
+		assertIPFilter(t, rules, "198.51.100.1:1234", http.StatusForbidden)
+		assertIPFilter(t, rules, "invalid", http.StatusForbidden)
+	})
+	t.Run("Country", func(t *testing.T) {
+		writeRules(t, path, "deny-country xx\n", time.Now())
+		rules, err := handler.NewIPRules(path, testCountryLookup{
+			"192.0.2.1":    "XX",
+			"198.51.100.1": "NZ",
+		}, slog.Default())
+		assert.Nil(t, err)
+		assertIPFilter(t, rules, "192.0.2.1:1234", http.StatusForbidden)
+		assertIPFilter(t, rules, "198.51.100.1:1234", http.StatusOK)
+		// Lookup fails
+		assertIPFilter(t, rules, "203.0.113.9:1234", http.StatusForbidden)
+	})
+	t.Run("CountryWithoutLookup", func(t *testing.T) {
+		writeRules(t, path, "deny-country XX\n", time.Now())
+		_, err := handler.NewIPRules(path, nil, slog.Default())
+		assert.ErrorIs(t, err, handler.ErrNoCountryLookup)
+	})
+	t.Run("Reload", func(t *testing.T) {
+		now := time.Now()
+		writeRules(t, path, "deny 192.0.2.0/24\n", now.Add(-time.Minute))
+		rules, err := handler.NewIPRules(path, nil, slog.Default())
+		assert.Nil(t, err)
+		assertIPFilter(t, rules, "192.0.2.1:1234", http.StatusForbidden)
+		writeRules(t, path, "deny 198.51.100.0/24\n", now)
+		assert.Nil(t, rules.Reload())
+		assertIPFilter(t, rules, "192.0.2.1:1234", http.StatusOK)
+		assertIPFilter(t, rules, "198.51.100.1:1234", http.StatusForbidden)
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		writeRules(t, path, "deny nowhere\n", time.Now())
+		_, err := handler.NewIPRules(path, nil, slog.Default())
+		assert.NotNil(t, err)
+		writeRules(t, path, "block 192.0.2.1\n", time.Now())
+		_, err = handler.NewIPRules(path, nil, slog.Default())
+		assert.NotNil(t, err)
+	})
+}
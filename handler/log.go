@@ -2,12 +2,13 @@ package handler
 
 import (
 	"aletheiaware.com/netgo"
+	"log/slog"
 	"net/http"
 )
 
-func Log(h http.Handler) http.Handler {
+func Log(h http.Handler, logger *slog.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		netgo.LogRequest(r)
+		netgo.LogRequest(logger, r)
 		h.ServeHTTP(w, r)
 	})
 }
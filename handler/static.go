@@ -2,20 +2,21 @@ package handler
 
 import (
 	"io/fs"
+	"log/slog"
 	"net/http"
 	"path/filepath"
 )
 
-func AttachStaticDirHandler(m *http.ServeMux, directory string, listable bool, cache string) {
-	AttachStaticHTTPFSHandler(m, http.Dir(directory), listable, cache)
+func AttachStaticDirHandler(m *http.ServeMux, directory string, listable bool, cache string, logger *slog.Logger) {
+	AttachStaticHTTPFSHandler(m, http.Dir(directory), listable, cache, logger)
 }
 
-func AttachStaticFSHandler(m *http.ServeMux, fs fs.FS, listable bool, cache string) {
-	AttachStaticHTTPFSHandler(m, http.FS(fs), listable, cache)
+func AttachStaticFSHandler(m *http.ServeMux, fs fs.FS, listable bool, cache string, logger *slog.Logger) {
+	AttachStaticHTTPFSHandler(m, http.FS(fs), listable, cache, logger)
 }
 
-func AttachStaticHTTPFSHandler(m *http.ServeMux, fs http.FileSystem, listable bool, cache string) {
-	m.Handle("/static/", Log(Compress(CacheControl(http.StripPrefix("/static/", StaticFS(fs, listable)), cache))))
+func AttachStaticHTTPFSHandler(m *http.ServeMux, fs http.FileSystem, listable bool, cache string, logger *slog.Logger) {
+	m.Handle("/static/", Log(Compress(CacheControl(http.StripPrefix("/static/", StaticFS(fs, listable)), cache), logger), logger))
 }
 
 func StaticDir(directory string, listable bool) http.Handler {
@@ -4,14 +4,31 @@ import (
 	"aletheiaware.com/netgo/handler"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 	"testing/fstest"
 )
 
 const CC = "max-age=60"
 
+// directoryListing returns the page http.FileServer lists a directory with, which since Go 1.23 is preceded by a doctype and viewport.
+func directoryListing(links string) string {
+	listing := "<pre>\n" + links + "</pre>\n"
+	// Development versions, such as devel go1.24-abcdef, are treated as the latest
+	version, _, _ := strings.Cut(strings.TrimPrefix(runtime.Version(), "go"), " ")
+	major, rest, _ := strings.Cut(version, ".")
+	minor, _, _ := strings.Cut(rest, ".")
+	if m, err := strconv.Atoi(minor); major == "1" && err == nil && m < 23 {
+		return listing
+	}
+	return "<!doctype html>\n<meta name=\"viewport\" content=\"width=device-width\">\n" + listing
+}
+
 func TestStatic_File(t *testing.T) {
 	mux := http.NewServeMux()
 	fs := fstest.MapFS{
@@ -19,7 +36,7 @@ func TestStatic_File(t *testing.T) {
 			Data: []byte("hello, world"),
 		},
 	}
-	handler.AttachStaticFSHandler(mux, fs, false, CC)
+	handler.AttachStaticFSHandler(mux, fs, false, CC, slog.Default())
 	t.Run("Returns 200 When File Exists", func(t *testing.T) {
 		request := httptest.NewRequest(http.MethodGet, "/static/exists", nil)
 		response := httptest.NewRecorder()
@@ -46,7 +63,7 @@ func TestStatic_Directory(t *testing.T) {
 	t.Run("Returns 301 When Missing Trailing Slash", func(t *testing.T) {
 		mux := http.NewServeMux()
 		fs := fstest.MapFS{}
-		handler.AttachStaticFSHandler(mux, fs, true, CC)
+		handler.AttachStaticFSHandler(mux, fs, true, CC, slog.Default())
 		request := httptest.NewRequest(http.MethodGet, "/static", nil)
 		response := httptest.NewRecorder()
 		mux.ServeHTTP(response, request)
@@ -63,7 +80,7 @@ func TestStatic_Directory(t *testing.T) {
 				Data: []byte("hello, world"),
 			},
 		}
-		handler.AttachStaticFSHandler(mux, fs, true, CC)
+		handler.AttachStaticFSHandler(mux, fs, true, CC, slog.Default())
 		request := httptest.NewRequest(http.MethodGet, "/static/", nil)
 		response := httptest.NewRecorder()
 		mux.ServeHTTP(response, request)
@@ -71,7 +88,7 @@ func TestStatic_Directory(t *testing.T) {
 		body, err := io.ReadAll(result.Body)
 		assert.Nil(t, err)
 		assert.Equal(t, http.StatusOK, result.StatusCode)
-		assert.Equal(t, "<pre>\n<a href=\"exists\">exists</a>\n</pre>\n", string(body))
+		assert.Equal(t, directoryListing("<a href=\"exists\">exists</a>\n"), string(body))
 	})
 	t.Run("Returns 200 When Not Listable But index.html Exists", func(t *testing.T) {
 		mux := http.NewServeMux()
@@ -80,7 +97,7 @@ func TestStatic_Directory(t *testing.T) {
 				Data: []byte("hello, world"),
 			},
 		}
-		handler.AttachStaticFSHandler(mux, fs, false, CC)
+		handler.AttachStaticFSHandler(mux, fs, false, CC, slog.Default())
 		request := httptest.NewRequest(http.MethodGet, "/static/", nil)
 		response := httptest.NewRecorder()
 		mux.ServeHTTP(response, request)
@@ -97,7 +114,7 @@ func TestStatic_Directory(t *testing.T) {
 				Data: []byte("hello, world"),
 			},
 		}
-		handler.AttachStaticFSHandler(mux, fs, false, CC)
+		handler.AttachStaticFSHandler(mux, fs, false, CC, slog.Default())
 		request := httptest.NewRequest(http.MethodGet, "/static/", nil)
 		response := httptest.NewRecorder()
 		mux.ServeHTTP(response, request)
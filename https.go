@@ -17,7 +17,7 @@
 package netgo
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 )
 
@@ -27,7 +27,7 @@ func IsSecure() bool {
 	return BooleanFlag(HTTPS)
 }
 
-func HTTPSRedirect(host string, paths map[string]bool) func(http.ResponseWriter, *http.Request) {
+func HTTPSRedirect(host string, paths map[string]bool, logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		allowed, ok := paths[r.URL.Path]
 		if allowed && ok && r.Host == host {
@@ -35,10 +35,10 @@ func HTTPSRedirect(host string, paths map[string]bool) func(http.ResponseWriter,
 			if len(r.URL.RawQuery) > 0 {
 				target += "?" + r.URL.RawQuery
 			}
-			log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL, r.Header, "redirected to", target)
+			logger.LogAttrs(r.Context(), slog.LevelInfo, "redirected", append(RequestAttrs(r), slog.String("target", target))...)
 			http.Redirect(w, r, target, http.StatusTemporaryRedirect)
 		} else {
-			log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL, r.Header, "not found")
+			logger.LogAttrs(r.Context(), slog.LevelInfo, "not found", RequestAttrs(r)...)
 			http.NotFound(w, r)
 		}
 	}
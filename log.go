@@ -17,134 +17,384 @@
 package netgo
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
+const (
+	LOG_LEVEL = "LOG_LEVEL"
+	// Key of the attribute tagging the type of an entry
+	LOG_TYPE = "type"
+	// Type of entries recording a request
+	REQUEST_LOG = "request"
+	// Type of entries recording a blocked request
+	BLOCKED_LOG = "blocked"
+)
+
+// NewLogger creates a logger writing JSON lines at or above the given level.
+func NewLogger(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level: level,
+	}))
+}
+
+// Logging is the log file and sinks configured by SetupLogger.
+type Logging struct {
+	*LogFile
+	Sinks []*AsyncSink
+	// Notified of SIGHUP, until closed
+	hangup chan os.Signal
+	// Closed once rotation on SIGHUP has stopped
+	done chan struct{}
+}
+
+// Close stops rotating the log file on SIGHUP, and closes the log file and the sinks, waiting for buffered entries to be written.
+func (l *Logging) Close() error {
+	if l.hangup != nil {
+		signal.Stop(l.hangup)
+		close(l.hangup)
+		<-l.done
+		l.hangup = nil
+	}
+	var errs []error
+	for _, s := range l.Sinks {
+		if d := s.Dropped(); d > 0 {
+			fmt.Fprintf(os.Stderr, "Log Sink Dropped %d Entries\n", d)
+		}
+		errs = append(errs, s.Close())
+	}
+	errs = append(errs, l.LogFile.Close())
+	return errors.Join(errs...)
+}
+
+// SetupLogging configures logging as SetupLogger does, and returns the file opened in LOG_DIRECTORY.
+//
+// Deprecated: Use SetupLogger, whose Logging also closes rotated files and flushes the sinks. The file returned here is only the first one written, so closing it does neither.
 func SetupLogging() (*os.File, error) {
+	_, logging, err := SetupLogger()
+	if err != nil {
+		return nil, err
+	}
+	logging.mutex.Lock()
+	defer logging.mutex.Unlock()
+	return logging.file, nil
+}
+
+// SetupLogger creates a logger writing to stdout, a file in LOG_DIRECTORY, and the sinks in LOG_SINKS, at the level in LOG_LEVEL, and makes it the default for both the slog and log packages.
+// The file is rotated according to LogFileOptionsFromEnv, and on SIGHUP.
+func SetupLogger() (*slog.Logger, *Logging, error) {
 	store, ok := os.LookupEnv("LOG_DIRECTORY")
 	if !ok {
 		store = "logs"
 	}
 	if err := os.MkdirAll(store, os.ModePerm); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	logFile, err := os.OpenFile(filepath.Join(store, time.Now().UTC().Format(time.RFC3339)), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	var level slog.Level
+	if l, ok := os.LookupEnv(LOG_LEVEL); ok {
+		if err := level.UnmarshalText([]byte(l)); err != nil {
+			return nil, nil, err
+		}
+	}
+	options, err := LogFileOptionsFromEnv()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	redaction, err := RedactionPolicyFromEnv()
+	if err != nil {
+		return nil, nil, err
 	}
-	log.SetOutput(io.MultiWriter(os.Stdout, logFile))
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	return logFile, nil
+	anonymiser, err := AnonymiserFromEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+	sinks, err := SinksFromEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+	logFile, err := OpenLogFile(store, options)
+	if err != nil {
+		for _, s := range sinks {
+			s.Close()
+		}
+		return nil, nil, err
+	}
+	LogRedaction = redaction
+	LogAnonymiser = anonymiser
+	writers := []io.Writer{os.Stdout, logFile}
+	for _, s := range sinks {
+		writers = append(writers, s)
+	}
+	logger := NewLogger(io.MultiWriter(writers...), level)
+	slog.SetDefault(logger)
+	logFile.SetLogger(logger)
+	// Reopen on SIGHUP, eg. after an external logrotate
+	hangup := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		defer close(done)
+		for range hangup {
+			if err := logFile.Rotate(); err != nil {
+				logger.Error("Log Rotation Failed", "error", err)
+			}
+		}
+	}()
+	return logger, &Logging{
+		LogFile: logFile,
+		Sinks:   sinks,
+		hangup:  hangup,
+		done:    done,
+	}, nil
+}
+
+// RequestAttrs returns the attributes describing a request, with the client address anonymised and sensitive headers redacted.
+func RequestAttrs(r *http.Request) []slog.Attr {
+	return NewRequestRecord(r, time.Now()).Attrs()
 }
 
-func LogRequest(r *http.Request) {
-	log.Println(r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL, r.Header)
+// LogRequest records the request as an entry of type REQUEST_LOG.
+func LogRequest(logger *slog.Logger, r *http.Request) {
+	logger.LogAttrs(r.Context(), slog.LevelInfo, "request", append([]slog.Attr{slog.String(LOG_TYPE, REQUEST_LOG)}, RequestAttrs(r)...)...)
 }
 
+// jsonRequestLog is the structure of a request entry written by LogRequest.
+type jsonRequestLog struct {
+	Time     time.Time   `json:"time"`
+	Type     string      `json:"type"`
+	Address  string      `json:"address"`
+	Protocol string      `json:"protocol"`
+	Method   string      `json:"method"`
+	Host     string      `json:"host"`
+	URL      string      `json:"url"`
+	Headers  http.Header `json:"headers"`
+}
+
+// LEGACY_TIME_FORMAT is the timestamp prefixed to logs written before request entries were tagged.
+const LEGACY_TIME_FORMAT = "2006/01/02 15:04:05"
+
+// ParseError describes why a log line could not be parsed.
+type ParseError struct {
+	// Line number, counting from 1, or 0 if unknown as parsers only see the line, so it is set by the reader
+	Line int
+	// Byte offset within the line, counting from 1
+	Column int
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Reason)
+	}
+	return fmt.Sprintf("column %d: %s", e.Column, e.Reason)
+}
+
+// IsRequestLog returns true if the line is a request entry written by LogRequest, or, for logs written before entries were tagged, if the line is prefixed by a timestamp and one of the given sources.
 func IsRequestLog(sources []string, line string) bool {
-	if !strings.HasPrefix(line, "2") {
+	if strings.HasPrefix(line, "{") {
+		var entry struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return false
+		}
+		return entry.Type == REQUEST_LOG
+	}
+	if len(line) <= len(LEGACY_TIME_FORMAT) || line[len(LEGACY_TIME_FORMAT)] != ' ' {
 		return false
 	}
-	if _, err := time.Parse("2006/01/02 15:04:05", line[:19]); err != nil {
+	if _, err := time.Parse(LEGACY_TIME_FORMAT, line[:len(LEGACY_TIME_FORMAT)]); err != nil {
 		return false
 	}
 	for _, s := range sources {
-		if strings.HasPrefix(line[20:], s) {
+		if strings.HasPrefix(line[len(LEGACY_TIME_FORMAT)+1:], s) {
 			return true
 		}
 	}
 	return false
 }
 
+// ParseRequestLog parses a request entry, returning a *ParseError if the line is malformed.
+//
+// Deprecated: Use ParseRequestRecord, which preserves the port, sub-second time, and multi-valued headers.
 func ParseRequestLog(line string) (int64, []string, map[string]string, error) {
-	var (
-		source,
-		address,
-		protocol,
-		method,
-		host,
-		url string
-		headers map[string]string
-	)
-
-	start := 20
-	timestamp, err := time.Parse("2006/01/02 15:04:05 ", line[:start])
+	record, err := ParseRequestRecord(line)
 	if err != nil {
 		return 0, nil, nil, err
 	}
+	var headers map[string]string
+	if record.Header != nil {
+		headers = make(map[string]string, len(record.Header))
+		for k, v := range record.Header {
+			headers[k] = strings.Join(v, " ")
+		}
+	}
+	return record.Time.Unix(), []string{
+		record.Source,
+		record.IP,
+		record.Protocol,
+		record.Method,
+		record.Host,
+		record.URL.String(),
+	}, headers, nil
+}
 
-	end := start + strings.IndexRune(line[start:], ' ')
-	source = line[start:end]
-
-	start = end + 1
-	end = start + strings.IndexRune(line[start:], ' ')
-	address, _, err = net.SplitHostPort(line[start:end])
+// ParseRequestRecord parses a request entry, returning a *ParseError if the line is malformed.
+func ParseRequestRecord(line string) (*RequestRecord, error) {
+	if strings.HasPrefix(line, "{") {
+		return parseJSONRequestLog(line)
+	}
+	if len(line) <= len(LEGACY_TIME_FORMAT) {
+		return nil, &ParseError{Column: len(line) + 1, Reason: "Missing Timestamp"}
+	}
+	timestamp, err := time.Parse(LEGACY_TIME_FORMAT, line[:len(LEGACY_TIME_FORMAT)])
 	if err != nil {
-		return 0, nil, nil, err
+		return nil, &ParseError{Column: 1, Reason: "Invalid Timestamp"}
 	}
 
-	start = end + 1
-	end = start + strings.IndexRune(line[start:], ' ')
-	protocol = line[start:end]
+	// Fields are separated by a single space
+	start := len(LEGACY_TIME_FORMAT) + 1
+	field := func(name string) (string, int, error) {
+		if start > len(line) {
+			return "", 0, &ParseError{Column: len(line) + 1, Reason: "Missing " + name}
+		}
+		i := strings.IndexByte(line[start:], ' ')
+		if i < 0 {
+			return "", 0, &ParseError{Column: len(line) + 1, Reason: "Missing " + name}
+		}
+		column := start + 1
+		f := line[start : start+i]
+		start += i + 1
+		return f, column, nil
+	}
 
-	start = end + 1
-	end = start + strings.IndexRune(line[start:], ' ')
-	method = line[start:end]
+	record := &RequestRecord{
+		Time: timestamp,
+	}
+	if record.Source, _, err = field("Source"); err != nil {
+		return nil, err
+	}
+	address, column, err := field("Address")
+	if err != nil {
+		return nil, err
+	}
+	if record.IP, record.Port, err = splitAddress(address); err != nil {
+		return nil, &ParseError{Column: column, Reason: "Invalid Address"}
+	}
+	if record.Protocol, _, err = field("Protocol"); err != nil {
+		return nil, err
+	}
+	if record.Method, _, err = field("Method"); err != nil {
+		return nil, err
+	}
+	if record.Host, _, err = field("Host"); err != nil {
+		// Host must be followed by the URL
+		return nil, &ParseError{Column: len(line) + 1, Reason: "Missing URL"}
+	}
 
-	start = end + 1
-	end = start + strings.IndexRune(line[start:], ' ')
-	host = line[start:end]
+	raw := line[start:]
+	column = start + 1
+	if i := strings.IndexByte(raw, ' '); i >= 0 {
+		raw = raw[:i]
+		start += i + 1
+		h := line[start:]
+		if !strings.HasPrefix(h, "map[") || !strings.HasSuffix(h, "]") {
+			return nil, &ParseError{Column: start + 1, Reason: "Invalid Headers"}
+		}
+		record.Header = make(http.Header)
+		for k, v := range parseHeaders(h[len("map[") : len(h)-1]) {
+			record.Header[k] = []string{v}
+		}
+	}
+	if record.URL, err = url.Parse(raw); err != nil {
+		return nil, &ParseError{Column: column, Reason: "Invalid URL"}
+	}
 
-	start = end + 1
-	end = start + strings.IndexRune(line[start:], ' ')
-	if end > start {
-		url = line[start:end]
+	return record, nil
+}
 
-		start = end + 1
-		headers = parseHeaders(strings.TrimSuffix(strings.TrimPrefix(line[start:], "map["), "]"))
-	} else {
-		url = line[start:]
+func parseJSONRequestLog(line string) (*RequestRecord, error) {
+	var entry jsonRequestLog
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		column := 1
+		var syntax *json.SyntaxError
+		var typ *json.UnmarshalTypeError
+		if errors.As(err, &syntax) {
+			column = int(syntax.Offset)
+		} else if errors.As(err, &typ) {
+			column = int(typ.Offset)
+		}
+		return nil, &ParseError{Column: column, Reason: "Invalid JSON: " + err.Error()}
+	}
+	if entry.Type != REQUEST_LOG {
+		return nil, &ParseError{Column: 1, Reason: "Not a Request"}
 	}
+	if entry.Time.IsZero() {
+		return nil, &ParseError{Column: 1, Reason: "Missing Timestamp"}
+	}
+	ip, port, err := splitAddress(entry.Address)
+	if err != nil {
+		return nil, &ParseError{Column: 1, Reason: "Invalid Address"}
+	}
+	u, err := url.Parse(entry.URL)
+	if err != nil {
+		return nil, &ParseError{Column: 1, Reason: "Invalid URL"}
+	}
+	return &RequestRecord{
+		Time:     entry.Time,
+		Source:   entry.Type,
+		IP:       ip,
+		Port:     port,
+		Protocol: entry.Protocol,
+		Method:   entry.Method,
+		Host:     entry.Host,
+		URL:      u,
+		Header:   entry.Headers,
+	}, nil
+}
 
-	return timestamp.Unix(), []string{
-		source,
-		address,
-		protocol,
-		method,
-		host,
-		url,
-	}, headers, nil
+// splitAddress splits a host:port address, where the port must be numeric.
+func splitAddress(address string) (string, int, error) {
+	ip, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, err
+	}
+	return ip, p, nil
 }
 
+// parseHeaders parses the formatted contents of a map[string][]string, eg. "Accept:[*/*] User-Agent:[curl/7.68.0]".
 func parseHeaders(s string) map[string]string {
 	headers := make(map[string]string)
-	limit := len(s) - 1
-	var (
-		start, end int
-		key, value string
-	)
-	for start < limit {
-		end = start + strings.Index(s[start:], ":[")
-		if end < start {
+	for s != "" {
+		i := strings.Index(s, ":[")
+		if i < 0 {
 			break
 		}
-		key = s[start:end]
-
-		start = end + 2
-		end = start + strings.Index(s[start:], "] ")
-		if end < start {
-			value = s[start:limit]
-			start = limit
+		key := s[:i]
+		s = s[i+2:]
+		var value string
+		if j := strings.Index(s, "] "); j >= 0 {
+			value = s[:j]
+			s = s[j+2:]
 		} else {
-			value = s[start:end]
-			start = end + 2
+			value = strings.TrimSuffix(s, "]")
+			s = ""
 		}
 		headers[key] = value
 	}
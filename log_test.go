@@ -0,0 +1,247 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netgo_test
+
+import (
+	"aletheiaware.com/netgo"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	LEGACY_LINE = `2022/03/04 12:00:00 log.go:30: 192.0.2.1:4567 HTTP/1.1 GET example.com / map[Accept:[*/*] User-Agent:[curl/7.68.0]]`
+	JSON_LINE   = `{"time":"2022-03-04T12:00:00Z","level":"INFO","msg":"request","type":"request","address":"192.0.2.1:4567","protocol":"HTTP/1.1","method":"GET","host":"example.com","url":"/","headers":{"Accept":["*/*"],"User-Agent":["curl/7.68.0"]}}`
+)
+
+func TestIsRequestLog(t *testing.T) {
+	sources := []string{"log.go:"}
+	for line, expected := range map[string]bool{
+		LEGACY_LINE: true,
+		JSON_LINE:   true,
+		`2022/03/04 12:00:00 main.go:10: Starting`: false,
+		`{"level":"INFO","msg":"Starting"}`:        false,
+		"":                                         false,
+		"2022/03/04 12:00:00":                      false,
+		"2022/03/04 12:00:00 ":                     false,
+		"20":                                       false,
+		"{":                                        false,
+	} {
+		if actual := netgo.IsRequestLog(sources, line); actual != expected {
+			t.Errorf("Incorrect result for '%s'; expected '%t', got '%t'", line, expected, actual)
+		}
+	}
+}
+
+func TestParseRequestLog(t *testing.T) {
+	t.Run("Legacy", func(t *testing.T) {
+		timestamp, request, headers, err := netgo.ParseRequestLog(LEGACY_LINE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if timestamp != 1646395200 {
+			t.Errorf("Incorrect timestamp; expected '1646395200', got '%d'", timestamp)
+		}
+		expected := []string{"log.go:30:", "192.0.2.1", "HTTP/1.1", "GET", "example.com", "/"}
+		if !reflect.DeepEqual(expected, request) {
+			t.Errorf("Incorrect request; expected '%v', got '%v'", expected, request)
+		}
+		expectedHeaders := map[string]string{"Accept": "*/*", "User-Agent": "curl/7.68.0"}
+		if !reflect.DeepEqual(expectedHeaders, headers) {
+			t.Errorf("Incorrect headers; expected '%v', got '%v'", expectedHeaders, headers)
+		}
+	})
+	t.Run("JSON", func(t *testing.T) {
+		timestamp, request, headers, err := netgo.ParseRequestLog(JSON_LINE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if timestamp != 1646395200 {
+			t.Errorf("Incorrect timestamp; expected '1646395200', got '%d'", timestamp)
+		}
+		expected := []string{"request", "192.0.2.1", "HTTP/1.1", "GET", "example.com", "/"}
+		if !reflect.DeepEqual(expected, request) {
+			t.Errorf("Incorrect request; expected '%v', got '%v'", expected, request)
+		}
+		expectedHeaders := map[string]string{"Accept": "*/*", "User-Agent": "curl/7.68.0"}
+		if !reflect.DeepEqual(expectedHeaders, headers) {
+			t.Errorf("Incorrect headers; expected '%v', got '%v'", expectedHeaders, headers)
+		}
+	})
+	t.Run("Errors", func(t *testing.T) {
+		for line, expected := range map[string]netgo.ParseError{
+			"2022/03/04":                                                                    {Column: 11, Reason: "Missing Timestamp"},
+			"2022/13/04 12:00:00 log.go:30:":                                                {Column: 1, Reason: "Invalid Timestamp"},
+			"2022/03/04 12:00:00 log.go:30:":                                                {Column: 31, Reason: "Missing Source"},
+			"2022/03/04 12:00:00 log.go:30: 192.0.2.1":                                      {Column: 41, Reason: "Missing Address"},
+			"2022/03/04 12:00:00 log.go:30: 192.0.2.1 HTTP/1":                               {Column: 32, Reason: "Invalid Address"},
+			"2022/03/04 12:00:00 log.go:30: 192.0.2.1:4567 HTTP/1.1 GET example.com":        {Column: 71, Reason: "Missing URL"},
+			"2022/03/04 12:00:00 log.go:30: 192.0.2.1:4567 HTTP/1.1 GET example.com / map[": {Column: 74, Reason: "Invalid Headers"},
+			`{"type":"request","address":"192.0.2.1:4567"}`:                                 {Column: 1, Reason: "Missing Timestamp"},
+			`{"time":"2022-03-04T12:00:00Z","type":"request","address":"192.0.2.1"}`:        {Column: 1, Reason: "Invalid Address"},
+			`{"time":"2022-03-04T12:00:00Z","type":"other"}`:                                {Column: 1, Reason: "Not a Request"},
+		} {
+			_, _, _, err := netgo.ParseRequestLog(line)
+			var actual *netgo.ParseError
+			if !errors.As(err, &actual) {
+				t.Errorf("Incorrect error for '%s'; expected '%v', got '%v'", line, expected, err)
+				continue
+			}
+			if *actual != expected {
+				t.Errorf("Incorrect error for '%s'; expected '%v', got '%v'", line, expected, *actual)
+			}
+		}
+	})
+}
+
+func FuzzParseRequestLog(f *testing.F) {
+	f.Add(LEGACY_LINE)
+	f.Add(JSON_LINE)
+	f.Add(COMBINED_LINE)
+	f.Add(CADDY_LINE)
+	f.Fuzz(func(t *testing.T, line string) {
+		netgo.IsRequestLog([]string{"log.go:"}, line)
+		for _, format := range netgo.LogFormats([]string{"log.go:"}) {
+			format.Detect(line)
+			if _, err := format.NewParser().Parse(line); err != nil {
+				var p *netgo.ParseError
+				if !errors.As(err, &p) {
+					t.Fatalf("Untyped %s error for '%s': %v", format.Name(), line, err)
+				}
+			}
+		}
+		_, request, _, err := netgo.ParseRequestLog(line)
+		if err != nil {
+			var p *netgo.ParseError
+			if !errors.As(err, &p) {
+				t.Fatalf("Untyped error for '%s': %v", line, err)
+			}
+			if p.Column < 1 || p.Column > len(line)+1 {
+				t.Fatalf("Column out of range for '%s': %v", line, p)
+			}
+			return
+		}
+		if len(request) != 6 {
+			t.Fatalf("Incorrect request for '%s': %v", line, request)
+		}
+	})
+}
+
+func TestParseRequestRecord(t *testing.T) {
+	line := `{"time":"2022-03-04T12:00:00.123Z","type":"request","address":"[2001:db8::1]:4567","protocol":"HTTP/2.0","method":"GET","host":"example.com","url":"/search?q=a+b","headers":{"Accept":["text/html","*/*"]}}`
+	record, err := netgo.ParseRequestRecord(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := time.Date(2022, 3, 4, 12, 0, 0, 123000000, time.UTC); !record.Time.Equal(expected) {
+		t.Errorf("Incorrect time; expected '%v', got '%v'", expected, record.Time)
+	}
+	if record.IP != "2001:db8::1" || record.Port != 4567 {
+		t.Errorf("Incorrect address; expected '2001:db8::1' and '4567', got '%s' and '%d'", record.IP, record.Port)
+	}
+	if record.URL.Path != "/search" || record.URL.Query().Get("q") != "a b" {
+		t.Errorf("Incorrect URL; got '%v'", record.URL)
+	}
+	if expected := []string{"text/html", "*/*"}; !reflect.DeepEqual(expected, record.Header.Values("Accept")) {
+		t.Errorf("Incorrect header; expected '%v', got '%v'", expected, record.Header.Values("Accept"))
+	}
+
+	// Records survive a round trip through JSON
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &netgo.RequestRecord{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(record, decoded) {
+		t.Errorf("Incorrect record; expected '%+v', got '%+v'", record, decoded)
+	}
+}
+
+func TestLogRequest(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := netgo.NewLogger(&buffer, slog.LevelInfo)
+	request := httptest.NewRequest(http.MethodPost, "https://example.com/form?a=1", nil)
+	request.RemoteAddr = "192.0.2.1:4567"
+	request.Header.Add("Accept", "text/html")
+	request.Header.Add("Accept", "*/*")
+	netgo.LogRequest(logger, request)
+
+	line := strings.TrimSpace(buffer.String())
+	if !netgo.IsRequestLog(nil, line) {
+		t.Fatalf("Not a request log; got '%s'", line)
+	}
+	record, err := netgo.ParseRequestRecord(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.IP != "192.0.2.1" || record.Port != 4567 || record.Method != http.MethodPost || record.Host != "example.com" || record.URL.String() != "https://example.com/form?a=1" {
+		t.Errorf("Incorrect record; got '%+v'", record)
+	}
+	if expected := []string{"text/html", "*/*"}; !reflect.DeepEqual(expected, record.Header.Values("Accept")) {
+		t.Errorf("Incorrect header; expected '%v', got '%v'", expected, record.Header.Values("Accept"))
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	previous := slog.Default()
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+	})
+	dir := t.TempDir()
+	t.Setenv("LOG_DIRECTORY", dir)
+	file, err := netgo.SetupLogging()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.Info("setup")
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(file.Name()) != dir {
+		t.Errorf("Incorrect directory; expected '%s', got '%s'", dir, filepath.Dir(file.Name()))
+	}
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"msg":"setup"`) {
+		t.Errorf("Entry not written; got '%s'", data)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for expected, err := range map[string]*netgo.ParseError{
+		"column 3: Invalid Address":         {Column: 3, Reason: "Invalid Address"},
+		"line 7, column 3: Invalid Address": {Line: 7, Column: 3, Reason: "Invalid Address"},
+	} {
+		if actual := err.Error(); actual != expected {
+			t.Errorf("Incorrect error; expected '%s', got '%s'", expected, actual)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Dialect adapts the schema and queries to a database engine.
+type Dialect struct {
+	Name string
+	// Driver registered with database/sql
+	Driver string
+	// Whether parameters are numbered, as in $1, rather than ?
+	Numbered bool
+	// Migrations bring a database up to the latest version
+	Migrations []*Migration
+	// Queries that differ from the defaults, keyed by the default
+	Queries map[string]string
+	// Regexp is the condition matching the column formatted into it with a regular expression parameter
+	Regexp string
+	// Glob is true if wildcards are matched with GLOB, which is case sensitive unlike LIKE in SQLite
+	Glob bool
+}
+
+// dialects are keyed by the scheme of their DSNs.
+var dialects = map[string]*Dialect{
+	"sqlite":     SQLite,
+	"sqlite3":    SQLite,
+	"postgres":   Postgres,
+	"postgresql": Postgres,
+}
+
+// LatestVersion returns the version of a database once all migrations are applied.
+func (d *Dialect) LatestVersion() int {
+	return d.Migrations[len(d.Migrations)-1].Version
+}
+
+// Query returns the dialect's version of the query, with parameters numbered if needed.
+func (d *Dialect) Query(query string) string {
+	if q, ok := d.Queries[query]; ok {
+		return q
+	}
+	return d.Rebind(query)
+}
+
+// Rebind replaces each ? parameter with its number, if the dialect numbers parameters.
+// Question marks within quoted literals are left as they are.
+func (d *Dialect) Rebind(query string) string {
+	if !d.Numbered {
+		return query
+	}
+	var (
+		b      strings.Builder
+		n      int
+		quoted bool
+	)
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// ParseDSN returns the dialect of the data source name, and the name given to its driver.
+// Names without a scheme, such as log.db, are SQLite databases.
+// DuckDB is only available when built with the duckdb tag.
+func ParseDSN(dsn string) (*Dialect, string, error) {
+	scheme, name, ok := strings.Cut(dsn, "://")
+	if !ok {
+		return SQLite, dsn, nil
+	}
+	d, ok := dialects[scheme]
+	if !ok {
+		if scheme == "duckdb" {
+			return nil, "", fmt.Errorf("Unsupported Database: %s (build with -tags duckdb)", scheme)
+		}
+		return nil, "", fmt.Errorf("Unsupported Database: %s", scheme)
+	}
+	if d == Postgres {
+		// Driver accepts the URL as is
+		return d, dsn, nil
+	}
+	return d, name, nil
+}
@@ -0,0 +1,115 @@
+//go:build duckdb
+
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb
+
+import (
+	"database/sql"
+	_ "github.com/marcboeker/go-duckdb"
+)
+
+// DuckDB stores the database in a single columnar file, which aggregates large logs faster than SQLite.
+var DuckDB = &Dialect{
+	Name:   "duckdb",
+	Driver: "duckdb",
+	Regexp: `regexp_matches(%s, ?)`,
+	Glob:   true,
+	Migrations: []*Migration{
+		{
+			Version:     1,
+			Description: "Create files, requests, and headers",
+			Up: func(tx *sql.Tx) error {
+				// Columns are scanned without secondary indexes, which would only slow down inserts
+				return execAll(tx,
+					DUCKDB_CREATE_SEQUENCES_QUERY,
+					DUCKDB_CREATE_FILES_QUERY,
+					DUCKDB_CREATE_REQUESTS_QUERY,
+					DUCKDB_CREATE_HEADER_KEYS_QUERY,
+					DUCKDB_CREATE_HEADER_VALUES_QUERY,
+					DUCKDB_CREATE_HEADERS_QUERY,
+				)
+			},
+		},
+		{
+			Version:     2,
+			Description: "Record port, and address in hex so networks can be matched, of requests",
+			Up: func(tx *sql.Tx) error {
+				if err := execAll(tx, DUCKDB_ADD_REQUESTS_PORT_QUERY, DUCKDB_ADD_REQUESTS_ADDRESS_HEX_QUERY); err != nil {
+					return err
+				}
+				return fillAddressHex(tx, UPDATE_ADDRESS_HEX_QUERY)
+			},
+		},
+		{
+			Version:     3,
+			Description: "Store named exclusions of requests",
+			Up: func(tx *sql.Tx) error {
+				return execAll(tx, CREATE_EXCLUSIONS_QUERY)
+			},
+		},
+	},
+}
+
+func init() {
+	dialects["duckdb"] = DuckDB
+}
+
+// Foreign keys are omitted, as DuckDB checks them on every insert without an index to help.
+const (
+	DUCKDB_CREATE_SEQUENCES_QUERY = `CREATE SEQUENCE IF NOT EXISTS seq_files;
+CREATE SEQUENCE IF NOT EXISTS seq_requests;
+CREATE SEQUENCE IF NOT EXISTS seq_header_keys;
+CREATE SEQUENCE IF NOT EXISTS seq_header_values;
+CREATE SEQUENCE IF NOT EXISTS seq_headers;`
+	DUCKDB_CREATE_FILES_QUERY = `CREATE TABLE IF NOT EXISTS tbl_files (
+    id BIGINT PRIMARY KEY DEFAULT nextval('seq_files'),
+    name TEXT NOT NULL UNIQUE,
+    byte_offset BIGINT NOT NULL DEFAULT 0,
+    line_count BIGINT NOT NULL DEFAULT 0,
+    inode BIGINT NOT NULL DEFAULT 0,
+    tag TEXT NOT NULL DEFAULT ''
+);`
+	DUCKDB_CREATE_REQUESTS_QUERY = `CREATE TABLE IF NOT EXISTS tbl_requests (
+    id BIGINT PRIMARY KEY DEFAULT nextval('seq_requests'),
+    file BIGINT NULL,
+    timestamp BIGINT NOT NULL,
+    source TEXT,
+    address TEXT,
+    protocol TEXT,
+    method TEXT,
+    host TEXT,
+    url TEXT
+);`
+	DUCKDB_CREATE_HEADER_KEYS_QUERY = `CREATE TABLE IF NOT EXISTS tbl_header_keys (
+    id BIGINT PRIMARY KEY DEFAULT nextval('seq_header_keys'),
+    key TEXT NOT NULL UNIQUE
+);`
+	DUCKDB_CREATE_HEADER_VALUES_QUERY = `CREATE TABLE IF NOT EXISTS tbl_header_values (
+    id BIGINT PRIMARY KEY DEFAULT nextval('seq_header_values'),
+    value TEXT NOT NULL UNIQUE
+);`
+	// Columns added to existing tables cannot have constraints
+	DUCKDB_ADD_REQUESTS_PORT_QUERY        = `ALTER TABLE tbl_requests ADD COLUMN IF NOT EXISTS port INTEGER DEFAULT 0;`
+	DUCKDB_ADD_REQUESTS_ADDRESS_HEX_QUERY = `ALTER TABLE tbl_requests ADD COLUMN IF NOT EXISTS address_hex TEXT DEFAULT '';`
+	DUCKDB_CREATE_HEADERS_QUERY           = `CREATE TABLE IF NOT EXISTS tbl_headers (
+    id BIGINT PRIMARY KEY DEFAULT nextval('seq_headers'),
+    request BIGINT NULL,
+    key_id BIGINT NOT NULL,
+    value_id BIGINT NOT NULL
+);`
+)
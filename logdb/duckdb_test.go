@@ -0,0 +1,34 @@
+//go:build duckdb
+
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb_test
+
+import (
+	"aletheiaware.com/netgo/logdb"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore_DuckDB(t *testing.T) {
+	testStore(t, func(t *testing.T) logdb.Store {
+		store, err := logdb.Open("duckdb://" + filepath.Join(t.TempDir(), "log.duckdb"))
+		assert.Nil(t, err)
+		return store
+	})
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	SELECT_EXCLUSIONS_QUERY = `SELECT name, address, url, user_agent FROM tbl_exclusions ORDER BY name;`
+	UPSERT_EXCLUSION_QUERY  = `INSERT INTO tbl_exclusions (name, address, url, user_agent) VALUES (?, ?, ?, ?) ON CONFLICT (name) DO UPDATE SET address = excluded.address, url = excluded.url, user_agent = excluded.user_agent;`
+	DELETE_EXCLUSION_QUERY  = `DELETE FROM tbl_exclusions WHERE name = ?;`
+
+	// SELECT_USER_AGENT_QUERY selects the User-Agent headers of each request, to be followed by conditions on their values
+	SELECT_USER_AGENT_QUERY = `SELECT 1 FROM tbl_headers h INNER JOIN tbl_header_keys k ON k.id = h.key_id INNER JOIN tbl_header_values v ON v.id = h.value_id WHERE h.request = tbl_requests.id AND k.key = 'User-Agent' AND `
+)
+
+// Built in exclusions
+const (
+	EXCLUSION_BOTS   = "bots"
+	EXCLUSION_HEALTH = "health"
+)
+
+//go:embed bots.txt
+var botsFile string
+
+// Bots are the text found within the User-Agent header of bots and crawlers, read from bots.txt.
+var Bots = parseBots(botsFile)
+
+// BuiltInExclusions are always available, and cannot be replaced or deleted.
+var BuiltInExclusions = []*Exclusion{
+	{
+		Name:      EXCLUSION_BOTS,
+		UserAgent: botsExpression(Bots),
+		BuiltIn:   true,
+	},
+	{
+		// Served by handler.AttachHealthHandler
+		Name:    EXCLUSION_HEALTH,
+		URL:     "/health",
+		BuiltIn: true,
+	},
+}
+
+// Exclusion is a named preset excluding the requests that match all of its expressions.
+type Exclusion struct {
+	Name string
+	// Expressions matching the address, URL, and User-Agent header of excluded requests, each ignored if empty
+	Address, URL, UserAgent string
+	// Whether the exclusion is built in, rather than stored in the database
+	BuiltIn bool
+}
+
+// validate returns an *ExpressionError if an expression is invalid, or an error if nothing would be matched.
+func (e *Exclusion) validate() error {
+	if strings.TrimSpace(e.Name) == "" {
+		return errors.New("Missing Exclusion Name")
+	}
+	if strings.Contains(e.Name, ",") {
+		// Names are separated by commas when excluding requests
+		return errors.New("Invalid Exclusion Name: " + e.Name)
+	}
+	if e.Address == "" && e.URL == "" && e.UserAgent == "" {
+		return errors.New("Empty Exclusion: " + e.Name)
+	}
+	for _, f := range []*field{
+		{"Address", KIND_ADDRESS, "", e.Address},
+		{"URL", KIND_TEXT, "", e.URL},
+		{"User Agent", KIND_TEXT, "", e.UserAgent},
+	} {
+		if _, err := ParseExpression(f.name, f.kind, f.expression); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// condition returns the condition matching the requests excluded, and the arguments it binds.
+func (e *Exclusion) condition(d *Dialect) (*conditions, error) {
+	c := &conditions{}
+	if err := c.fields(d,
+		&field{"Address", KIND_ADDRESS, `tbl_requests.address`, e.Address},
+		&field{"URL", KIND_TEXT, `tbl_requests.url`, e.URL},
+	); err != nil {
+		return nil, err
+	}
+	agent := &conditions{}
+	if err := agent.fields(d, &field{"User Agent", KIND_TEXT, `v.value`, e.UserAgent}); err != nil {
+		return nil, err
+	}
+	if len(agent.sql) > 0 {
+		c.add(`EXISTS (`+SELECT_USER_AGENT_QUERY+agent.join("")+`)`, agent.args...)
+	}
+	return c, nil
+}
+
+func (s *SQLStore) Exclusions() ([]*Exclusion, error) {
+	exclusions := append([]*Exclusion{}, BuiltInExclusions...)
+	rows, err := s.db.Query(s.dialect.Query(SELECT_EXCLUSIONS_QUERY))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := &Exclusion{}
+		if err := rows.Scan(&e.Name, &e.Address, &e.URL, &e.UserAgent); err != nil {
+			return nil, err
+		}
+		exclusions = append(exclusions, e)
+	}
+	return exclusions, rows.Err()
+}
+
+func (s *SQLStore) SaveExclusion(e *Exclusion) error {
+	if builtIn(e.Name) {
+		return fmt.Errorf("Cannot Replace Built In Exclusion: %s", e.Name)
+	}
+	if err := e.validate(); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(s.dialect.Query(UPSERT_EXCLUSION_QUERY), e.Name, e.Address, e.URL, e.UserAgent)
+	return err
+}
+
+func (s *SQLStore) DeleteExclusion(name string) (bool, error) {
+	if builtIn(name) {
+		return false, fmt.Errorf("Cannot Delete Built In Exclusion: %s", name)
+	}
+	result, err := s.db.Exec(s.dialect.Query(DELETE_EXCLUSION_QUERY), name)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// builtIn returns true if the name is of a built in exclusion.
+func builtIn(name string) bool {
+	for _, e := range BuiltInExclusions {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBots returns the lines of the file, other than blank lines and comments.
+func parseBots(file string) []string {
+	var bots []string
+	scanner := bufio.NewScanner(strings.NewReader(file))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		bots = append(bots, line)
+	}
+	return bots
+}
+
+// botsExpression returns the expression matching text containing any of the bots.
+func botsExpression(bots []string) string {
+	escape := strings.NewReplacer(`\`, `\\`, `|`, `\|`, `*`, `\*`)
+	terms := make([]string, len(bots))
+	for i, b := range bots {
+		terms[i] = `*` + escape.Replace(b) + `*`
+	}
+	return strings.Join(terms, `|`)
+}
@@ -0,0 +1,41 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb_test
+
+import (
+	"aletheiaware.com/netgo/logdb"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestBuiltInExclusions(t *testing.T) {
+	assert.Contains(t, logdb.Bots, "Googlebot")
+	for _, b := range logdb.Bots {
+		assert.NotEmpty(t, b)
+		assert.False(t, strings.HasPrefix(b, "#"))
+	}
+	for _, e := range logdb.BuiltInExclusions {
+		t.Run(e.Name, func(t *testing.T) {
+			assert.True(t, e.BuiltIn)
+			for _, expression := range []string{e.Address, e.URL, e.UserAgent} {
+				_, err := logdb.ParseExpression(e.Name, logdb.KIND_TEXT, expression)
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Kind of field, which determines how its filter expressions are interpreted.
+type Kind int
+
+const (
+	// KIND_TEXT fields match text exactly, by wildcard, or by regular expression
+	KIND_TEXT Kind = iota
+	// KIND_ADDRESS fields also match networks, such as 192.0.2.0/24
+	KIND_ADDRESS
+	// KIND_NUMBER fields match numbers exactly, by comparison, such as >=1024, or by range, such as 8000..8999
+	KIND_NUMBER
+)
+
+// match is the way a term compares a field with its value.
+type match int
+
+const (
+	MATCH_EXACT match = iota
+	MATCH_WILDCARD
+	MATCH_REGEXP
+	MATCH_NETWORK
+	MATCH_COMPARE
+	MATCH_RANGE
+)
+
+// Expression is a filter on a field, such as GET|POST, -/health, *bot*, ~^/blog/, "a|b", 192.0.2.0/24, or >=1024.
+//
+// Terms separated by | select values matching any of them, and terms prefixed with - exclude values matching them.
+// An unquoted * matches any text, ~ prefixes a regular expression, and double quotes match text exactly, with \" and \\ as escapes.
+// Elsewhere, \ escapes the next character, so \| \* and \- match the character itself.
+type Expression struct {
+	Field string
+	terms []*term
+}
+
+// term is a single comparison of an expression.
+type term struct {
+	not   bool
+	match match
+	// Text matched exactly or by regular expression, or the parts between wildcards
+	text  string
+	parts []string
+	// Operator comparing numbers, such as >=
+	operator string
+	// Number compared, or the bounds of a range or network
+	number    int64
+	low, high any
+}
+
+// ExpressionError describes where and why an expression could not be parsed.
+type ExpressionError struct {
+	Field string
+	// Column of the expression, starting at 1
+	Column int
+	Reason string
+}
+
+func (e *ExpressionError) Error() string {
+	return fmt.Sprintf("Invalid %s Filter at Column %d: %s", e.Field, e.Column, e.Reason)
+}
+
+// ParseExpression parses the filter expression of the named field, returning nil if it is empty.
+func ParseExpression(field string, kind Kind, expression string) (*Expression, error) {
+	if expression == "" {
+		return nil, nil
+	}
+	p := &expressionParser{
+		field:      field,
+		kind:       kind,
+		expression: expression,
+	}
+	e := &Expression{
+		Field: field,
+	}
+	for {
+		t, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		e.terms = append(e.terms, t)
+		if p.pos >= len(p.expression) {
+			return e, nil
+		}
+		// Only | follows a term
+		p.pos++
+	}
+}
+
+// expressionParser reads the terms of an expression.
+type expressionParser struct {
+	field      string
+	kind       Kind
+	expression string
+	pos        int
+}
+
+func (p *expressionParser) error(pos int, reason string) error {
+	return &ExpressionError{
+		Field:  p.field,
+		Column: pos + 1,
+		Reason: reason,
+	}
+}
+
+// term reads the term at the current position.
+func (p *expressionParser) term() (*term, error) {
+	t := &term{}
+	start := p.pos
+	if p.consume("-") {
+		t.not = true
+	}
+	pattern := p.consume("~")
+	if !pattern && p.kind == KIND_NUMBER {
+		for _, op := range []string{">=", "<=", ">", "<"} {
+			if p.consume(op) {
+				t.operator = op
+				break
+			}
+		}
+	}
+	valuePos := p.pos
+	if p.pos < len(p.expression) && p.expression[p.pos] == '"' {
+		text, err := p.quoted(pattern)
+		if err != nil {
+			return nil, err
+		}
+		t.text = text
+		t.parts = []string{text}
+	} else {
+		t.parts = p.bare(pattern)
+		t.text = strings.Join(t.parts, "*")
+		if len(t.parts) == 1 && t.parts[0] == "" {
+			if p.pos == start {
+				return nil, p.error(p.pos, "Empty Term")
+			}
+			return nil, p.error(p.pos, "Missing Value")
+		}
+	}
+	switch {
+	case pattern && p.kind == KIND_NUMBER:
+		return nil, p.error(valuePos, "Regular Expressions Require a Text Field")
+	case pattern:
+		if _, err := regexp.Compile(t.text); err != nil {
+			return nil, p.error(valuePos, "Invalid Regular Expression")
+		}
+		t.match = MATCH_REGEXP
+	case p.kind == KIND_NUMBER:
+		return t, p.number(t, valuePos)
+	case len(t.parts) > 1:
+		t.match = MATCH_WILDCARD
+	case p.kind == KIND_ADDRESS && strings.Contains(t.text, "/") && p.expression[valuePos] != '"':
+		prefix, err := netip.ParsePrefix(t.text)
+		if err != nil {
+			return nil, p.error(valuePos, "Invalid Network")
+		}
+		t.match = MATCH_NETWORK
+		t.low, t.high = networkRange(prefix)
+	default:
+		t.match = MATCH_EXACT
+	}
+	return t, nil
+}
+
+// number interprets the text of the term as a number, or a range of numbers.
+func (p *expressionParser) number(t *term, pos int) error {
+	if len(t.parts) > 1 {
+		return p.error(pos, "Wildcards Require a Text Field")
+	}
+	if t.operator == "" {
+		if low, high, ok := strings.Cut(t.text, ".."); ok {
+			l, err := strconv.ParseInt(low, 10, 64)
+			if err != nil {
+				return p.error(pos, "Invalid Number")
+			}
+			h, err := strconv.ParseInt(high, 10, 64)
+			if err != nil {
+				return p.error(pos+len(low)+2, "Invalid Number")
+			}
+			if l > h {
+				return p.error(pos, "Empty Range")
+			}
+			t.match = MATCH_RANGE
+			t.low, t.high = l, h
+			return nil
+		}
+	}
+	n, err := strconv.ParseInt(t.text, 10, 64)
+	if err != nil {
+		return p.error(pos, "Invalid Number")
+	}
+	t.number = n
+	t.match = MATCH_COMPARE
+	if t.operator == "" {
+		t.operator = "="
+	}
+	return nil
+}
+
+// condition returns the SQL condition matching the column with the term, and the arguments it binds.
+func (t *term) condition(d *Dialect, column string) (string, []any) {
+	switch t.match {
+	case MATCH_WILDCARD:
+		if d.Glob {
+			return column + ` GLOB ?`, []any{wildcardPattern(t.parts, "*", "*?[", func(c rune) string { return "[" + string(c) + "]" })}
+		}
+		return column + ` LIKE ? ESCAPE '\'`, []any{wildcardPattern(t.parts, "%", "%_\\", func(c rune) string { return "\\" + string(c) })}
+	case MATCH_REGEXP:
+		return fmt.Sprintf(d.Regexp, column), []any{t.text}
+	case MATCH_NETWORK:
+		// Addresses are compared by their hex form, in which networks are ranges
+		return column + `_hex >= ? AND ` + column + `_hex <= ?`, []any{t.low, t.high}
+	case MATCH_COMPARE:
+		return column + ` ` + t.operator + ` ?`, []any{t.number}
+	case MATCH_RANGE:
+		return column + ` >= ? AND ` + column + ` <= ?`, []any{t.low, t.high}
+	}
+	return column + ` = ?`, []any{t.text}
+}
+
+// wildcardPattern joins the parts with the wildcard, escaping the special characters within each part.
+func wildcardPattern(parts []string, wildcard, special string, escape func(rune) string) string {
+	var b strings.Builder
+	for i, p := range parts {
+		if i > 0 {
+			b.WriteString(wildcard)
+		}
+		for _, c := range p {
+			if strings.ContainsRune(special, c) {
+				b.WriteString(escape(c))
+			} else {
+				b.WriteRune(c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// consume advances past the prefix, returning true if it is at the current position.
+func (p *expressionParser) consume(prefix string) bool {
+	if strings.HasPrefix(p.expression[p.pos:], prefix) {
+		p.pos += len(prefix)
+		return true
+	}
+	return false
+}
+
+// quoted reads the text between double quotes, keeping escapes other than \" and \\ in regular expressions.
+func (p *expressionParser) quoted(pattern bool) (string, error) {
+	start := p.pos
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.expression) {
+		c := p.expression[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			if p.pos < len(p.expression) && p.expression[p.pos] != '|' {
+				return "", p.error(p.pos, "Expected | After Quoted Value")
+			}
+			return b.String(), nil
+		case c == '\\' && p.pos+1 < len(p.expression):
+			next := p.expression[p.pos+1]
+			if pattern && next != '"' && next != '\\' {
+				b.WriteByte(c)
+			}
+			b.WriteByte(next)
+			p.pos += 2
+			continue
+		}
+		b.WriteByte(c)
+		p.pos++
+	}
+	return "", p.error(start, "Unterminated Quote")
+}
+
+// bare reads the text up to the next unescaped |, split at each unescaped *.
+// Escapes are kept in regular expressions, which have no wildcards.
+func (p *expressionParser) bare(pattern bool) []string {
+	var (
+		parts []string
+		b     strings.Builder
+	)
+	for p.pos < len(p.expression) {
+		c := p.expression[p.pos]
+		switch {
+		case c == '|':
+			return append(parts, b.String())
+		case c == '\\' && p.pos+1 < len(p.expression):
+			if pattern {
+				b.WriteByte(c)
+			}
+			b.WriteByte(p.expression[p.pos+1])
+			p.pos += 2
+			continue
+		case c == '*' && !pattern:
+			parts = append(parts, b.String())
+			b.Reset()
+			p.pos++
+			continue
+		}
+		b.WriteByte(c)
+		p.pos++
+	}
+	return append(parts, b.String())
+}
+
+// AddressHex returns the address as the 32 hex digits of its 16 byte form, so networks are ranges, or "" if it is not an IP.
+// IPv4 addresses take their IPv4-mapped IPv6 form.
+func AddressHex(address string) string {
+	a, err := netip.ParseAddr(address)
+	if err != nil {
+		return ""
+	}
+	b := a.As16()
+	return hex.EncodeToString(b[:])
+}
+
+// networkRange returns the first and last addresses of the network, in the form of AddressHex.
+func networkRange(prefix netip.Prefix) (string, string) {
+	prefix = prefix.Masked()
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+	low := prefix.Addr().As16()
+	high := low
+	for i := bits; i < 128; i++ {
+		high[i/8] |= 0x80 >> (i % 8)
+	}
+	return hex.EncodeToString(low[:]), hex.EncodeToString(high[:])
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb_test
+
+import (
+	"aletheiaware.com/netgo/logdb"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseExpression(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		for _, test := range []struct {
+			kind       logdb.Kind
+			expression string
+		}{
+			{logdb.KIND_TEXT, "GET"},
+			{logdb.KIND_TEXT, "GET|POST"},
+			{logdb.KIND_TEXT, "-/health|-/metrics"},
+			{logdb.KIND_TEXT, "/static/*"},
+			{logdb.KIND_TEXT, "*bot*"},
+			{logdb.KIND_TEXT, `~^/blog/\d+$`},
+			{logdb.KIND_TEXT, `~"a|b"`},
+			{logdb.KIND_TEXT, `"*/*"|text/html`},
+			{logdb.KIND_TEXT, `""`},
+			{logdb.KIND_TEXT, `a\|b`},
+			{logdb.KIND_TEXT, `>1`},
+			{logdb.KIND_ADDRESS, "192.0.2.0/24|2001:db8::/32"},
+			{logdb.KIND_ADDRESS, "-192.0.2.1"},
+			{logdb.KIND_NUMBER, "443"},
+			{logdb.KIND_NUMBER, ">=1024|<100"},
+			{logdb.KIND_NUMBER, "-8000..8999"},
+		} {
+			e, err := logdb.ParseExpression("Field", test.kind, test.expression)
+			assert.Nil(t, err, test.expression)
+			assert.NotNil(t, e, test.expression)
+		}
+		e, err := logdb.ParseExpression("Field", logdb.KIND_TEXT, "")
+		assert.Nil(t, err)
+		assert.Nil(t, e)
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		for _, test := range []struct {
+			kind       logdb.Kind
+			expression string
+			expected   logdb.ExpressionError
+		}{
+			{logdb.KIND_TEXT, "|GET", logdb.ExpressionError{Field: "Field", Column: 1, Reason: "Empty Term"}},
+			{logdb.KIND_TEXT, "GET|", logdb.ExpressionError{Field: "Field", Column: 5, Reason: "Empty Term"}},
+			{logdb.KIND_TEXT, "GET||POST", logdb.ExpressionError{Field: "Field", Column: 5, Reason: "Empty Term"}},
+			{logdb.KIND_TEXT, "GET|-", logdb.ExpressionError{Field: "Field", Column: 6, Reason: "Missing Value"}},
+			{logdb.KIND_TEXT, `"GET`, logdb.ExpressionError{Field: "Field", Column: 1, Reason: "Unterminated Quote"}},
+			{logdb.KIND_TEXT, `"GET"POST`, logdb.ExpressionError{Field: "Field", Column: 6, Reason: "Expected | After Quoted Value"}},
+			{logdb.KIND_TEXT, "GET|~(", logdb.ExpressionError{Field: "Field", Column: 6, Reason: "Invalid Regular Expression"}},
+			{logdb.KIND_ADDRESS, "192.0.2.0/33", logdb.ExpressionError{Field: "Field", Column: 1, Reason: "Invalid Network"}},
+			{logdb.KIND_NUMBER, "80|http", logdb.ExpressionError{Field: "Field", Column: 4, Reason: "Invalid Number"}},
+			{logdb.KIND_NUMBER, ">=", logdb.ExpressionError{Field: "Field", Column: 3, Reason: "Missing Value"}},
+			{logdb.KIND_NUMBER, "100..x", logdb.ExpressionError{Field: "Field", Column: 6, Reason: "Invalid Number"}},
+			{logdb.KIND_NUMBER, "9..1", logdb.ExpressionError{Field: "Field", Column: 1, Reason: "Empty Range"}},
+			{logdb.KIND_NUMBER, "~80", logdb.ExpressionError{Field: "Field", Column: 2, Reason: "Regular Expressions Require a Text Field"}},
+			{logdb.KIND_NUMBER, "80*", logdb.ExpressionError{Field: "Field", Column: 1, Reason: "Wildcards Require a Text Field"}},
+		} {
+			_, err := logdb.ParseExpression("Field", test.kind, test.expression)
+			var actual *logdb.ExpressionError
+			if assert.True(t, errors.As(err, &actual), test.expression) {
+				assert.Equal(t, test.expected, *actual, test.expression)
+			}
+		}
+	})
+	t.Run("Error", func(t *testing.T) {
+		_, err := logdb.ParseExpression("Header Value", logdb.KIND_TEXT, "a||b")
+		assert.Equal(t, "Invalid Header Value Filter at Column 3: Empty Term", err.Error())
+	})
+}
+
+func TestAddressHex(t *testing.T) {
+	assert.Equal(t, "00000000000000000000ffffc0000201", logdb.AddressHex("192.0.2.1"))
+	assert.Equal(t, "20010db8000000000000000000000001", logdb.AddressHex("2001:db8::1"))
+	assert.Equal(t, "", logdb.AddressHex("192.0.2"))
+	assert.Equal(t, "", logdb.AddressHex("a1b2c3"))
+}
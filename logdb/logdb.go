@@ -0,0 +1,222 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package logdb is the database of requests parsed from logs by logparser and served by logserver.
+//
+// SQLite databases use the cgo driver by default; build with -tags purego to use a pure Go driver instead,
+// eg. CGO_ENABLED=0 go build -tags purego ./cmd/logparser
+package logdb
+
+import (
+	"aletheiaware.com/netgo"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Store records the requests parsed from logs, and aggregates them.
+type Store interface {
+	// Version returns the version of the schema, or 0 if no migrations have been applied
+	Version() (int, error)
+	// Migrate brings the schema up to the latest version, returning the number of migrations applied
+	Migrate() (int, error)
+	// Vacuum reclaims the space freed by migrations
+	Vacuum() error
+
+	// File returns the named log, or nil if it has not been recorded
+	File(name string) (*File, error)
+	// ArchiveFiles returns the logs recorded from within the named archive
+	ArchiveFiles(archive string) ([]*File, error)
+	// InodeFiles returns the logs recorded with the inode, most recently recorded first
+	InodeFiles(inode int64) ([]*File, error)
+	// UpdateFile records how far the log has been parsed, and its tag
+	UpdateFile(f *File) error
+	// NewWriter returns a writer of the requests parsed from logs
+	NewWriter() (Writer, error)
+	// Anonymise replaces the addresses of the requests recorded before the given time, returning the number replaced
+	Anonymise(before time.Time, anonymise func(address string, t time.Time) string) (int, error)
+
+	// Exclusions returns the built in exclusions, followed by those stored by name
+	Exclusions() ([]*Exclusion, error)
+	// SaveExclusion stores the exclusion, replacing any with the same name, or returns an *ExpressionError if an expression is invalid
+	SaveExclusion(e *Exclusion) error
+	// DeleteExclusion removes the named exclusion, returning whether it was stored
+	DeleteExclusion(name string) (bool, error)
+
+	// Requests returns the requests matching the filter in time order, or an *ExpressionError if the filter is invalid
+	Requests(f *Filter) ([]*netgo.RequestRecord, error)
+	// ScanRequests calls fn with each request matching the filter within the page, in order, as it is read from the database
+	ScanRequests(f *Filter, p *Page, fn func(Cursor, *netgo.RequestRecord) error) error
+	// Summarise returns the number and time span of the requests matching the filter
+	Summarise(f *Filter) (*Summary, error)
+	// Sessions returns the sessions of requests matching the filter, newest first, split by address and optionally user agent, and by inactivity longer than the gap.
+	// Only the latest sessions are returned if there are more than the limit, unless it is 0.
+	Sessions(f *Filter, gap time.Duration, byAgent bool, limit int) ([]*Session, error)
+	// TimeSeries returns the number of requests matching the filter in each interval of the location's time that has any, in time order, optionally split by one of SPLITS
+	TimeSeries(f *Filter, interval Interval, location *time.Location, split string) ([]*Bucket, error)
+	// Addresses returns up to limit addresses of the requests matching the filter, most requested first
+	Addresses(f *Filter, limit int) ([]*Count, error)
+	// Protocols returns up to limit protocols of the requests matching the filter, most requested first
+	Protocols(f *Filter, limit int) ([]*Count, error)
+	// Methods returns up to limit methods of the requests matching the filter, most requested first
+	Methods(f *Filter, limit int) ([]*Count, error)
+	// URLs returns up to limit URLs of the requests matching the filter, most requested first
+	URLs(f *Filter, limit int) ([]*Count, error)
+	// HeaderKeys returns up to limit keys of the headers of requests matching the filter, most common first
+	HeaderKeys(f *Filter, limit int) ([]*Count, error)
+	// HeaderValues returns up to limit values of the headers of requests matching the filter, most common first
+	HeaderValues(f *Filter, limit int) ([]*Count, error)
+
+	Close() error
+}
+
+// Writer inserts the requests parsed from logs in transactions, each committed together with how far the logs have been parsed.
+type Writer interface {
+	// Begin starts a transaction
+	Begin() error
+	// AddFile records a log not seen before, setting its ID
+	AddFile(f *File) error
+	// UpdateFile records how far the log has been parsed, and its tag
+	UpdateFile(f *File) error
+	// AddRequest records a request parsed from the log with the given ID
+	AddRequest(file int64, r *netgo.RequestRecord) error
+	// Commit commits the transaction
+	Commit() error
+	// Rollback aborts the transaction, and is a no-op once committed
+	Rollback() error
+	Close() error
+}
+
+// File is a log recorded in the database.
+type File struct {
+	ID   int64
+	Name string
+	// Offset parsed up to, or -1 if parsed completely before offsets were recorded
+	Offset int64
+	// Number of lines before the offset
+	Lines int64
+	Inode int64
+	// Tag given to the log, such as the host it was copied from
+	Tag string
+}
+
+// Count is the number of requests or headers with a value.
+type Count struct {
+	Value string
+	Count int
+}
+
+// Filter selects requests by their fields and headers.
+// Each field is an Expression, such as GET|POST or -/health, and is ignored if empty.
+type Filter struct {
+	// Unix times of the first and last requests, or 0 for no limit
+	Start, End  int64
+	Address     string
+	Port        string
+	Protocol    string
+	Method      string
+	URL         string
+	HeaderKey   string
+	HeaderValue string
+	// Tag of the log the request was parsed from
+	Tag string
+	// Exclusions of requests that are not matched
+	Exclude []*Exclusion
+}
+
+// Page selects a page of requests in time order, or of all requests if nil.
+type Page struct {
+	// Cursor of the last request of the previous page, or nil for the first page
+	After *Cursor
+	// Maximum number of requests, or 0 for no limit
+	Limit int
+	// Whether the latest requests are first
+	Descending bool
+}
+
+// Cursor is the position of a request in time order, with requests at the same time ordered by ID.
+type Cursor struct {
+	Timestamp, ID int64
+}
+
+func (c Cursor) String() string {
+	return fmt.Sprintf("%d.%d", c.Timestamp, c.ID)
+}
+
+// ParseCursor parses a cursor formatted by Cursor.String.
+func ParseCursor(s string) (*Cursor, error) {
+	timestamp, id, ok := strings.Cut(s, ".")
+	if ok {
+		t, terr := strconv.ParseInt(timestamp, 10, 64)
+		i, ierr := strconv.ParseInt(id, 10, 64)
+		if terr == nil && ierr == nil {
+			return &Cursor{t, i}, nil
+		}
+	}
+	return nil, fmt.Errorf("Invalid Cursor: %s", s)
+}
+
+// Summary is the number of requests, and the Unix times of the first and last, or 0 if there are none.
+type Summary struct {
+	Count      int
+	Start, End int64
+}
+
+// Open opens the database with the given data source name, migrating it to the latest version.
+func Open(dsn string) (Store, error) {
+	dialect, name, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	s, err := OpenSQL(dialect, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.Migrate(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// OpenLatest opens the database with the given data source name without migrating it, returning an error unless it is at the latest version.
+// Readers use it so that only the writer changes the schema.
+func OpenLatest(dsn string) (Store, error) {
+	dialect, name, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	s, err := OpenSQL(dialect, name)
+	if err != nil {
+		return nil, err
+	}
+	// Read without creating the migrations table, so the schema is left as it is
+	var version int
+	if err := s.db.QueryRow(SELECT_VERSION_QUERY).Scan(&version); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("Unversioned Database (run logparser migrate): %w", err)
+	}
+	switch latest := dialect.LatestVersion(); {
+	case version < latest:
+		s.Close()
+		return nil, fmt.Errorf("Database Version %d is Older than Supported Version %d (run logparser migrate)", version, latest)
+	case version > latest:
+		s.Close()
+		return nil, fmt.Errorf("Database Version %d is Newer than Supported Version %d", version, latest)
+	}
+	return s, nil
+}
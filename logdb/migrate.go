@@ -0,0 +1,165 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	CREATE_MIGRATIONS_QUERY = `CREATE TABLE IF NOT EXISTS tbl_migrations (
+    version INTEGER NOT NULL PRIMARY KEY,
+    description TEXT NOT NULL,
+    timestamp BIGINT NOT NULL
+);`
+	SELECT_VERSION_QUERY   = `SELECT COALESCE(MAX(version), 0) FROM tbl_migrations;`
+	INSERT_MIGRATION_QUERY = `INSERT INTO tbl_migrations
+(version, description, timestamp)
+VALUES
+(?, ?, ?);`
+)
+
+// LOCK_MIGRATIONS_QUERY stops other migrations until the transaction ends.
+// Deleting nothing takes the write lock of a SQLite transaction, which would otherwise wait until its first change.
+const LOCK_MIGRATIONS_QUERY = `DELETE FROM tbl_migrations WHERE version < 0;`
+
+// Migration changes the schema from the previous version.
+// Migrations must be safe to apply to databases created before versions were recorded.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(*sql.Tx) error
+}
+
+// Version returns the version of the database, or 0 if no migrations have been applied.
+func (s *SQLStore) Version() (int, error) {
+	if _, err := s.db.Exec(CREATE_MIGRATIONS_QUERY); err != nil {
+		return 0, err
+	}
+	var version int
+	if err := s.db.QueryRow(SELECT_VERSION_QUERY).Scan(&version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Migrate applies the migrations after the database's version, each in its own transaction, and returns the number applied.
+// The version is read again once each transaction holds the lock on the migrations, so concurrent callers never apply a migration twice.
+func (s *SQLStore) Migrate() (int, error) {
+	version, err := s.Version()
+	if err != nil {
+		return 0, err
+	}
+	if latest := s.dialect.LatestVersion(); version > latest {
+		return 0, fmt.Errorf("Database Version %d is Newer than Supported Version %d", version, latest)
+	}
+	var count int
+	for _, m := range s.dialect.Migrations {
+		if m.Version <= version {
+			continue
+		}
+		applied, err := s.migrate(m)
+		if err != nil {
+			return count, fmt.Errorf("Migration %d Failed: %w", m.Version, err)
+		}
+		if applied {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// migrate applies the migration unless another caller already has, and returns whether it was applied.
+func (s *SQLStore) migrate(m *Migration) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		// No-op once committed
+		tx.Rollback()
+	}()
+	if _, err := tx.Exec(s.dialect.Query(LOCK_MIGRATIONS_QUERY)); err != nil {
+		return false, err
+	}
+	var version int
+	if err := tx.QueryRow(SELECT_VERSION_QUERY).Scan(&version); err != nil {
+		return false, err
+	}
+	if version >= m.Version {
+		return false, nil
+	}
+	if err := m.Up(tx); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(s.dialect.Rebind(INSERT_MIGRATION_QUERY), m.Version, m.Description, time.Now().Unix()); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// Vacuum rebuilds the database, reclaiming the space freed by migrations.
+func (s *SQLStore) Vacuum() error {
+	_, err := s.db.Exec(`VACUUM;`)
+	return err
+}
+
+// fillAddressHex records the hex form of the addresses of requests recorded before it was, using the update query of the dialect.
+func fillAddressHex(tx *sql.Tx, update string) error {
+	rows, err := tx.Query(`SELECT DISTINCT address FROM tbl_requests WHERE address IS NOT NULL;`)
+	if err != nil {
+		return err
+	}
+	var addresses []string
+	for rows.Next() {
+		var address string
+		if err := rows.Scan(&address); err != nil {
+			rows.Close()
+			return err
+		}
+		addresses = append(addresses, address)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	stmt, err := tx.Prepare(update)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, a := range addresses {
+		if h := AddressHex(a); h != "" {
+			if _, err := stmt.Exec(h, a); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func execAll(tx *sql.Tx, queries ...string) error {
+	for _, q := range queries {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
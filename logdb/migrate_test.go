@@ -0,0 +1,186 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb_test
+
+import (
+	"aletheiaware.com/netgo/logdb"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	t.Run("New", func(t *testing.T) {
+		store, err := logdb.Open(filepath.Join(t.TempDir(), "log.db"))
+		assert.Nil(t, err)
+		defer store.Close()
+		db := store.(*logdb.SQLStore).DB()
+
+		version, err := store.Version()
+		assert.Nil(t, err)
+		assert.Equal(t, logdb.SQLite.LatestVersion(), version)
+
+		for _, index := range []string{"idx_requests_timestamp", "idx_requests_address", "idx_requests_url", "idx_headers_request_key"} {
+			var name string
+			assert.Nil(t, db.QueryRow(`SELECT name FROM sqlite_master WHERE type = 'index' AND name = ?;`, index).Scan(&name), index)
+		}
+
+		// Nothing left to apply
+		count, err := store.Migrate()
+		assert.Nil(t, err)
+		assert.Equal(t, 0, count)
+	})
+	t.Run("Unversioned", func(t *testing.T) {
+		// Database created before versions were recorded, with some columns already added
+		store, err := logdb.OpenSQL(logdb.SQLite, filepath.Join(t.TempDir(), "log.db"))
+		assert.Nil(t, err)
+		defer store.Close()
+		db := store.DB()
+		for _, q := range []string{
+			`CREATE TABLE tbl_files (id INTEGER NOT NULL PRIMARY KEY, name TEXT NOT NULL UNIQUE, byte_offset INT NOT NULL DEFAULT -1);`,
+			`INSERT INTO tbl_files (name) VALUES ('a');`,
+			`CREATE TABLE tbl_requests (id INTEGER NOT NULL PRIMARY KEY, file INT NULL, timestamp INT UNSIGNED NOT NULL, source TEXT, address TEXT, protocol TEXT, method TEXT, host TEXT, url TEXT);`,
+			`CREATE TABLE tbl_headers (id INTEGER NOT NULL PRIMARY KEY, request INT NULL, key TEXT, value TEXT);`,
+			`INSERT INTO tbl_requests (file, timestamp, address) VALUES (1, 1, '192.0.2.1'), (1, 2, 'anonymised');`,
+			`INSERT INTO tbl_headers (request, key, value) VALUES (1, 'Accept', '*/*'), (1, 'User-Agent', 'curl'), (2, 'User-Agent', 'curl'), (2, 'Accept', 'text/html'), (2, NULL, 'orphan'), (2, 'Referer', NULL);`,
+		} {
+			_, err := db.Exec(q)
+			assert.Nil(t, err)
+		}
+
+		count, err := store.Migrate()
+		assert.Nil(t, err)
+		assert.Equal(t, len(logdb.SQLiteMigrations), count)
+
+		var (
+			offset, lines int64
+			tag           string
+		)
+		assert.Nil(t, db.QueryRow(`SELECT byte_offset, line_count, tag FROM tbl_files WHERE name = 'a';`).Scan(&offset, &lines, &tag))
+		assert.Equal(t, int64(-1), offset)
+		assert.Equal(t, int64(0), lines)
+		assert.Equal(t, "", tag)
+
+		// Addresses are recorded in hex, if they are IPs
+		var hexes []string
+		hexRows, err := db.Query(`SELECT address_hex FROM tbl_requests ORDER BY id;`)
+		assert.Nil(t, err)
+		defer hexRows.Close()
+		for hexRows.Next() {
+			var h string
+			assert.Nil(t, hexRows.Scan(&h))
+			hexes = append(hexes, h)
+		}
+		assert.Equal(t, []string{"00000000000000000000ffffc0000201", ""}, hexes)
+
+		// Headers are unchanged, except missing keys and values are empty, but each key and value is only stored once
+		rows, err := db.Query(`SELECT tbl_headers.request, tbl_header_keys.key, tbl_header_values.value FROM tbl_headers INNER JOIN tbl_header_keys ON tbl_header_keys.id = tbl_headers.key_id INNER JOIN tbl_header_values ON tbl_header_values.id = tbl_headers.value_id ORDER BY tbl_headers.id;`)
+		assert.Nil(t, err)
+		defer rows.Close()
+		var headers []string
+		for rows.Next() {
+			var (
+				request    int
+				key, value string
+			)
+			assert.Nil(t, rows.Scan(&request, &key, &value))
+			headers = append(headers, fmt.Sprintf("%d %s: %s", request, key, value))
+		}
+		assert.Nil(t, rows.Err())
+		assert.Equal(t, []string{"1 Accept: */*", "1 User-Agent: curl", "2 User-Agent: curl", "2 Accept: text/html", "2 : orphan", "2 Referer: "}, headers)
+		var keys, values int
+		assert.Nil(t, db.QueryRow(`SELECT COUNT(*) FROM tbl_header_keys;`).Scan(&keys))
+		assert.Nil(t, db.QueryRow(`SELECT COUNT(*) FROM tbl_header_values;`).Scan(&values))
+		assert.Equal(t, 4, keys)
+		assert.Equal(t, 5, values)
+	})
+	t.Run("Newer", func(t *testing.T) {
+		store, err := logdb.Open(filepath.Join(t.TempDir(), "log.db"))
+		assert.Nil(t, err)
+		defer store.Close()
+		_, err = store.(*logdb.SQLStore).DB().Exec(`INSERT INTO tbl_migrations (version, description, timestamp) VALUES (?, 'Future', 0);`, logdb.SQLite.LatestVersion()+1)
+		assert.Nil(t, err)
+
+		_, err = store.Migrate()
+		assert.NotNil(t, err)
+	})
+	t.Run("Concurrent", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "log.db")
+		counts := make(chan int, 4)
+		var wg sync.WaitGroup
+		for range cap(counts) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				store, err := logdb.OpenSQL(logdb.SQLite, path)
+				assert.Nil(t, err)
+				defer store.Close()
+				count, err := store.Migrate()
+				assert.Nil(t, err)
+				counts <- count
+			}()
+		}
+		wg.Wait()
+		close(counts)
+
+		// Each migration is applied once
+		var total int
+		for c := range counts {
+			total += c
+		}
+		assert.Equal(t, len(logdb.SQLiteMigrations), total)
+	})
+}
+
+func TestOpenLatest(t *testing.T) {
+	t.Run("Latest", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "log.db")
+		store, err := logdb.Open(path)
+		assert.Nil(t, err)
+		assert.Nil(t, store.Close())
+
+		store, err = logdb.OpenLatest(path)
+		assert.Nil(t, err)
+		assert.Nil(t, store.Close())
+	})
+	t.Run("Unversioned", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "log.db")
+		_, err := logdb.OpenLatest(path)
+		assert.ErrorContains(t, err, "run logparser migrate")
+
+		// Schema is unchanged
+		store, err := logdb.OpenSQL(logdb.SQLite, path)
+		assert.Nil(t, err)
+		defer store.Close()
+		var count int
+		assert.Nil(t, store.DB().QueryRow(`SELECT COUNT(*) FROM sqlite_master;`).Scan(&count))
+		assert.Equal(t, 0, count)
+	})
+	t.Run("Older", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "log.db")
+		store, err := logdb.Open(path)
+		assert.Nil(t, err)
+		_, err = store.(*logdb.SQLStore).DB().Exec(`DELETE FROM tbl_migrations WHERE version = ?;`, logdb.SQLite.LatestVersion())
+		assert.Nil(t, err)
+		assert.Nil(t, store.Close())
+
+		_, err = logdb.OpenLatest(path)
+		assert.ErrorContains(t, err, "run logparser migrate")
+	})
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb
+
+import (
+	"database/sql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// Postgres stores the database on a PostgreSQL server, which can be shared by several hosts.
+var Postgres = &Dialect{
+	Name:     "postgres",
+	Driver:   "pgx",
+	Numbered: true,
+	Regexp:   `%s ~ ?`,
+	Migrations: []*Migration{
+		{
+			Version:     1,
+			Description: "Create files, requests, and headers",
+			Up: func(tx *sql.Tx) error {
+				return execAll(tx,
+					POSTGRES_CREATE_FILES_QUERY,
+					POSTGRES_CREATE_REQUESTS_QUERY,
+					POSTGRES_CREATE_HEADER_KEYS_QUERY,
+					POSTGRES_CREATE_HEADER_VALUES_QUERY,
+					POSTGRES_CREATE_HEADER_VALUES_INDEX_QUERY,
+					POSTGRES_CREATE_HEADERS_QUERY,
+					CREATE_REQUESTS_TIMESTAMP_INDEX_QUERY,
+					CREATE_REQUESTS_ADDRESS_INDEX_QUERY,
+					CREATE_REQUESTS_URL_INDEX_QUERY,
+					CREATE_HEADERS_REQUEST_KEY_ID_INDEX_QUERY,
+					CREATE_HEADERS_KEY_VALUE_INDEX_QUERY,
+				)
+			},
+		},
+		{
+			Version:     2,
+			Description: "Record port, and address in hex so networks can be matched, of requests",
+			Up: func(tx *sql.Tx) error {
+				if err := execAll(tx, POSTGRES_ADD_REQUESTS_PORT_QUERY, POSTGRES_ADD_REQUESTS_ADDRESS_HEX_QUERY); err != nil {
+					return err
+				}
+				if err := fillAddressHex(tx, POSTGRES_UPDATE_ADDRESS_HEX_QUERY); err != nil {
+					return err
+				}
+				return execAll(tx, CREATE_REQUESTS_ADDRESS_HEX_INDEX_QUERY)
+			},
+		},
+		{
+			Version:     3,
+			Description: "Store named exclusions of requests",
+			Up: func(tx *sql.Tx) error {
+				return execAll(tx, CREATE_EXCLUSIONS_QUERY)
+			},
+		},
+	},
+	Queries: map[string]string{
+		// Values are unique by hash, as long values exceed the size of a btree index entry
+		INSERT_HEADER_VALUE_QUERY: `INSERT INTO tbl_header_values (value) VALUES ($1) ON CONFLICT ((md5(value))) DO NOTHING;`,
+		SELECT_HEADER_VALUE_QUERY: `SELECT id FROM tbl_header_values WHERE md5(value) = md5($1) AND value = $1;`,
+		// Deleting nothing locks no rows, so the table is locked instead
+		LOCK_MIGRATIONS_QUERY: `LOCK TABLE tbl_migrations IN EXCLUSIVE MODE;`,
+	},
+}
+
+const (
+	POSTGRES_CREATE_FILES_QUERY = `CREATE TABLE IF NOT EXISTS tbl_files (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    byte_offset BIGINT NOT NULL DEFAULT 0,
+    line_count BIGINT NOT NULL DEFAULT 0,
+    inode BIGINT NOT NULL DEFAULT 0,
+    tag TEXT NOT NULL DEFAULT ''
+);`
+	POSTGRES_CREATE_REQUESTS_QUERY = `CREATE TABLE IF NOT EXISTS tbl_requests (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    file BIGINT NULL REFERENCES tbl_files(id),
+    timestamp BIGINT NOT NULL,
+    source TEXT,
+    address TEXT,
+    protocol TEXT,
+    method TEXT,
+    host TEXT,
+    url TEXT
+);`
+	POSTGRES_CREATE_HEADER_KEYS_QUERY = `CREATE TABLE IF NOT EXISTS tbl_header_keys (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    key TEXT NOT NULL UNIQUE
+);`
+	POSTGRES_CREATE_HEADER_VALUES_QUERY = `CREATE TABLE IF NOT EXISTS tbl_header_values (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    value TEXT NOT NULL
+);`
+	POSTGRES_CREATE_HEADER_VALUES_INDEX_QUERY = `CREATE UNIQUE INDEX IF NOT EXISTS idx_header_values_md5 ON tbl_header_values ((md5(value)));`
+	POSTGRES_ADD_REQUESTS_PORT_QUERY          = `ALTER TABLE tbl_requests ADD COLUMN IF NOT EXISTS port INTEGER NOT NULL DEFAULT 0;`
+	POSTGRES_ADD_REQUESTS_ADDRESS_HEX_QUERY   = `ALTER TABLE tbl_requests ADD COLUMN IF NOT EXISTS address_hex TEXT NOT NULL DEFAULT '';`
+	POSTGRES_UPDATE_ADDRESS_HEX_QUERY         = `UPDATE tbl_requests SET address_hex = $1 WHERE address = $2;`
+	POSTGRES_CREATE_HEADERS_QUERY             = `CREATE TABLE IF NOT EXISTS tbl_headers (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    request BIGINT NULL REFERENCES tbl_requests(id),
+    key_id BIGINT NOT NULL REFERENCES tbl_header_keys(id),
+    value_id BIGINT NOT NULL REFERENCES tbl_header_values(id)
+);`
+)
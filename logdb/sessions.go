@@ -0,0 +1,187 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb
+
+import (
+	"cmp"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// SELECT_SESSION_REQUESTS_QUERY selects each request with its headers whose keys are given as parameters, in a row for each header, or a single row if it has none
+	SELECT_SESSION_REQUESTS_QUERY = `SELECT tbl_requests.id, tbl_requests.address, tbl_requests.timestamp, tbl_requests.url, COALESCE(k.key, ''), COALESCE(v.value, '') FROM tbl_requests LEFT JOIN tbl_headers h ON h.request = tbl_requests.id AND h.key_id IN (SELECT tbl_header_keys.id FROM tbl_header_keys WHERE tbl_header_keys.key IN (?, ?)) LEFT JOIN tbl_header_keys k ON k.id = h.key_id LEFT JOIN tbl_header_values v ON v.id = h.value_id`
+)
+
+// assetExtensions are the extensions of URLs of assets loaded by pages, such as styles, scripts, images, and fonts, whose requests are not counted as pages.
+var assetExtensions = map[string]bool{
+	".avif":  true,
+	".bmp":   true,
+	".css":   true,
+	".eot":   true,
+	".gif":   true,
+	".ico":   true,
+	".jpeg":  true,
+	".jpg":   true,
+	".js":    true,
+	".map":   true,
+	".mjs":   true,
+	".mp3":   true,
+	".mp4":   true,
+	".otf":   true,
+	".png":   true,
+	".svg":   true,
+	".ttf":   true,
+	".wasm":  true,
+	".webm":  true,
+	".webp":  true,
+	".woff":  true,
+	".woff2": true,
+}
+
+// Session is a sequence of requests from a visitor, each within an inactivity gap of the last.
+type Session struct {
+	Address string
+	// User agent of the first request, which is the same for every request if sessions are split by user agent
+	UserAgent string
+	// Unix times of the first and last requests
+	Start, End int64
+	// Number of requests, including those of assets
+	Requests int
+	// Number of requests of pages, excluding those of assets
+	Pages int
+	// URLs of the first and last requests
+	Entry, Exit string
+	// Referrer of the first request
+	Referrer string
+}
+
+// sessionRequest is a request read for sessions, with the first value of each of its headers that were selected.
+type sessionRequest struct {
+	id, timestamp int64
+	address, url  string
+	headers       map[string]string
+}
+
+func (s *SQLStore) Sessions(f *Filter, gap time.Duration, byAgent bool, limit int) ([]*Session, error) {
+	raw := SELECT_SESSION_REQUESTS_QUERY
+	filters, args, err := requestFilters(s.dialect, f)
+	if err != nil {
+		return nil, err
+	}
+	// Requests are read newest first, so reading stops once the latest sessions have started, and headers in the order they were recorded
+	raw += filters + ` ORDER BY tbl_requests.timestamp DESC, tbl_requests.id DESC, h.id`
+	rows, err := s.db.Query(s.dialect.Rebind(raw), append([]any{"User-Agent", "Referer"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		sessions []*Session
+		// Earliest session of each visitor
+		earliest = make(map[string]*Session)
+		// Unix time of the first request of any session, which is the earliest as requests are read newest first
+		start int64
+	)
+	// add adds the request to the start of its visitor's earliest session, or starts another, returning false once every session has started
+	add := func(r *sessionRequest) bool {
+		agent := r.headers["User-Agent"]
+		full := limit > 0 && len(sessions) >= limit
+		if full && time.Duration(start-r.timestamp)*time.Second > gap {
+			// Every session has started, and any earlier request would end another
+			return false
+		}
+		visitor := r.address
+		if byAgent {
+			visitor += "\x00" + agent
+		}
+		current, ok := earliest[visitor]
+		if !ok || time.Duration(current.Start-r.timestamp)*time.Second > gap {
+			if full {
+				return true
+			}
+			current = &Session{
+				Address: r.address,
+				End:     r.timestamp,
+				Exit:    r.url,
+			}
+			sessions = append(sessions, current)
+			earliest[visitor] = current
+		}
+		current.UserAgent = agent
+		current.Start = r.timestamp
+		current.Entry = r.url
+		current.Referrer = r.headers["Referer"]
+		current.Requests++
+		if !isAsset(r.url) {
+			current.Pages++
+		}
+		start = r.timestamp
+		return true
+	}
+	var request *sessionRequest
+	for rows.Next() {
+		var (
+			id, timestamp                int64
+			address, pageURL, key, value string
+		)
+		if err := rows.Scan(&id, &address, &timestamp, &pageURL, &key, &value); err != nil {
+			return nil, err
+		}
+		if request == nil || id != request.id {
+			if request != nil && !add(request) {
+				request = nil
+				break
+			}
+			request = &sessionRequest{
+				id:        id,
+				timestamp: timestamp,
+				address:   address,
+				url:       pageURL,
+				headers:   make(map[string]string),
+			}
+		}
+		// Rows are repeated if joined with more than one header matching the filter, so only the first value of each header is kept
+		if _, ok := request.headers[key]; !ok && key != "" {
+			request.headers[key] = value
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if request != nil {
+		add(request)
+	}
+	slices.SortStableFunc(sessions, func(a, b *Session) int {
+		// Newest first
+		if c := cmp.Compare(b.Start, a.Start); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Address, b.Address)
+	})
+	return sessions, nil
+}
+
+// isAsset returns true if the URL is of an asset loaded by a page, rather than of a page.
+func isAsset(u string) bool {
+	p, _, _ := strings.Cut(u, "?")
+	p, _, _ = strings.Cut(p, "#")
+	return assetExtensions[strings.ToLower(path.Ext(p))]
+}
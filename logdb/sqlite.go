@@ -0,0 +1,235 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// SQLite is the default dialect, storing the database in a single file.
+var SQLite = &Dialect{
+	Name:       "sqlite",
+	Driver:     SQLITE_DRIVER,
+	Migrations: SQLiteMigrations,
+	// Matched by the regexp function registered with the driver
+	Regexp: `%s REGEXP ?`,
+	Glob:   true,
+}
+
+const (
+	// Exclusions are created the same way by every dialect
+	CREATE_EXCLUSIONS_QUERY = `CREATE TABLE IF NOT EXISTS tbl_exclusions (
+    name TEXT NOT NULL PRIMARY KEY,
+    address TEXT NOT NULL DEFAULT '',
+    url TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT ''
+);`
+	CREATE_FILES_QUERY = `CREATE TABLE IF NOT EXISTS tbl_files (
+    id INTEGER NOT NULL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE
+);`
+	CREATE_REQUESTS_QUERY = `CREATE TABLE IF NOT EXISTS tbl_requests (
+    id INTEGER NOT NULL PRIMARY KEY,
+    file INT NULL,
+    timestamp INT UNSIGNED NOT NULL,
+    source TEXT,
+    address TEXT,
+    protocol TEXT,
+    method TEXT,
+    host TEXT,
+    url TEXT,
+    FOREIGN KEY (file) REFERENCES tbl_files(id)
+);`
+	CREATE_HEADERS_QUERY = `CREATE TABLE IF NOT EXISTS tbl_headers (
+	id INTEGER NOT NULL PRIMARY KEY,
+	request INT NULL,
+	key TEXT,
+	value TEXT,
+	FOREIGN KEY (request) REFERENCES tbl_requests(id)
+);`
+	CREATE_HEADER_KEYS_QUERY = `CREATE TABLE IF NOT EXISTS tbl_header_keys (
+    id INTEGER NOT NULL PRIMARY KEY,
+    key TEXT NOT NULL UNIQUE
+);`
+	CREATE_HEADER_VALUES_QUERY = `CREATE TABLE IF NOT EXISTS tbl_header_values (
+    id INTEGER NOT NULL PRIMARY KEY,
+    value TEXT NOT NULL UNIQUE
+);`
+	// Headers refer to their key and value in the dictionary tables, rather than repeating the text for every request.
+	// Missing keys and values are recorded as empty text, so every header is kept.
+	CREATE_NORMALISED_HEADERS_QUERY = `CREATE TABLE tbl_headers_normalised (
+    id INTEGER NOT NULL PRIMARY KEY,
+    request INT NULL,
+    key_id INT NOT NULL,
+    value_id INT NOT NULL,
+    FOREIGN KEY (request) REFERENCES tbl_requests(id),
+    FOREIGN KEY (key_id) REFERENCES tbl_header_keys(id),
+    FOREIGN KEY (value_id) REFERENCES tbl_header_values(id)
+);`
+	INSERT_HEADER_KEYS_FROM_HEADERS_QUERY   = `INSERT OR IGNORE INTO tbl_header_keys (key) SELECT DISTINCT COALESCE(key, '') FROM tbl_headers;`
+	INSERT_HEADER_VALUES_FROM_HEADERS_QUERY = `INSERT OR IGNORE INTO tbl_header_values (value) SELECT DISTINCT COALESCE(value, '') FROM tbl_headers;`
+	INSERT_NORMALISED_HEADERS_QUERY         = `INSERT INTO tbl_headers_normalised
+(id, request, key_id, value_id)
+SELECT tbl_headers.id, tbl_headers.request, tbl_header_keys.id, tbl_header_values.id FROM tbl_headers
+INNER JOIN tbl_header_keys ON tbl_header_keys.key = COALESCE(tbl_headers.key, '')
+INNER JOIN tbl_header_values ON tbl_header_values.value = COALESCE(tbl_headers.value, '');`
+	DROP_HEADERS_REQUEST_INDEX_QUERY        = `DROP INDEX IF EXISTS idx_headers_request_key;`
+	DROP_HEADERS_QUERY                      = `DROP TABLE tbl_headers;`
+	RENAME_NORMALISED_HEADERS_QUERY         = `ALTER TABLE tbl_headers_normalised RENAME TO tbl_headers;`
+	CREATE_REQUESTS_TIMESTAMP_INDEX_QUERY   = `CREATE INDEX IF NOT EXISTS idx_requests_timestamp ON tbl_requests (timestamp);`
+	CREATE_REQUESTS_ADDRESS_INDEX_QUERY     = `CREATE INDEX IF NOT EXISTS idx_requests_address ON tbl_requests (address);`
+	CREATE_REQUESTS_URL_INDEX_QUERY         = `CREATE INDEX IF NOT EXISTS idx_requests_url ON tbl_requests (url);`
+	CREATE_HEADERS_REQUEST_INDEX_QUERY      = `CREATE INDEX IF NOT EXISTS idx_headers_request_key ON tbl_headers (request, key);`
+	CREATE_REQUESTS_ADDRESS_HEX_INDEX_QUERY = `CREATE INDEX IF NOT EXISTS idx_requests_address_hex ON tbl_requests (address_hex);`
+	UPDATE_ADDRESS_HEX_QUERY                = `UPDATE tbl_requests SET address_hex = ? WHERE address = ?;`
+	// Indexes of normalised headers
+	CREATE_HEADERS_REQUEST_KEY_ID_INDEX_QUERY = `CREATE INDEX IF NOT EXISTS idx_headers_request_key ON tbl_headers (request, key_id);`
+	CREATE_HEADERS_KEY_VALUE_INDEX_QUERY      = `CREATE INDEX IF NOT EXISTS idx_headers_key_value ON tbl_headers (key_id, value_id);`
+)
+
+// SQLiteMigrations bring a SQLite database up to the latest version, including those created before versions were recorded.
+var SQLiteMigrations = []*Migration{
+	{
+		Version:     1,
+		Description: "Create files, requests, and headers",
+		Up: func(tx *sql.Tx) error {
+			return execAll(tx, CREATE_FILES_QUERY, CREATE_REQUESTS_QUERY, CREATE_HEADERS_QUERY)
+		},
+	},
+	{
+		Version:     2,
+		Description: "Record offset, line count, inode, and tag of files",
+		Up: func(tx *sql.Tx) error {
+			// Files parsed before offsets were recorded are marked with -1, and considered complete
+			if err := addColumn(tx, "tbl_files", "byte_offset", "INT NOT NULL DEFAULT -1"); err != nil {
+				return err
+			}
+			if err := addColumn(tx, "tbl_files", "line_count", "INT NOT NULL DEFAULT 0"); err != nil {
+				return err
+			}
+			if err := addColumn(tx, "tbl_files", "inode", "INT NOT NULL DEFAULT 0"); err != nil {
+				return err
+			}
+			return addColumn(tx, "tbl_files", "tag", "TEXT NOT NULL DEFAULT ''")
+		},
+	},
+	{
+		Version:     3,
+		Description: "Index requests by timestamp, address, and url, and headers by request and key",
+		Up: func(tx *sql.Tx) error {
+			return execAll(tx, CREATE_REQUESTS_TIMESTAMP_INDEX_QUERY, CREATE_REQUESTS_ADDRESS_INDEX_QUERY, CREATE_REQUESTS_URL_INDEX_QUERY, CREATE_HEADERS_REQUEST_INDEX_QUERY)
+		},
+	},
+	{
+		Version:     4,
+		Description: "Store header keys and values once, in dictionary tables",
+		Up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				CREATE_HEADER_KEYS_QUERY,
+				CREATE_HEADER_VALUES_QUERY,
+				INSERT_HEADER_KEYS_FROM_HEADERS_QUERY,
+				INSERT_HEADER_VALUES_FROM_HEADERS_QUERY,
+				CREATE_NORMALISED_HEADERS_QUERY,
+				INSERT_NORMALISED_HEADERS_QUERY,
+				DROP_HEADERS_REQUEST_INDEX_QUERY,
+				DROP_HEADERS_QUERY,
+				RENAME_NORMALISED_HEADERS_QUERY,
+				CREATE_HEADERS_REQUEST_KEY_ID_INDEX_QUERY,
+				CREATE_HEADERS_KEY_VALUE_INDEX_QUERY,
+			)
+		},
+	},
+	{
+		Version:     5,
+		Description: "Record port, and address in hex so networks can be matched, of requests",
+		Up: func(tx *sql.Tx) error {
+			if err := addColumn(tx, "tbl_requests", "port", "INT NOT NULL DEFAULT 0"); err != nil {
+				return err
+			}
+			if err := addColumn(tx, "tbl_requests", "address_hex", "TEXT NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+			if err := fillAddressHex(tx, UPDATE_ADDRESS_HEX_QUERY); err != nil {
+				return err
+			}
+			return execAll(tx, CREATE_REQUESTS_ADDRESS_HEX_INDEX_QUERY)
+		},
+	},
+	{
+		Version:     6,
+		Description: "Store named exclusions of requests",
+		Up: func(tx *sql.Tx) error {
+			return execAll(tx, CREATE_EXCLUSIONS_QUERY)
+		},
+	},
+}
+
+// MAX_CACHED_REGEXPS limits the number of regular expressions remembered by matchRegexp.
+const MAX_CACHED_REGEXPS = 100
+
+var (
+	regexpsLock sync.Mutex
+	regexps     = make(map[string]*regexp.Regexp)
+)
+
+// matchRegexp implements the regexp function called by REGEXP, returning true if the value matches the pattern.
+// Patterns are compiled once, rather than for every row.
+func matchRegexp(pattern, value string) (bool, error) {
+	regexpsLock.Lock()
+	r, ok := regexps[pattern]
+	regexpsLock.Unlock()
+	if !ok {
+		var err error
+		if r, err = regexp.Compile(pattern); err != nil {
+			return false, err
+		}
+		regexpsLock.Lock()
+		if len(regexps) >= MAX_CACHED_REGEXPS {
+			clear(regexps)
+		}
+		regexps[pattern] = r
+		regexpsLock.Unlock()
+	}
+	return r.MatchString(value), nil
+}
+
+// addColumn adds the column to a table created by an earlier version, if it does not already exist.
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(`SELECT name FROM pragma_table_info(?);`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s;`, table, column, definition))
+	return err
+}
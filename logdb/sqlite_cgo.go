@@ -0,0 +1,35 @@
+//go:build !purego
+
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb
+
+import (
+	"database/sql"
+	"github.com/mattn/go-sqlite3"
+)
+
+// SQLITE_DRIVER is the cgo SQLite driver, unless built with the purego tag.
+const SQLITE_DRIVER = "sqlite3_netgo"
+
+func init() {
+	sql.Register(SQLITE_DRIVER, &sqlite3.SQLiteDriver{
+		ConnectHook: func(c *sqlite3.SQLiteConn) error {
+			return c.RegisterFunc("regexp", matchRegexp, true)
+		},
+	})
+}
@@ -0,0 +1,46 @@
+//go:build purego
+
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb
+
+import (
+	"context"
+	"database/sql/driver"
+	"modernc.org/sqlite"
+	"strings"
+)
+
+// SQLITE_DRIVER is the pure Go SQLite driver, so binaries can be built without cgo.
+const SQLITE_DRIVER = "sqlite"
+
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("regexp", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		pattern, _ := args[0].(string)
+		value, _ := args[1].(string)
+		return matchRegexp(pattern, value)
+	})
+	sqlite.RegisterConnectionHook(func(c sqlite.ExecQuerierContext, dsn string) error {
+		if strings.Contains(dsn, "timeout") {
+			// Set by the data source name
+			return nil
+		}
+		// Wait for locks held by other connections, as the cgo driver does by default, rather than failing at once
+		_, err := c.ExecContext(context.Background(), "PRAGMA busy_timeout = 5000;", nil)
+		return err
+	})
+}
@@ -0,0 +1,445 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb
+
+import (
+	"aletheiaware.com/netgo"
+	"database/sql"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	SELECT_FILE_QUERY          = `SELECT id, name, byte_offset, line_count, inode, tag FROM tbl_files WHERE name = ?;`
+	SELECT_ARCHIVE_FILES_QUERY = `SELECT id, name, byte_offset, line_count, inode, tag FROM tbl_files WHERE name > ? AND name < ?;`
+	SELECT_INODE_FILES_QUERY   = `SELECT id, name, byte_offset, line_count, inode, tag FROM tbl_files WHERE inode = ? ORDER BY id DESC;`
+	UPDATE_FILE_QUERY          = `UPDATE tbl_files SET byte_offset = ?, line_count = ?, inode = ?, tag = ? WHERE id = ?;`
+
+	SELECT_ADDRESSES_BEFORE_QUERY = `SELECT id, timestamp, address FROM tbl_requests WHERE timestamp < ?;`
+	UPDATE_ADDRESS_QUERY          = `UPDATE tbl_requests SET address = ?, address_hex = ? WHERE id = ?;`
+
+	// HEADERS_JOIN joins headers with their keys and values
+	HEADERS_JOIN = ` INNER JOIN tbl_header_keys ON tbl_header_keys.id = tbl_headers.key_id INNER JOIN tbl_header_values ON tbl_header_values.id = tbl_headers.value_id`
+)
+
+// SQLStore is a Store in a database/sql database.
+type SQLStore struct {
+	db      *sql.DB
+	dialect *Dialect
+}
+
+// OpenSQL opens the named database of the dialect, without migrating it.
+func OpenSQL(dialect *Dialect, name string) (*SQLStore, error) {
+	db, err := sql.Open(dialect.Driver, name)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLStore{
+		db:      db,
+		dialect: dialect,
+	}, nil
+}
+
+// DB returns the underlying database.
+func (s *SQLStore) DB() *sql.DB {
+	return s.db
+}
+
+// Dialect returns the dialect of the database.
+func (s *SQLStore) Dialect() *Dialect {
+	return s.dialect
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLStore) File(name string) (*File, error) {
+	f := &File{}
+	switch err := s.db.QueryRow(s.dialect.Query(SELECT_FILE_QUERY), name).Scan(&f.ID, &f.Name, &f.Offset, &f.Lines, &f.Inode, &f.Tag); err {
+	case nil:
+		return f, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (s *SQLStore) ArchiveFiles(archive string) ([]*File, error) {
+	// Names within the archive are between archive/ and archive0, since '0' follows '/'
+	return s.files(SELECT_ARCHIVE_FILES_QUERY, archive+"/", archive+"0")
+}
+
+func (s *SQLStore) InodeFiles(inode int64) ([]*File, error) {
+	return s.files(SELECT_INODE_FILES_QUERY, inode)
+}
+
+func (s *SQLStore) files(query string, args ...any) ([]*File, error) {
+	rows, err := s.db.Query(s.dialect.Query(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []*File
+	for rows.Next() {
+		f := &File{}
+		if err := rows.Scan(&f.ID, &f.Name, &f.Offset, &f.Lines, &f.Inode, &f.Tag); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+func (s *SQLStore) UpdateFile(f *File) error {
+	_, err := s.db.Exec(s.dialect.Query(UPDATE_FILE_QUERY), f.Offset, f.Lines, f.Inode, f.Tag, f.ID)
+	return err
+}
+
+func (s *SQLStore) Anonymise(before time.Time, anonymise func(string, time.Time) string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(s.dialect.Query(SELECT_ADDRESSES_BEFORE_QUERY), before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	type update struct {
+		id      int64
+		address string
+	}
+	var updates []*update
+	for rows.Next() {
+		var (
+			id        int64
+			timestamp int64
+			address   string
+		)
+		if err := rows.Scan(&id, &timestamp, &address); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if a := anonymise(address, time.Unix(timestamp, 0)); a != address {
+			updates = append(updates, &update{id, a})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	stmt, err := tx.Prepare(s.dialect.Query(UPDATE_ADDRESS_QUERY))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	for _, u := range updates {
+		if _, err := stmt.Exec(u.address, AddressHex(u.address), u.id); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(updates), nil
+}
+
+func (s *SQLStore) Requests(f *Filter) ([]*netgo.RequestRecord, error) {
+	var records []*netgo.RequestRecord
+	return records, s.ScanRequests(f, nil, func(c Cursor, r *netgo.RequestRecord) error {
+		records = append(records, r)
+		return nil
+	})
+}
+
+func (s *SQLStore) ScanRequests(f *Filter, p *Page, fn func(Cursor, *netgo.RequestRecord) error) error {
+	if p == nil {
+		p = &Page{}
+	}
+	// Distinct, as requests are joined with each header matching the filter
+	raw := `SELECT DISTINCT tbl_requests.id, tbl_requests.timestamp, tbl_requests.source, tbl_requests.address, tbl_requests.port, tbl_requests.protocol, tbl_requests.method, tbl_requests.host, tbl_requests.url FROM tbl_requests`
+	header, err := headerConditions(s.dialect, f)
+	if err != nil {
+		return err
+	}
+	request, err := requestConditions(s.dialect, f)
+	if err != nil {
+		return err
+	}
+	order, after := `ASC`, `>`
+	if p.Descending {
+		order, after = `DESC`, `<`
+	}
+	if p.After != nil {
+		request.add(`(tbl_requests.timestamp `+after+` ? OR (tbl_requests.timestamp = ? AND tbl_requests.id `+after+` ?))`, p.After.Timestamp, p.After.Timestamp, p.After.ID)
+	}
+	filters, args := joinRequestFilters(header, request)
+	raw += filters
+	raw += ` ORDER BY tbl_requests.timestamp ` + order + `, tbl_requests.id ` + order
+	if p.Limit > 0 {
+		raw += ` LIMIT ?`
+		args = append(args, p.Limit)
+	}
+	rows, err := s.db.Query(s.dialect.Rebind(raw), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			c      Cursor
+			source sql.NullString
+			raw    string
+		)
+		r := &netgo.RequestRecord{}
+		if err := rows.Scan(&c.ID, &c.Timestamp, &source, &r.IP, &r.Port, &r.Protocol, &r.Method, &r.Host, &raw); err != nil {
+			return err
+		}
+		r.Time = time.Unix(c.Timestamp, 0)
+		r.Source = source.String
+		if r.URL, err = url.Parse(raw); err != nil {
+			// Keep unparseable URLs as an opaque path
+			r.URL = &url.URL{Path: raw}
+		}
+		if err := fn(c, r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLStore) Summarise(f *Filter) (*Summary, error) {
+	raw := `SELECT COUNT(DISTINCT tbl_requests.id), COALESCE(MIN(tbl_requests.timestamp), 0), COALESCE(MAX(tbl_requests.timestamp), 0) FROM tbl_requests`
+	filters, args, err := requestFilters(s.dialect, f)
+	if err != nil {
+		return nil, err
+	}
+	raw += filters
+	summary := &Summary{}
+	if err := s.db.QueryRow(s.dialect.Rebind(raw), args...).Scan(&summary.Count, &summary.Start, &summary.End); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+func (s *SQLStore) Addresses(f *Filter, limit int) ([]*Count, error) {
+	return s.countRequests("tbl_requests.address", f, limit)
+}
+
+func (s *SQLStore) Protocols(f *Filter, limit int) ([]*Count, error) {
+	return s.countRequests("tbl_requests.protocol", f, limit)
+}
+
+func (s *SQLStore) Methods(f *Filter, limit int) ([]*Count, error) {
+	return s.countRequests("tbl_requests.method", f, limit)
+}
+
+func (s *SQLStore) URLs(f *Filter, limit int) ([]*Count, error) {
+	return s.countRequests("tbl_requests.url", f, limit)
+}
+
+func (s *SQLStore) HeaderKeys(f *Filter, limit int) ([]*Count, error) {
+	return s.countHeaders("tbl_header_keys.key", f, limit)
+}
+
+func (s *SQLStore) HeaderValues(f *Filter, limit int) ([]*Count, error) {
+	return s.countHeaders("tbl_header_values.value", f, limit)
+}
+
+// countRequests returns up to limit values of the column, by the number of requests with each.
+func (s *SQLStore) countRequests(column string, f *Filter, limit int) ([]*Count, error) {
+	raw := `SELECT ` + column + `, COUNT(tbl_requests.id) AS count FROM tbl_requests`
+	filters, args, err := requestFilters(s.dialect, f)
+	if err != nil {
+		return nil, err
+	}
+	raw += filters
+	raw += ` GROUP BY ` + column
+	raw += ` ORDER BY count DESC`
+	raw += ` LIMIT ?`
+	return s.counts(raw, append(args, limit)...)
+}
+
+// countHeaders returns up to limit values of the column, by the number of headers with each.
+func (s *SQLStore) countHeaders(column string, f *Filter, limit int) ([]*Count, error) {
+	raw := `SELECT ` + column + `, COUNT(tbl_headers.id) AS count FROM tbl_headers` + HEADERS_JOIN
+	filters, args, err := headerFilters(s.dialect, f)
+	if err != nil {
+		return nil, err
+	}
+	raw += filters
+	raw += ` GROUP BY ` + column
+	raw += ` ORDER BY count DESC`
+	raw += ` LIMIT ?`
+	return s.counts(raw, append(args, limit)...)
+}
+
+func (s *SQLStore) counts(query string, args ...any) ([]*Count, error) {
+	rows, err := s.db.Query(s.dialect.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var counts []*Count
+	for rows.Next() {
+		c := &Count{}
+		if err := rows.Scan(&c.Value, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// conditions are SQL conditions, with the arguments bound to their parameters in order.
+type conditions struct {
+	sql  []string
+	args []any
+}
+
+// add appends the condition and its arguments.
+func (c *conditions) add(condition string, args ...any) {
+	c.sql = append(c.sql, condition)
+	c.args = append(c.args, args...)
+}
+
+// join returns the conditions joined by AND, following the prefix, or "" if there are none.
+func (c *conditions) join(prefix string) string {
+	if len(c.sql) == 0 {
+		return ""
+	}
+	return prefix + strings.Join(c.sql, ` AND `)
+}
+
+// requestFilters returns the joins and conditions selecting the requests matching the filter, and the arguments they bind.
+func requestFilters(d *Dialect, f *Filter) (string, []any, error) {
+	header, err := headerConditions(d, f)
+	if err != nil {
+		return "", nil, err
+	}
+	request, err := requestConditions(d, f)
+	if err != nil {
+		return "", nil, err
+	}
+	result, args := joinRequestFilters(header, request)
+	return result, args, nil
+}
+
+// joinRequestFilters returns the joins and conditions selecting the requests matching the conditions on their headers and fields, and the arguments they bind.
+func joinRequestFilters(header, request *conditions) (string, []any) {
+	result := header.join(` INNER JOIN tbl_headers ON tbl_requests.id = tbl_headers.request` + HEADERS_JOIN + ` AND `)
+	result += request.join(` WHERE `)
+	return result, append(header.args, request.args...)
+}
+
+// headerFilters returns the joins and conditions selecting the headers of requests matching the filter, and the arguments they bind.
+func headerFilters(d *Dialect, f *Filter) (string, []any, error) {
+	request, err := requestConditions(d, f)
+	if err != nil {
+		return "", nil, err
+	}
+	header, err := headerConditions(d, f)
+	if err != nil {
+		return "", nil, err
+	}
+	result := request.join(` INNER JOIN tbl_requests ON tbl_requests.id = tbl_headers.request AND `)
+	result += header.join(` WHERE `)
+	return result, append(request.args, header.args...), nil
+}
+
+// requestConditions returns the conditions on the fields of requests.
+func requestConditions(d *Dialect, f *Filter) (*conditions, error) {
+	c := &conditions{}
+	if f.Start != 0 {
+		c.add(`tbl_requests.timestamp >= ?`, f.Start)
+	}
+	if f.End != 0 {
+		c.add(`tbl_requests.timestamp <= ?`, f.End)
+	}
+	for _, e := range f.Exclude {
+		excluded, err := e.condition(d)
+		if err != nil {
+			return nil, err
+		}
+		c.add(`NOT (`+excluded.join("")+`)`, excluded.args...)
+	}
+	return c, c.fields(d,
+		&field{"Address", KIND_ADDRESS, `tbl_requests.address`, f.Address},
+		&field{"Port", KIND_NUMBER, `tbl_requests.port`, f.Port},
+		&field{"Protocol", KIND_TEXT, `tbl_requests.protocol`, f.Protocol},
+		&field{"Method", KIND_TEXT, `tbl_requests.method`, f.Method},
+		&field{"URL", KIND_TEXT, `tbl_requests.url`, f.URL},
+		&field{"Tag", KIND_TEXT, `COALESCE((SELECT tbl_files.tag FROM tbl_files WHERE tbl_files.id = tbl_requests.file), '')`, f.Tag},
+	)
+}
+
+// headerConditions returns the conditions on the keys and values of headers.
+func headerConditions(d *Dialect, f *Filter) (*conditions, error) {
+	c := &conditions{}
+	return c, c.fields(d,
+		&field{"Header Key", KIND_TEXT, `tbl_header_keys.key`, f.HeaderKey},
+		&field{"Header Value", KIND_TEXT, `tbl_header_values.value`, f.HeaderValue},
+	)
+}
+
+// field is a column filtered by an expression.
+type field struct {
+	name       string
+	kind       Kind
+	column     string
+	expression string
+}
+
+// fields adds the conditions matching each column with its expression.
+func (c *conditions) fields(d *Dialect, fields ...*field) error {
+	for _, f := range fields {
+		e, err := ParseExpression(f.name, f.kind, f.expression)
+		if err != nil {
+			return err
+		}
+		if e != nil {
+			c.expression(d, f.column, e)
+		}
+	}
+	return nil
+}
+
+// expression adds the condition matching the column with any of the expression's terms, and none of its negated terms.
+func (c *conditions) expression(d *Dialect, column string, e *Expression) {
+	var (
+		either     []string
+		eitherArgs []any
+	)
+	for _, t := range e.terms {
+		condition, args := t.condition(d, column)
+		if t.not {
+			c.add(`NOT (`+condition+`)`, args...)
+		} else {
+			either = append(either, condition)
+			eitherArgs = append(eitherArgs, args...)
+		}
+	}
+	if len(either) > 0 {
+		c.add(`(`+strings.Join(either, ` OR `)+`)`, eitherArgs...)
+	}
+}
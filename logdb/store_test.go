@@ -0,0 +1,585 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb_test
+
+import (
+	"aletheiaware.com/netgo"
+	"aletheiaware.com/netgo/logdb"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// LOGDB_TEST_POSTGRES is the DSN of an empty PostgreSQL database to also run the store tests against.
+const LOGDB_TEST_POSTGRES = "LOGDB_TEST_POSTGRES"
+
+func TestStore_SQLite(t *testing.T) {
+	testStore(t, func(t *testing.T) logdb.Store {
+		store, err := logdb.Open(filepath.Join(t.TempDir(), "log.db"))
+		assert.Nil(t, err)
+		return store
+	})
+}
+
+func TestStore_Postgres(t *testing.T) {
+	dsn := os.Getenv(LOGDB_TEST_POSTGRES)
+	if dsn == "" {
+		t.Skip(LOGDB_TEST_POSTGRES + " not set")
+	}
+	testStore(t, func(t *testing.T) logdb.Store {
+		store, err := logdb.OpenSQL(logdb.Postgres, dsn)
+		assert.Nil(t, err)
+		version, err := store.Version()
+		assert.Nil(t, err)
+		if version != 0 {
+			store.Close()
+			t.Skip("Database not empty")
+		}
+		t.Cleanup(func() {
+			// Leave the database empty for the next test
+			_, err := store.DB().Exec(`DROP TABLE tbl_exclusions, tbl_headers, tbl_header_values, tbl_header_keys, tbl_requests, tbl_files, tbl_migrations;`)
+			assert.Nil(t, err)
+			store.Close()
+		})
+		_, err = store.Migrate()
+		assert.Nil(t, err)
+		return store
+	})
+}
+
+// testStore runs the tests shared by all dialects against stores returned by open.
+func testStore(t *testing.T, open func(*testing.T) logdb.Store) {
+	t.Helper()
+	t.Run("Files", func(t *testing.T) {
+		store := open(t)
+		defer store.Close()
+
+		file, err := store.File("a.log")
+		assert.Nil(t, err)
+		assert.Nil(t, file)
+
+		w, err := store.NewWriter()
+		assert.Nil(t, err)
+		defer w.Close()
+		assert.Nil(t, w.Begin())
+		files := []*logdb.File{
+			{Name: "a.log", Inode: 1, Tag: "host1"},
+			{Name: "b.tar/x.log"},
+			{Name: "b.tar/y.log"},
+			{Name: "b.tar0"},
+		}
+		for _, f := range files {
+			assert.Nil(t, w.AddFile(f))
+			assert.NotZero(t, f.ID)
+		}
+		files[0].Offset = 20
+		files[0].Lines = 2
+		assert.Nil(t, w.UpdateFile(files[0]))
+		assert.Nil(t, w.Commit())
+
+		file, err = store.File("a.log")
+		assert.Nil(t, err)
+		assert.Equal(t, files[0], file)
+
+		file.Offset = 30
+		file.Lines = 3
+		file.Tag = "host2"
+		assert.Nil(t, store.UpdateFile(file))
+		file, err = store.File("a.log")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(30), file.Offset)
+		assert.Equal(t, int64(3), file.Lines)
+		assert.Equal(t, "host2", file.Tag)
+
+		members, err := store.ArchiveFiles("b.tar")
+		assert.Nil(t, err)
+		assert.Equal(t, files[1:3], members)
+
+		inodes, err := store.InodeFiles(1)
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.File{file}, inodes)
+		inodes, err = store.InodeFiles(2)
+		assert.Nil(t, err)
+		assert.Empty(t, inodes)
+	})
+	t.Run("Rollback", func(t *testing.T) {
+		store := open(t)
+		defer store.Close()
+
+		w, err := store.NewWriter()
+		assert.Nil(t, err)
+		defer w.Close()
+		assert.Nil(t, w.Begin())
+		f := &logdb.File{Name: "a.log"}
+		assert.Nil(t, w.AddFile(f))
+		assert.Nil(t, w.AddRequest(f.ID, testRecord(1, "192.0.2.1", "/", "Accept", "*/*")))
+		assert.Nil(t, w.Rollback())
+
+		file, err := store.File("a.log")
+		assert.Nil(t, err)
+		assert.Nil(t, file)
+		records, err := store.Requests(&logdb.Filter{})
+		assert.Nil(t, err)
+		assert.Empty(t, records)
+	})
+	t.Run("Requests", func(t *testing.T) {
+		store := open(t)
+		defer store.Close()
+		writeRecords(t, store,
+			testRecord(1, "192.0.2.1", "/", "Accept", "*/*", "User-Agent", "curl"),
+			testRecord(2, "192.0.2.1", "/about", "Accept", "text/html"),
+			testRecord(3, "192.0.2.2", "/", "Accept", "*/*"),
+		)
+		file, err := store.File("test.log")
+		assert.Nil(t, err)
+		file.Tag = "host1"
+		assert.Nil(t, store.UpdateFile(file))
+
+		records, err := store.Requests(&logdb.Filter{})
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(records))
+		assert.Equal(t, "192.0.2.1", records[0].IP)
+		assert.Equal(t, "/about", records[1].URL.String())
+		assert.Equal(t, int64(3), records[2].Time.Unix())
+
+		for name, test := range map[string]struct {
+			filter   *logdb.Filter
+			expected []string
+		}{
+			"Time":        {&logdb.Filter{Start: 2, End: 2}, []string{"/about"}},
+			"Address":     {&logdb.Filter{Address: "192.0.2.2"}, []string{"/"}},
+			"NotAddress":  {&logdb.Filter{Address: "-192.0.2.2"}, []string{"/", "/about"}},
+			"HeaderKey":   {&logdb.Filter{HeaderKey: "User-Agent"}, []string{"/"}},
+			"HeaderValue": {&logdb.Filter{HeaderValue: "text/html"}, []string{"/about"}},
+			"Tag":         {&logdb.Filter{Tag: "host*"}, []string{"/", "/about", "/"}},
+			"OtherTag":    {&logdb.Filter{Tag: "host2"}, nil},
+		} {
+			t.Run(name, func(t *testing.T) {
+				records, err := store.Requests(test.filter)
+				assert.Nil(t, err)
+				var urls []string
+				for _, r := range records {
+					urls = append(urls, r.URL.String())
+				}
+				assert.Equal(t, test.expected, urls)
+			})
+		}
+	})
+	t.Run("Pages", func(t *testing.T) {
+		store := open(t)
+		defer store.Close()
+		writeRecords(t, store,
+			testRecord(1, "192.0.2.1", "/a", "Accept", "*/*", "Accept", "text/html"),
+			testRecord(2, "192.0.2.1", "/b"),
+			testRecord(2, "192.0.2.1", "/c"),
+			testRecord(3, "192.0.2.1", "/d"),
+			testRecord(4, "192.0.2.2", "/e"),
+		)
+
+		// scan returns the URLs of the page, and the cursor of the last
+		scan := func(f *logdb.Filter, p *logdb.Page) ([]string, *logdb.Cursor) {
+			var (
+				urls []string
+				last *logdb.Cursor
+			)
+			assert.Nil(t, store.ScanRequests(f, p, func(c logdb.Cursor, r *netgo.RequestRecord) error {
+				urls = append(urls, r.URL.String())
+				last = &c
+				return nil
+			}))
+			return urls, last
+		}
+
+		filter := &logdb.Filter{Address: "192.0.2.1"}
+		urls, cursor := scan(filter, &logdb.Page{Limit: 2})
+		assert.Equal(t, []string{"/a", "/b"}, urls)
+		urls, cursor = scan(filter, &logdb.Page{After: cursor, Limit: 2})
+		assert.Equal(t, []string{"/c", "/d"}, urls)
+		urls, _ = scan(filter, &logdb.Page{After: cursor, Limit: 2})
+		assert.Empty(t, urls)
+
+		urls, cursor = scan(&logdb.Filter{}, &logdb.Page{Limit: 3, Descending: true})
+		assert.Equal(t, []string{"/e", "/d", "/c"}, urls)
+		urls, _ = scan(&logdb.Filter{}, &logdb.Page{After: cursor, Descending: true})
+		assert.Equal(t, []string{"/b", "/a"}, urls)
+
+		// Requests joined with more than one matching header are scanned once
+		urls, _ = scan(&logdb.Filter{HeaderKey: "Accept"}, nil)
+		assert.Equal(t, []string{"/a"}, urls)
+
+		parsed, err := logdb.ParseCursor(cursor.String())
+		assert.Nil(t, err)
+		assert.Equal(t, cursor, parsed)
+		for _, invalid := range []string{"", "1", "1.", ".1", "a.b", "1.2.3"} {
+			_, err := logdb.ParseCursor(invalid)
+			assert.NotNil(t, err, invalid)
+		}
+
+		summary, err := store.Summarise(&logdb.Filter{HeaderKey: "Accept"})
+		assert.Nil(t, err)
+		assert.Equal(t, &logdb.Summary{Count: 1, Start: 1, End: 1}, summary)
+		summary, err = store.Summarise(&logdb.Filter{Address: "-192.0.2.2"})
+		assert.Nil(t, err)
+		assert.Equal(t, &logdb.Summary{Count: 4, Start: 1, End: 3}, summary)
+		summary, err = store.Summarise(&logdb.Filter{Address: "203.0.113.1"})
+		assert.Nil(t, err)
+		assert.Equal(t, &logdb.Summary{}, summary)
+	})
+	t.Run("TimeSeries", func(t *testing.T) {
+		store := open(t)
+		defer store.Close()
+		post := testRecord(time.Date(2024, 3, 31, 0, 50, 0, 0, time.UTC).Unix(), "192.0.2.1", "/", "Accept", "*/*", "Accept", "text/html")
+		post.Method = "POST"
+		writeRecords(t, store,
+			testRecord(time.Date(2024, 3, 30, 23, 30, 0, 0, time.UTC).Unix(), "192.0.2.1", "/"),
+			testRecord(time.Date(2024, 3, 31, 0, 10, 0, 0, time.UTC).Unix(), "192.0.2.1", "/"),
+			post,
+			testRecord(time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC).Unix(), "192.0.2.2", "/"),
+		)
+		london, err := time.LoadLocation("Europe/London")
+		assert.Nil(t, err)
+		unix := func(year int, month time.Month, day, hour int) int64 {
+			return time.Date(year, month, day, hour, 0, 0, 0, time.UTC).Unix()
+		}
+
+		buckets, err := store.TimeSeries(&logdb.Filter{}, logdb.INTERVAL_HOUR, time.UTC, "")
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Bucket{
+			{Start: unix(2024, 3, 30, 23), End: unix(2024, 3, 31, 0), Count: 1},
+			{Start: unix(2024, 3, 31, 0), End: unix(2024, 3, 31, 1), Count: 2},
+			{Start: unix(2024, 3, 31, 12), End: unix(2024, 3, 31, 13), Count: 1},
+		}, buckets)
+
+		// Clocks go forward, so the day is 23 hours long
+		buckets, err = store.TimeSeries(&logdb.Filter{}, logdb.INTERVAL_DAY, london, "")
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Bucket{
+			{Start: unix(2024, 3, 30, 0), End: unix(2024, 3, 31, 0), Count: 1},
+			{Start: unix(2024, 3, 31, 0), End: unix(2024, 3, 31, 23), Count: 3},
+		}, buckets)
+
+		buckets, err = store.TimeSeries(&logdb.Filter{HeaderKey: "Accept"}, logdb.INTERVAL_WEEK, time.UTC, "method")
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Bucket{
+			{Start: unix(2024, 3, 25, 0), End: unix(2024, 4, 1, 0), Value: "POST", Count: 1},
+		}, buckets)
+
+		_, err = store.TimeSeries(&logdb.Filter{}, logdb.INTERVAL_DAY, time.UTC, "password")
+		assert.NotNil(t, err)
+		_, err = store.TimeSeries(&logdb.Filter{}, logdb.Interval("fortnight"), time.UTC, "")
+		assert.NotNil(t, err)
+	})
+	t.Run("Counts", func(t *testing.T) {
+		store := open(t)
+		defer store.Close()
+		writeRecords(t, store,
+			testRecord(1, "192.0.2.1", "/", "Accept", "*/*", "User-Agent", "curl"),
+			testRecord(2, "192.0.2.1", "/about", "Accept", "text/html"),
+			testRecord(3, "192.0.2.2", "/", "Accept", "*/*"),
+		)
+
+		addresses, err := store.Addresses(&logdb.Filter{}, 1000)
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Count{{"192.0.2.1", 2}, {"192.0.2.2", 1}}, addresses)
+
+		urls, err := store.URLs(&logdb.Filter{}, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Count{{"/", 2}}, urls)
+
+		methods, err := store.Methods(&logdb.Filter{Address: "192.0.2.2"}, 1000)
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Count{{"GET", 1}}, methods)
+
+		protocols, err := store.Protocols(&logdb.Filter{HeaderValue: "text/html"}, 1000)
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Count{{"HTTP/1.1", 1}}, protocols)
+
+		keys, err := store.HeaderKeys(&logdb.Filter{}, 1000)
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Count{{"Accept", 3}, {"User-Agent", 1}}, keys)
+
+		values, err := store.HeaderValues(&logdb.Filter{HeaderKey: "Accept", Address: "-192.0.2.2", Start: 2}, 1000)
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Count{{"text/html", 1}}, values)
+	})
+	t.Run("Expressions", func(t *testing.T) {
+		store := open(t)
+		defer store.Close()
+		records := []*netgo.RequestRecord{
+			testRecord(1, "192.0.2.1", "/", "User-Agent", "Mozilla/5.0"),
+			testRecord(2, "192.0.2.200", "/blog/1", "User-Agent", "Googlebot/2.1"),
+			testRecord(3, "198.51.100.1", "/blog/latest", "User-Agent", "curl/7.68.0"),
+			testRecord(4, "2001:db8::1", "/static/a*b.css", "Accept", "*/*"),
+			testRecord(5, "anonymised", "/health", "User-Agent", "a|b"),
+		}
+		for i, r := range records {
+			r.Port = 80 * (i + 1)
+		}
+		writeRecords(t, store, records...)
+
+		for name, test := range map[string]struct {
+			filter   *logdb.Filter
+			expected []string
+		}{
+			"Or":               {&logdb.Filter{URL: "/|/health"}, []string{"/", "/health"}},
+			"NotOr":            {&logdb.Filter{URL: "-/|-/health"}, []string{"/blog/1", "/blog/latest", "/static/a%2Ab.css"}},
+			"OrNot":            {&logdb.Filter{URL: "/blog/*|-/blog/1"}, []string{"/blog/latest"}},
+			"Prefix":           {&logdb.Filter{URL: "/blog/*"}, []string{"/blog/1", "/blog/latest"}},
+			"Suffix":           {&logdb.Filter{HeaderValue: "*bot/2.1"}, []string{"/blog/1"}},
+			"Contains":         {&logdb.Filter{HeaderValue: "*bot*"}, []string{"/blog/1"}},
+			"CaseSensitive":    {&logdb.Filter{HeaderValue: "*BOT*"}, nil},
+			"WildcardLiterals": {&logdb.Filter{HeaderValue: "*/*|*_*|*%*"}, []string{"/", "/blog/1", "/blog/latest", "/static/a%2Ab.css"}},
+			"Escaped":          {&logdb.Filter{HeaderValue: `a\|b`}, []string{"/health"}},
+			"Quoted":           {&logdb.Filter{HeaderValue: `"*/*"`}, []string{"/static/a%2Ab.css"}},
+			"Regexp":           {&logdb.Filter{URL: `~^/blog/\d+$`}, []string{"/blog/1"}},
+			"NotRegexp":        {&logdb.Filter{HeaderValue: `-~"^(Mozilla|curl)/"`, HeaderKey: "User-Agent"}, []string{"/blog/1", "/health"}},
+			"Network":          {&logdb.Filter{Address: "192.0.2.0/24"}, []string{"/", "/blog/1"}},
+			"NetworkIPv6":      {&logdb.Filter{Address: "2001:db8::/32|198.51.100.0/31"}, []string{"/blog/latest", "/static/a%2Ab.css"}},
+			"NotNetwork":       {&logdb.Filter{Address: "-192.0.2.0/24"}, []string{"/blog/latest", "/static/a%2Ab.css", "/health"}},
+			"Port":             {&logdb.Filter{Port: "160"}, []string{"/blog/1"}},
+			"PortCompare":      {&logdb.Filter{Port: ">=320|<100"}, []string{"/", "/static/a%2Ab.css", "/health"}},
+			"PortRange":        {&logdb.Filter{Port: "100..300"}, []string{"/blog/1", "/blog/latest"}},
+			"NotPortRange":     {&logdb.Filter{Port: "-100..300"}, []string{"/", "/static/a%2Ab.css", "/health"}},
+		} {
+			t.Run(name, func(t *testing.T) {
+				records, err := store.Requests(test.filter)
+				assert.Nil(t, err)
+				var urls []string
+				for _, r := range records {
+					urls = append(urls, r.URL.String())
+				}
+				assert.Equal(t, test.expected, urls)
+			})
+		}
+
+		_, err := store.Requests(&logdb.Filter{Port: "http"})
+		var e *logdb.ExpressionError
+		assert.True(t, errors.As(err, &e))
+		_, err = store.HeaderKeys(&logdb.Filter{URL: "~("}, 1000)
+		assert.True(t, errors.As(err, &e))
+	})
+	t.Run("Hostile", func(t *testing.T) {
+		store := open(t)
+		defer store.Close()
+		writeRecords(t, store,
+			testRecord(1, "192.0.2.1", "/", "User-Agent", "O'Brien"),
+			testRecord(2, "'; DROP TABLE tbl_requests; --", "/", "User-Agent", "?"),
+		)
+
+		records, err := store.Requests(&logdb.Filter{Address: "'; DROP TABLE tbl_requests; --"})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(records))
+
+		values, err := store.HeaderValues(&logdb.Filter{HeaderValue: "-?", Address: "' OR '1'='1"}, 1000)
+		assert.Nil(t, err)
+		assert.Empty(t, values)
+
+		addresses, err := store.Addresses(&logdb.Filter{HeaderValue: "O'Brien"}, 1000)
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Count{{"192.0.2.1", 1}}, addresses)
+	})
+	t.Run("Sessions", func(t *testing.T) {
+		store := open(t)
+		defer store.Close()
+		writeRecords(t, store,
+			testRecord(100, "192.0.2.1", "/", "User-Agent", "curl", "User-Agent", "other", "Referer", "https://example.org/"),
+			testRecord(160, "192.0.2.1", "/about", "User-Agent", "curl"),
+			testRecord(170, "192.0.2.1", "/style.css", "User-Agent", "curl"),
+			testRecord(200, "192.0.2.1", "/", "User-Agent", "wget"),
+			testRecord(5000, "192.0.2.1", "/contact", "User-Agent", "curl"),
+			testRecord(150, "192.0.2.2", "/", "Accept", "*/*", "Accept", "text/html"),
+		)
+
+		sessions, err := store.Sessions(&logdb.Filter{}, 30*time.Minute, false, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Session{
+			{Address: "192.0.2.1", UserAgent: "curl", Start: 5000, End: 5000, Requests: 1, Pages: 1, Entry: "/contact", Exit: "/contact"},
+			{Address: "192.0.2.2", Start: 150, End: 150, Requests: 1, Pages: 1, Entry: "/", Exit: "/"},
+			{Address: "192.0.2.1", UserAgent: "curl", Start: 100, End: 200, Requests: 4, Pages: 3, Entry: "/", Exit: "/", Referrer: "https://example.org/"},
+		}, sessions)
+
+		sessions, err = store.Sessions(&logdb.Filter{}, time.Hour*2, true, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Session{
+			{Address: "192.0.2.1", UserAgent: "wget", Start: 200, End: 200, Requests: 1, Pages: 1, Entry: "/", Exit: "/"},
+			{Address: "192.0.2.2", Start: 150, End: 150, Requests: 1, Pages: 1, Entry: "/", Exit: "/"},
+			{Address: "192.0.2.1", UserAgent: "curl", Start: 100, End: 5000, Requests: 4, Pages: 3, Entry: "/", Exit: "/contact", Referrer: "https://example.org/"},
+		}, sessions)
+
+		// Reading stops once the latest sessions have started, leaving out earlier requests of other visitors too
+		sessions, err = store.Sessions(&logdb.Filter{}, 30*time.Minute, false, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Session{
+			{Address: "192.0.2.1", UserAgent: "curl", Start: 5000, End: 5000, Requests: 1, Pages: 1, Entry: "/contact", Exit: "/contact"},
+		}, sessions)
+		sessions, err = store.Sessions(&logdb.Filter{}, 30*time.Minute, false, 2)
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Session{
+			{Address: "192.0.2.1", UserAgent: "curl", Start: 5000, End: 5000, Requests: 1, Pages: 1, Entry: "/contact", Exit: "/contact"},
+			{Address: "192.0.2.1", UserAgent: "curl", Start: 100, End: 200, Requests: 4, Pages: 3, Entry: "/", Exit: "/", Referrer: "https://example.org/"},
+		}, sessions)
+		sessions, err = store.Sessions(&logdb.Filter{}, time.Hour*2, true, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Session{
+			{Address: "192.0.2.1", UserAgent: "curl", Start: 100, End: 5000, Requests: 4, Pages: 3, Entry: "/", Exit: "/contact", Referrer: "https://example.org/"},
+		}, sessions)
+
+		// Requests joined with more than one matching header are counted once
+		sessions, err = store.Sessions(&logdb.Filter{Address: "192.0.2.2", HeaderKey: "Accept"}, 30*time.Minute, false, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Session{
+			{Address: "192.0.2.2", Start: 150, End: 150, Requests: 1, Pages: 1, Entry: "/", Exit: "/"},
+		}, sessions)
+		sessions, err = store.Sessions(&logdb.Filter{Address: "192.0.2.1", HeaderKey: "User-Agent"}, 30*time.Minute, true, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Session{
+			{Address: "192.0.2.1", UserAgent: "curl", Start: 5000, End: 5000, Requests: 1, Pages: 1, Entry: "/contact", Exit: "/contact"},
+			{Address: "192.0.2.1", UserAgent: "wget", Start: 200, End: 200, Requests: 1, Pages: 1, Entry: "/", Exit: "/"},
+			{Address: "192.0.2.1", UserAgent: "curl", Start: 100, End: 170, Requests: 3, Pages: 2, Entry: "/", Exit: "/style.css", Referrer: "https://example.org/"},
+		}, sessions)
+
+		_, err = store.Sessions(&logdb.Filter{Port: "~80"}, 30*time.Minute, false, 0)
+		var e *logdb.ExpressionError
+		assert.True(t, errors.As(err, &e))
+	})
+	t.Run("Exclusions", func(t *testing.T) {
+		store := open(t)
+		defer store.Close()
+		writeRecords(t, store,
+			testRecord(1, "192.0.2.1", "/", "User-Agent", "Mozilla/5.0"),
+			testRecord(2, "192.0.2.1", "/health", "User-Agent", "kube-probe/1.30"),
+			testRecord(3, "192.0.2.2", "/", "User-Agent", "Mozilla/5.0 (compatible; Googlebot/2.1)"),
+			testRecord(4, "198.51.100.7", "/", "User-Agent", "Mozilla/5.0"),
+			testRecord(5, "198.51.100.7", "/about", "Accept", "*/*"),
+		)
+
+		exclusions, err := store.Exclusions()
+		assert.Nil(t, err)
+		assert.Equal(t, logdb.BuiltInExclusions, exclusions)
+
+		office := &logdb.Exclusion{Name: "office", Address: "198.51.100.0/24", URL: "/"}
+		assert.Nil(t, store.SaveExclusion(office))
+		// Replaced by name
+		office.URL = "/|/about"
+		assert.Nil(t, store.SaveExclusion(office))
+		exclusions, err = store.Exclusions()
+		assert.Nil(t, err)
+		assert.Equal(t, append(append([]*logdb.Exclusion{}, logdb.BuiltInExclusions...), office), exclusions)
+
+		for name, test := range map[string]struct {
+			exclude  []*logdb.Exclusion
+			expected []string
+		}{
+			"None":   {nil, []string{"/", "/health", "/", "/", "/about"}},
+			"Bots":   {exclusions[:1], []string{"/", "/", "/about"}},
+			"Health": {exclusions[1:2], []string{"/", "/", "/", "/about"}},
+			"All":    {exclusions, []string{"/"}},
+		} {
+			t.Run(name, func(t *testing.T) {
+				records, err := store.Requests(&logdb.Filter{Exclude: test.exclude})
+				assert.Nil(t, err)
+				var urls []string
+				for _, r := range records {
+					urls = append(urls, r.URL.String())
+				}
+				assert.Equal(t, test.expected, urls)
+			})
+		}
+
+		// Applied to headers
+		keys, err := store.HeaderKeys(&logdb.Filter{Exclude: exclusions[:1]}, 1000)
+		assert.Nil(t, err)
+		assert.Equal(t, []*logdb.Count{{"User-Agent", 2}, {"Accept", 1}}, keys)
+
+		var e *logdb.ExpressionError
+		assert.True(t, errors.As(store.SaveExclusion(&logdb.Exclusion{Name: "invalid", Address: "192.0.2.0/99"}), &e))
+		assert.NotNil(t, store.SaveExclusion(&logdb.Exclusion{Name: "empty"}))
+		assert.NotNil(t, store.SaveExclusion(&logdb.Exclusion{Name: "bots,office", URL: "/"}))
+		assert.NotNil(t, store.SaveExclusion(&logdb.Exclusion{Name: logdb.EXCLUSION_BOTS, URL: "/"}))
+
+		deleted, err := store.DeleteExclusion("office")
+		assert.Nil(t, err)
+		assert.True(t, deleted)
+		deleted, err = store.DeleteExclusion("office")
+		assert.Nil(t, err)
+		assert.False(t, deleted)
+		_, err = store.DeleteExclusion(logdb.EXCLUSION_HEALTH)
+		assert.NotNil(t, err)
+	})
+	t.Run("Anonymise", func(t *testing.T) {
+		store := open(t)
+		defer store.Close()
+		writeRecords(t, store,
+			testRecord(1, "192.0.2.1", "/"),
+			testRecord(2, "192.0.2.2", "/"),
+			testRecord(3, "192.0.2.3", "/"),
+		)
+
+		count, err := store.Anonymise(time.Unix(3, 0), func(address string, t time.Time) string {
+			if address == "192.0.2.2" {
+				// Already anonymised
+				return address
+			}
+			return "anonymous"
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, count)
+
+		addresses, err := store.Addresses(&logdb.Filter{}, 1000)
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []*logdb.Count{{"anonymous", 1}, {"192.0.2.2", 1}, {"192.0.2.3", 1}}, addresses)
+	})
+}
+
+// testRecord returns a GET request at the given Unix time, with headers given in pairs.
+func testRecord(timestamp int64, ip, path string, headers ...string) *netgo.RequestRecord {
+	header := make(http.Header)
+	for i := 0; i+1 < len(headers); i += 2 {
+		header.Add(headers[i], headers[i+1])
+	}
+	return &netgo.RequestRecord{
+		Time:     time.Unix(timestamp, 0),
+		Source:   netgo.REQUEST_LOG,
+		IP:       ip,
+		Protocol: "HTTP/1.1",
+		Method:   "GET",
+		Host:     "example.com",
+		URL:      &url.URL{Path: path},
+		Header:   header,
+	}
+}
+
+// writeRecords records the requests as parsed from a single log.
+func writeRecords(t *testing.T, store logdb.Store, records ...*netgo.RequestRecord) {
+	t.Helper()
+	w, err := store.NewWriter()
+	assert.Nil(t, err)
+	defer w.Close()
+	assert.Nil(t, w.Begin())
+	f := &logdb.File{Name: "test.log"}
+	assert.Nil(t, w.AddFile(f))
+	for _, r := range records {
+		assert.Nil(t, w.AddRequest(f.ID, r))
+	}
+	assert.Nil(t, w.Commit())
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Interval is the size of the buckets of a time series.
+type Interval string
+
+const (
+	INTERVAL_MINUTE Interval = "minute"
+	INTERVAL_HOUR   Interval = "hour"
+	INTERVAL_DAY    Interval = "day"
+	INTERVAL_WEEK   Interval = "week"
+)
+
+// INTERVALS are the sizes of buckets, smallest first.
+var INTERVALS = []Interval{INTERVAL_MINUTE, INTERVAL_HOUR, INTERVAL_DAY, INTERVAL_WEEK}
+
+// SPLITS are the dimensions a time series can be split by, and their columns.
+var SPLITS = map[string]string{
+	"method":   `tbl_requests.method`,
+	"protocol": `tbl_requests.protocol`,
+	"host":     `tbl_requests.host`,
+}
+
+// ParseInterval returns the named interval.
+func ParseInterval(s string) (Interval, error) {
+	i := Interval(s)
+	if !slices.Contains(INTERVALS, i) {
+		return "", fmt.Errorf("Invalid Interval: %s", s)
+	}
+	return i, nil
+}
+
+// IntervalFor returns the smallest interval dividing the time span into no more than the given number of buckets, or the largest interval.
+func IntervalFor(start, end int64, buckets int) Interval {
+	span := time.Duration(end-start) * time.Second
+	for _, i := range INTERVALS {
+		if span <= i.approximate()*time.Duration(buckets) {
+			return i
+		}
+	}
+	return INTERVAL_WEEK
+}
+
+// approximate returns the usual duration of the interval, which differs when clocks change.
+func (i Interval) approximate() time.Duration {
+	switch i {
+	case INTERVAL_MINUTE:
+		return time.Minute
+	case INTERVAL_HOUR:
+		return time.Hour
+	case INTERVAL_DAY:
+		return 24 * time.Hour
+	default:
+		return 7 * 24 * time.Hour
+	}
+}
+
+// Start returns the start of the bucket containing the time, in the time's location.
+// Weeks start on Monday.
+func (i Interval) Start(t time.Time) time.Time {
+	switch i {
+	case INTERVAL_MINUTE:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
+	case INTERVAL_HOUR:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case INTERVAL_DAY:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	default:
+		monday := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-monday, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// Next returns the start of the bucket after the one starting at the time.
+func (i Interval) Next(t time.Time) time.Time {
+	switch i {
+	case INTERVAL_MINUTE:
+		return t.Add(time.Minute)
+	case INTERVAL_HOUR:
+		return t.Add(time.Hour)
+	case INTERVAL_DAY:
+		return t.AddDate(0, 0, 1)
+	default:
+		return t.AddDate(0, 0, 7)
+	}
+}
+
+// slot returns the number of seconds in which requests are counted by the database, before being merged into buckets.
+// Every timezone's offset from UTC is a multiple of 15 minutes, so slots never span the start of a bucket.
+func (i Interval) slot() int64 {
+	if i == INTERVAL_MINUTE {
+		return 60
+	}
+	return 15 * 60
+}
+
+// Bucket is the number of requests in a time interval, optionally with a value of the dimension the series is split by.
+type Bucket struct {
+	// Unix times of the start of the bucket, and the start of the next
+	Start, End int64
+	Value      string
+	Count      int
+}
+
+func (s *SQLStore) TimeSeries(f *Filter, interval Interval, location *time.Location, split string) ([]*Bucket, error) {
+	if !slices.Contains(INTERVALS, interval) {
+		return nil, fmt.Errorf("Invalid Interval: %s", interval)
+	}
+	// Distinct, as requests are joined with each header matching the filter
+	raw := `SELECT tbl_requests.timestamp - tbl_requests.timestamp % ?, COUNT(DISTINCT tbl_requests.id)`
+	group := ` GROUP BY 1`
+	if split != "" {
+		column, ok := SPLITS[split]
+		if !ok {
+			return nil, fmt.Errorf("Invalid Split: %s", split)
+		}
+		raw += `, ` + column
+		group += `, 3`
+	}
+	raw += ` FROM tbl_requests`
+	filters, args, err := requestFilters(s.dialect, f)
+	if err != nil {
+		return nil, err
+	}
+	raw += filters
+	raw += group
+	rows, err := s.db.Query(s.dialect.Rebind(raw), append([]any{interval.slot()}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type key struct {
+		start int64
+		value string
+	}
+	buckets := make(map[key]*Bucket)
+	for rows.Next() {
+		var (
+			slot  int64
+			value string
+			count int
+		)
+		dest := []any{&slot, &count}
+		if split != "" {
+			dest = append(dest, &value)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		start := interval.Start(time.Unix(slot, 0).In(location))
+		k := key{start.Unix(), value}
+		b, ok := buckets[k]
+		if !ok {
+			b = &Bucket{
+				Start: k.start,
+				End:   interval.Next(start).Unix(),
+				Value: value,
+			}
+			buckets[k] = b
+		}
+		b.Count += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	result := make([]*Bucket, 0, len(buckets))
+	for _, b := range buckets {
+		result = append(result, b)
+	}
+	slices.SortFunc(result, func(a, b *Bucket) int {
+		return cmp.Or(cmp.Compare(a.Start, b.Start), strings.Compare(a.Value, b.Value))
+	})
+	return result, nil
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb_test
+
+import (
+	"aletheiaware.com/netgo/logdb"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestInterval(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	assert.Nil(t, err)
+	// Thursday, during summer time
+	now := time.Date(2024, 7, 4, 15, 42, 17, 0, london)
+	for _, test := range []struct {
+		interval    logdb.Interval
+		start, next time.Time
+	}{
+		{logdb.INTERVAL_MINUTE, time.Date(2024, 7, 4, 15, 42, 0, 0, london), time.Date(2024, 7, 4, 15, 43, 0, 0, london)},
+		{logdb.INTERVAL_HOUR, time.Date(2024, 7, 4, 15, 0, 0, 0, london), time.Date(2024, 7, 4, 16, 0, 0, 0, london)},
+		{logdb.INTERVAL_DAY, time.Date(2024, 7, 4, 0, 0, 0, 0, london), time.Date(2024, 7, 5, 0, 0, 0, 0, london)},
+		{logdb.INTERVAL_WEEK, time.Date(2024, 7, 1, 0, 0, 0, 0, london), time.Date(2024, 7, 8, 0, 0, 0, 0, london)},
+	} {
+		t.Run(string(test.interval), func(t *testing.T) {
+			parsed, err := logdb.ParseInterval(string(test.interval))
+			assert.Nil(t, err)
+			assert.Equal(t, test.interval, parsed)
+			start := test.interval.Start(now)
+			assert.True(t, test.start.Equal(start), start)
+			next := test.interval.Next(start)
+			assert.True(t, test.next.Equal(next), next)
+		})
+	}
+	t.Run("Sunday", func(t *testing.T) {
+		start := logdb.INTERVAL_WEEK.Start(time.Date(2024, 7, 7, 23, 59, 0, 0, time.UTC))
+		assert.Equal(t, time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC), start)
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := logdb.ParseInterval("fortnight")
+		assert.NotNil(t, err)
+	})
+}
+
+func TestIntervalFor(t *testing.T) {
+	for _, test := range []struct {
+		span     time.Duration
+		expected logdb.Interval
+	}{
+		{0, logdb.INTERVAL_MINUTE},
+		{100 * time.Minute, logdb.INTERVAL_MINUTE},
+		{101 * time.Minute, logdb.INTERVAL_HOUR},
+		{100 * time.Hour, logdb.INTERVAL_HOUR},
+		{30 * 24 * time.Hour, logdb.INTERVAL_DAY},
+		{365 * 24 * time.Hour, logdb.INTERVAL_WEEK},
+		{100 * 365 * 24 * time.Hour, logdb.INTERVAL_WEEK},
+	} {
+		t.Run(test.span.String(), func(t *testing.T) {
+			assert.Equal(t, test.expected, logdb.IntervalFor(0, int64(test.span/time.Second), 100))
+		})
+	}
+}
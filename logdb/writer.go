@@ -0,0 +1,228 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logdb
+
+import (
+	"aletheiaware.com/netgo"
+	"database/sql"
+	"errors"
+	"maps"
+	"slices"
+)
+
+const (
+	INSERT_FILE_QUERY = `INSERT INTO tbl_files
+(name, byte_offset, line_count, inode, tag)
+VALUES
+(?, ?, ?, ?, ?)
+RETURNING id;`
+	INSERT_REQUEST_QUERY = `INSERT INTO tbl_requests
+(file, timestamp, source, address, address_hex, port, protocol, method, host, url)
+VALUES
+(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+RETURNING id;`
+	INSERT_HEADER_QUERY = `INSERT INTO tbl_headers
+(request, key_id, value_id)
+VALUES
+(?, ?, ?);`
+	INSERT_HEADER_KEY_QUERY   = `INSERT INTO tbl_header_keys (key) VALUES (?) ON CONFLICT (key) DO NOTHING;`
+	SELECT_HEADER_KEY_QUERY   = `SELECT id FROM tbl_header_keys WHERE key = ?;`
+	INSERT_HEADER_VALUE_QUERY = `INSERT INTO tbl_header_values (value) VALUES (?) ON CONFLICT (value) DO NOTHING;`
+	SELECT_HEADER_VALUE_QUERY = `SELECT id FROM tbl_header_values WHERE value = ?;`
+)
+
+// MAX_CACHED_HEADER_VALUES limits the number of header value ids remembered by a writer.
+const MAX_CACHED_HEADER_VALUES = 100000
+
+// sqlWriter is a Writer with statements prepared once and used in each transaction.
+type sqlWriter struct {
+	db      *sql.DB
+	dialect *Dialect
+	tx      *sql.Tx
+	// Statements prepared on the database
+	insertFile, updateFile, insertRequest, insertHeader *sql.Stmt
+	// Statements of the current transaction
+	files, updates, requests, headers *sql.Stmt
+	keys, values                      *dictionary
+}
+
+func (s *SQLStore) NewWriter() (Writer, error) {
+	w := &sqlWriter{
+		db:      s.db,
+		dialect: s.dialect,
+	}
+	for _, p := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&w.insertFile, INSERT_FILE_QUERY},
+		{&w.updateFile, UPDATE_FILE_QUERY},
+		{&w.insertRequest, INSERT_REQUEST_QUERY},
+		{&w.insertHeader, INSERT_HEADER_QUERY},
+	} {
+		stmt, err := s.db.Prepare(s.dialect.Query(p.query))
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		*p.stmt = stmt
+	}
+	var err error
+	if w.keys, err = newDictionary(s.db, s.dialect.Query(INSERT_HEADER_KEY_QUERY), s.dialect.Query(SELECT_HEADER_KEY_QUERY), 0); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if w.values, err = newDictionary(s.db, s.dialect.Query(INSERT_HEADER_VALUE_QUERY), s.dialect.Query(SELECT_HEADER_VALUE_QUERY), MAX_CACHED_HEADER_VALUES); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *sqlWriter) Begin() (err error) {
+	if w.tx, err = w.db.Begin(); err != nil {
+		return err
+	}
+	w.files = w.tx.Stmt(w.insertFile)
+	w.updates = w.tx.Stmt(w.updateFile)
+	w.requests = w.tx.Stmt(w.insertRequest)
+	w.headers = w.tx.Stmt(w.insertHeader)
+	w.keys.begin(w.tx)
+	w.values.begin(w.tx)
+	return nil
+}
+
+func (w *sqlWriter) AddFile(f *File) error {
+	return w.files.QueryRow(f.Name, f.Offset, f.Lines, f.Inode, f.Tag).Scan(&f.ID)
+}
+
+func (w *sqlWriter) UpdateFile(f *File) error {
+	_, err := w.updates.Exec(f.Offset, f.Lines, f.Inode, f.Tag, f.ID)
+	return err
+}
+
+func (w *sqlWriter) AddRequest(file int64, r *netgo.RequestRecord) error {
+	var id int64
+	if err := w.requests.QueryRow(file, r.Time.Unix(), r.Source, r.IP, AddressHex(r.IP), r.Port, r.Protocol, r.Method, r.Host, r.URL.String()).Scan(&id); err != nil {
+		return err
+	}
+	// Insert in key order so the database is deterministic
+	for _, k := range slices.Sorted(maps.Keys(r.Header)) {
+		keyId, err := w.keys.id(k)
+		if err != nil {
+			return err
+		}
+		for _, v := range r.Header[k] {
+			valueId, err := w.values.id(v)
+			if err != nil {
+				return err
+			}
+			if _, err := w.headers.Exec(id, keyId, valueId); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *sqlWriter) Commit() error {
+	return w.tx.Commit()
+}
+
+func (w *sqlWriter) Rollback() error {
+	if w.tx == nil {
+		return nil
+	}
+	return w.tx.Rollback()
+}
+
+func (w *sqlWriter) Close() error {
+	var errs []error
+	for _, s := range []*sql.Stmt{w.insertFile, w.updateFile, w.insertRequest, w.insertHeader} {
+		if s != nil {
+			errs = append(errs, s.Close())
+		}
+	}
+	for _, d := range []*dictionary{w.keys, w.values} {
+		if d != nil {
+			errs = append(errs, d.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// dictionary maps header keys or values to their ids in a dictionary table, recording those not seen before.
+type dictionary struct {
+	insert, query *sql.Stmt
+	// Statements of the current transaction
+	txInsert, txQuery *sql.Stmt
+	ids               map[string]int64
+	// Maximum number of ids cached, or 0 for no limit
+	limit int
+}
+
+func newDictionary(db *sql.DB, insert, query string, limit int) (*dictionary, error) {
+	i, err := db.Prepare(insert)
+	if err != nil {
+		return nil, err
+	}
+	q, err := db.Prepare(query)
+	if err != nil {
+		i.Close()
+		return nil, err
+	}
+	return &dictionary{
+		insert: i,
+		query:  q,
+		ids:    make(map[string]int64),
+		limit:  limit,
+	}, nil
+}
+
+// begin uses the transaction for subsequent lookups.
+// Ids cached during a transaction that is rolled back are not valid, so a writer is not used again after a failed transaction.
+func (d *dictionary) begin(tx *sql.Tx) {
+	d.txInsert = tx.Stmt(d.insert)
+	d.txQuery = tx.Stmt(d.query)
+}
+
+// id returns the id of the text, recording it if not seen before.
+func (d *dictionary) id(text string) (int64, error) {
+	if id, ok := d.ids[text]; ok {
+		return id, nil
+	}
+	if _, err := d.txInsert.Exec(text); err != nil {
+		return 0, err
+	}
+	var id int64
+	if err := d.txQuery.QueryRow(text).Scan(&id); err != nil {
+		return 0, err
+	}
+	if d.limit > 0 && len(d.ids) >= d.limit {
+		clear(d.ids)
+	}
+	d.ids[text] = id
+	return id, nil
+}
+
+func (d *dictionary) Close() error {
+	err := d.insert.Close()
+	if e := d.query.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,304 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netgo
+
+import (
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LOG_ROTATE_SIZE     = "LOG_ROTATE_SIZE"
+	LOG_ROTATE_INTERVAL = "LOG_ROTATE_INTERVAL"
+	LOG_COMPRESS        = "LOG_COMPRESS"
+	LOG_RETAIN_AGE      = "LOG_RETAIN_AGE"
+	LOG_RETAIN_COUNT    = "LOG_RETAIN_COUNT"
+)
+
+// COMPRESSED_SUFFIX is appended to the name of rotated log files when compression is enabled.
+const COMPRESSED_SUFFIX = ".gz"
+
+// LogFileOptions controls when log files are rotated and how long rotated files are kept.
+// Zero values disable the corresponding behaviour.
+type LogFileOptions struct {
+	// Rotate once the file reaches this many bytes
+	MaxSize int64
+	// Rotate at each multiple of this interval since the zero time, so 24h rotates daily at UTC midnight
+	Interval time.Duration
+	// Gzip rotated files, off by default since only a logparser which reads compressed logs can resume them
+	Compress bool
+	// Delete rotated files older than this
+	MaxAge time.Duration
+	// Keep at most this many rotated files
+	MaxCount int
+	// Clock used to name and rotate files, defaults to time.Now
+	Now func() time.Time
+}
+
+// LogFileOptionsFromEnv reads options from the LOG_ROTATE_SIZE (bytes), LOG_ROTATE_INTERVAL (eg. 24h), LOG_COMPRESS, LOG_RETAIN_AGE (eg. 720h), and LOG_RETAIN_COUNT environment variables.
+func LogFileOptionsFromEnv() (*LogFileOptions, error) {
+	size, err := envInt(LOG_ROTATE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	count, err := envInt(LOG_RETAIN_COUNT)
+	if err != nil {
+		return nil, err
+	}
+	options := &LogFileOptions{
+		MaxSize:  size,
+		Compress: BooleanFlag(LOG_COMPRESS),
+		MaxCount: int(count),
+	}
+	if i, ok := os.LookupEnv(LOG_ROTATE_INTERVAL); ok {
+		d, err := time.ParseDuration(i)
+		if err != nil {
+			return nil, err
+		}
+		options.Interval = d
+	}
+	if a, ok := os.LookupEnv(LOG_RETAIN_AGE); ok {
+		d, err := time.ParseDuration(a)
+		if err != nil {
+			return nil, err
+		}
+		options.MaxAge = d
+	}
+	return options, nil
+}
+
+// LogFile writes to a file in a directory, named with the UTC time it was opened, and rotates to a new file according to its options.
+type LogFile struct {
+	directory string
+	options   *LogFileOptions
+	mutex     sync.Mutex
+	file      *os.File
+	size      int64
+	rotation  time.Time
+	// Reports failures of background compression and pruning
+	logger *slog.Logger
+	// Tracks background compression and pruning
+	group sync.WaitGroup
+	// Serializes background compression and pruning
+	background sync.Mutex
+}
+
+func OpenLogFile(directory string, options *LogFileOptions) (*LogFile, error) {
+	if options == nil {
+		options = &LogFileOptions{}
+	}
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+	f := &LogFile{
+		directory: directory,
+		options:   options,
+		// Until a logger is set, which may write to this file
+		logger: slog.New(slog.NewTextHandler(os.Stderr, nil)),
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Name returns the path of the file currently being written.
+func (f *LogFile) Name() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Name()
+}
+
+func (f *LogFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.shouldRotate(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// SetLogger sets the logger reporting failures of background compression and pruning, which otherwise are written to stderr.
+func (f *LogFile) SetLogger(logger *slog.Logger) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.logger = logger
+}
+
+// Rotate closes the current file and opens a new one.
+func (f *LogFile) Rotate() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.rotate()
+}
+
+// Close closes the current file and waits for any rotated files to be compressed.
+func (f *LogFile) Close() error {
+	f.mutex.Lock()
+	err := f.file.Close()
+	f.mutex.Unlock()
+	f.group.Wait()
+	return err
+}
+
+func (f *LogFile) shouldRotate(n int64) bool {
+	if f.options.MaxSize > 0 && f.size > 0 && f.size+n > f.options.MaxSize {
+		return true
+	}
+	if f.options.Interval > 0 && !f.options.Now().Before(f.rotation) {
+		return true
+	}
+	return false
+}
+
+func (f *LogFile) open() error {
+	now := f.options.Now().UTC()
+	name := filepath.Join(f.directory, now.Format(time.RFC3339))
+	if _, err := os.Stat(name); err == nil {
+		// Avoid appending to a file rotated within the same second
+		name = filepath.Join(f.directory, now.Format(time.RFC3339Nano))
+	}
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	if f.options.Interval > 0 {
+		f.rotation = now.Truncate(f.options.Interval).Add(f.options.Interval)
+	}
+	return nil
+}
+
+func (f *LogFile) rotate() error {
+	previous := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	if err := previous.Close(); err != nil {
+		return err
+	}
+	logger := f.logger
+	f.group.Add(1)
+	go func() {
+		defer f.group.Done()
+		f.background.Lock()
+		defer f.background.Unlock()
+		if f.options.Compress {
+			if err := compressLogFile(previous.Name()); err != nil {
+				logger.Error("Log Compression Failed", "file", previous.Name(), "error", err)
+			}
+		}
+		if err := f.prune(); err != nil {
+			logger.Error("Log Retention Failed", "error", err)
+		}
+	}()
+	return nil
+}
+
+// prune deletes rotated files exceeding the retention options.
+func (f *LogFile) prune() error {
+	if f.options.MaxAge <= 0 && f.options.MaxCount <= 0 {
+		return nil
+	}
+	current := f.Name()
+	entries, err := os.ReadDir(f.directory)
+	if err != nil {
+		return err
+	}
+	type rotated struct {
+		name string
+		time time.Time
+	}
+	var files []*rotated
+	for _, e := range entries {
+		name := filepath.Join(f.directory, e.Name())
+		if e.IsDir() || name == current {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, strings.TrimSuffix(e.Name(), COMPRESSED_SUFFIX))
+		if err != nil {
+			// Not a log file
+			continue
+		}
+		files = append(files, &rotated{name, t})
+	}
+	// Newest first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].time.After(files[j].time)
+	})
+	limit := f.options.Now().Add(-f.options.MaxAge)
+	for i, r := range files {
+		if (f.options.MaxCount > 0 && i >= f.options.MaxCount) || (f.options.MaxAge > 0 && r.time.Before(limit)) {
+			if err := os.Remove(r.name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compressLogFile gzips the named file, replacing it with name.gz
+func compressLogFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// Write to a hidden temporary file so a partial file is never mistaken for a log
+	temp := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+COMPRESSED_SUFFIX)
+	out, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(out)
+	writer.Name = filepath.Base(name)
+	if _, err := io.Copy(writer, in); err != nil {
+		out.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		out.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	if err := os.Rename(temp, name+COMPRESSED_SUFFIX); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netgo_test
+
+import (
+	"aletheiaware.com/netgo"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *testClock) Set(t time.Time) {
+	c.mutex.Lock()
+	c.now = t
+	c.mutex.Unlock()
+}
+
+func listLogFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func writeLog(t *testing.T, f *netgo.LogFile, s string) {
+	t.Helper()
+	if _, err := f.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogFile(t *testing.T) {
+	t.Run("Size", func(t *testing.T) {
+		dir := t.TempDir()
+		clock := &testClock{now: time.Date(2022, 3, 4, 12, 0, 0, 0, time.UTC)}
+		f, err := netgo.OpenLogFile(dir, &netgo.LogFileOptions{
+			MaxSize: 10,
+			Now:     clock.Now,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeLog(t, f, "12345678\n")
+		clock.Set(clock.Now().Add(time.Second))
+		writeLog(t, f, "12345678\n")
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"2022-03-04T12:00:00Z", "2022-03-04T12:00:01Z"}
+		if actual := listLogFiles(t, dir); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("Incorrect files; expected '%v', got '%v'", expected, actual)
+		}
+	})
+	t.Run("Interval", func(t *testing.T) {
+		dir := t.TempDir()
+		clock := &testClock{now: time.Date(2022, 3, 4, 23, 59, 0, 0, time.UTC)}
+		f, err := netgo.OpenLogFile(dir, &netgo.LogFileOptions{
+			Interval: 24 * time.Hour,
+			Now:      clock.Now,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeLog(t, f, "before midnight\n")
+		clock.Set(clock.Now().Add(30 * time.Second))
+		writeLog(t, f, "still before midnight\n")
+		clock.Set(time.Date(2022, 3, 5, 0, 0, 0, 0, time.UTC))
+		writeLog(t, f, "after midnight\n")
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"2022-03-04T23:59:00Z", "2022-03-05T00:00:00Z"}
+		if actual := listLogFiles(t, dir); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("Incorrect files; expected '%v', got '%v'", expected, actual)
+		}
+	})
+	t.Run("Compress", func(t *testing.T) {
+		dir := t.TempDir()
+		clock := &testClock{now: time.Date(2022, 3, 4, 12, 0, 0, 0, time.UTC)}
+		f, err := netgo.OpenLogFile(dir, &netgo.LogFileOptions{
+			Compress: true,
+			Now:      clock.Now,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeLog(t, f, "hello\n")
+		clock.Set(clock.Now().Add(time.Hour))
+		if err := f.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"2022-03-04T12:00:00Z.gz", "2022-03-04T13:00:00Z"}
+		if actual := listLogFiles(t, dir); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("Incorrect files; expected '%v', got '%v'", expected, actual)
+		}
+		in, err := os.Open(filepath.Join(dir, "2022-03-04T12:00:00Z.gz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer in.Close()
+		reader, err := gzip.NewReader(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "hello\n" {
+			t.Errorf("Incorrect content; expected 'hello\\n', got '%s'", content)
+		}
+	})
+	t.Run("Logger", func(t *testing.T) {
+		dir := t.TempDir()
+		// Compression fails as the temporary file cannot be created
+		if err := os.Mkdir(filepath.Join(dir, ".2022-03-04T12:00:00Z.gz"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		clock := &testClock{now: time.Date(2022, 3, 4, 12, 0, 0, 0, time.UTC)}
+		f, err := netgo.OpenLogFile(dir, &netgo.LogFileOptions{
+			Compress: true,
+			Now:      clock.Now,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buffer bytes.Buffer
+		f.SetLogger(slog.New(slog.NewTextHandler(&buffer, nil)))
+		clock.Set(clock.Now().Add(time.Hour))
+		if err := f.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(buffer.Bytes(), []byte("Log Compression Failed")) {
+			t.Errorf("Failure not logged; got '%s'", buffer.String())
+		}
+	})
+	t.Run("Retention", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		clock := &testClock{now: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)}
+		f, err := netgo.OpenLogFile(dir, &netgo.LogFileOptions{
+			MaxAge:   72 * time.Hour,
+			MaxCount: 2,
+			Now:      clock.Now,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			clock.Set(clock.Now().Add(24 * time.Hour))
+			if err := f.Rotate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// Current file and two most recent rotated files are kept, other files are untouched
+		expected := []string{"2022-03-04T00:00:00Z", "2022-03-05T00:00:00Z", "2022-03-06T00:00:00Z", "notes.txt"}
+		if actual := listLogFiles(t, dir); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("Incorrect files; expected '%v', got '%v'", expected, actual)
+		}
+	})
+}
@@ -18,6 +18,8 @@ package netgo_test
 
 import (
 	"aletheiaware.com/netgo"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -31,7 +33,7 @@ func TestHTTPSRedirect(t *testing.T) {
 
 		netgo.HTTPSRedirect("", map[string]bool{
 			"/foo/bar": true,
-		})(response, request)
+		}, slog.New(slog.NewTextHandler(io.Discard, nil)))(response, request)
 
 		if response.Code != http.StatusTemporaryRedirect {
 			t.Errorf("Wrong response code; expected 300, got '%s'", http.StatusText(response.Code))
@@ -48,7 +50,7 @@ func TestHTTPSRedirect(t *testing.T) {
 		request, _ := http.NewRequest(http.MethodGet, "/foo/bar", nil)
 		response := httptest.NewRecorder()
 
-		netgo.HTTPSRedirect("", map[string]bool{})(response, request)
+		netgo.HTTPSRedirect("", map[string]bool{}, slog.New(slog.NewTextHandler(io.Discard, nil)))(response, request)
 
 		if response.Code != http.StatusNotFound {
 			t.Errorf("Wrong response code; expected 404, got '%s'", http.StatusText(response.Code))
@@ -17,19 +17,35 @@
 package netgo
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
+	"os"
 	"strconv"
 	"strings"
 )
 
-func ParseInt(s string) int64 {
+func ParseInt(s string, logger *slog.Logger) int64 {
 	s = strings.TrimSpace(s)
 	if s != "" {
 		if i, err := strconv.ParseInt(s, 10, 64); err != nil {
-			log.Println(err)
+			logger.Warn("Invalid Integer", "error", err)
 		} else {
 			return int64(i)
 		}
 	}
 	return 0
 }
+
+// envInt returns the integer in the named environment variable, or 0 if it is unset or empty.
+// Environment variables are read while the logger is set up, so an invalid integer is returned as an error rather than logged.
+func envInt(name string) (int64, error) {
+	s := strings.TrimSpace(os.Getenv(name))
+	if s == "" {
+		return 0, nil
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s: %w", name, err)
+	}
+	return i, nil
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netgo
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// RequestRecord is a request as logged, parsed and served.
+type RequestRecord struct {
+	Time time.Time
+	// Source of the entry, such as the entry type or the legacy file:line prefix
+	Source string
+	// Client IP, which may be anonymised
+	IP       string
+	Port     int
+	Protocol string
+	Method   string
+	Host     string
+	URL      *url.URL
+	Header   http.Header
+}
+
+// NewRequestRecord creates a record of the request received at the given time, with the client address anonymised by LogAnonymiser and headers redacted by LogRedaction.
+func NewRequestRecord(r *http.Request, t time.Time) *RequestRecord {
+	ip, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	p, _ := strconv.Atoi(port)
+	return &RequestRecord{
+		Time:     t,
+		Source:   REQUEST_LOG,
+		IP:       LogAnonymiser.AnonymiseIP(ip, t),
+		Port:     p,
+		Protocol: r.Proto,
+		Method:   r.Method,
+		Host:     r.Host,
+		URL:      r.URL,
+		Header:   LogRedaction.RedactHeader(r.Header),
+	}
+}
+
+// Address returns the client IP and port joined as host:port.
+func (r *RequestRecord) Address() string {
+	return net.JoinHostPort(r.IP, strconv.Itoa(r.Port))
+}
+
+// Attrs returns the attributes logged for the record.
+func (r *RequestRecord) Attrs() []slog.Attr {
+	return []slog.Attr{
+		slog.String("address", r.Address()),
+		slog.String("protocol", r.Protocol),
+		slog.String("method", r.Method),
+		slog.String("host", r.Host),
+		slog.String("url", r.urlString()),
+		slog.Any("headers", r.Header),
+	}
+}
+
+func (r *RequestRecord) urlString() string {
+	if r.URL == nil {
+		return ""
+	}
+	return r.URL.String()
+}
+
+// jsonRequestRecord is the JSON encoding of a RequestRecord.
+// Timestamp is in seconds since the epoch, and Time preserves sub-second precision.
+type jsonRequestRecord struct {
+	Timestamp int64       `json:"timestamp"`
+	Time      time.Time   `json:"time"`
+	Source    string      `json:"source,omitempty"`
+	Address   string      `json:"address"`
+	Port      int         `json:"port,omitempty"`
+	Protocol  string      `json:"protocol"`
+	Method    string      `json:"method"`
+	Host      string      `json:"host"`
+	URL       string      `json:"url"`
+	Headers   http.Header `json:"headers,omitempty"`
+}
+
+func (r *RequestRecord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonRequestRecord{
+		Timestamp: r.Time.Unix(),
+		Time:      r.Time,
+		Source:    r.Source,
+		Address:   r.IP,
+		Port:      r.Port,
+		Protocol:  r.Protocol,
+		Method:    r.Method,
+		Host:      r.Host,
+		URL:       r.urlString(),
+		Headers:   r.Header,
+	})
+}
+
+func (r *RequestRecord) UnmarshalJSON(data []byte) error {
+	var j jsonRequestRecord
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	u, err := url.Parse(j.URL)
+	if err != nil {
+		return err
+	}
+	t := j.Time
+	if t.IsZero() {
+		t = time.Unix(j.Timestamp, 0)
+	}
+	*r = RequestRecord{
+		Time:     t,
+		Source:   j.Source,
+		IP:       j.Address,
+		Port:     j.Port,
+		Protocol: j.Protocol,
+		Method:   j.Method,
+		Host:     j.Host,
+		URL:      u,
+		Header:   j.Headers,
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netgo
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	LOG_REDACT_HEADERS = "LOG_REDACT_HEADERS"
+	LOG_REDACT_MODE    = "LOG_REDACT_MODE"
+	LOG_REDACT_KEY     = "LOG_REDACT_KEY"
+)
+
+const REDACTED = "REDACTED"
+
+// HASH_PREFIX precedes the hex digest recorded in place of a value hashed by REDACT_HASH.
+const HASH_PREFIX = "HMAC-"
+
+// HASH_LENGTH is the number of hex characters in a digest recorded by REDACT_HASH.
+const HASH_LENGTH = 32
+
+type RedactionMode int
+
+const (
+	// Remove the header entirely
+	REDACT_DROP RedactionMode = iota
+	// Replace the value with REDACTED
+	REDACT_MASK
+	// Replace the value with a keyed hash so equal values remain correlatable
+	REDACT_HASH
+)
+
+// DefaultRedactedHeaders lists headers which commonly carry credentials.
+var DefaultRedactedHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+	"X-Csrf-Token",
+	"X-Xsrf-Token",
+}
+
+// LogRedaction is the policy applied to headers by LogRequest.
+var LogRedaction = DefaultRedactionPolicy()
+
+func ParseRedactionMode(s string) (RedactionMode, error) {
+	switch strings.ToLower(s) {
+	case "drop":
+		return REDACT_DROP, nil
+	case "mask":
+		return REDACT_MASK, nil
+	case "hash":
+		return REDACT_HASH, nil
+	default:
+		return 0, fmt.Errorf("Unrecognized Redaction Mode: %s", s)
+	}
+}
+
+// RedactionPolicy controls how the values of sensitive headers are recorded.
+type RedactionPolicy struct {
+	Mode    RedactionMode
+	Headers map[string]bool
+	Key     []byte
+}
+
+func NewRedactionPolicy(mode RedactionMode, headers []string, key []byte) (*RedactionPolicy, error) {
+	if mode == REDACT_HASH && len(key) == 0 {
+		return nil, errors.New("Redaction Hash Requires Key")
+	}
+	p := &RedactionPolicy{
+		Mode:    mode,
+		Headers: make(map[string]bool),
+		Key:     key,
+	}
+	for _, h := range headers {
+		h = strings.TrimSpace(h)
+		if h != "" {
+			p.Headers[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+	return p, nil
+}
+
+// DefaultRedactionPolicy masks the DefaultRedactedHeaders.
+func DefaultRedactionPolicy() *RedactionPolicy {
+	p, _ := NewRedactionPolicy(REDACT_MASK, DefaultRedactedHeaders, nil)
+	return p
+}
+
+// RedactionPolicyFromEnv creates a policy from the LOG_REDACT_HEADERS (comma-separated, empty to disable), LOG_REDACT_MODE (drop, mask, or hash), and LOG_REDACT_KEY environment variables, falling back to the default policy.
+func RedactionPolicyFromEnv() (*RedactionPolicy, error) {
+	headers := DefaultRedactedHeaders
+	if h, ok := os.LookupEnv(LOG_REDACT_HEADERS); ok {
+		headers = strings.Split(h, ",")
+	}
+	mode := REDACT_MASK
+	if m, ok := os.LookupEnv(LOG_REDACT_MODE); ok {
+		var err error
+		mode, err = ParseRedactionMode(m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewRedactionPolicy(mode, headers, []byte(os.Getenv(LOG_REDACT_KEY)))
+}
+
+// Redacts returns true if the given header is covered by the policy.
+func (p *RedactionPolicy) Redacts(key string) bool {
+	return p.Headers[http.CanonicalHeaderKey(key)]
+}
+
+// RedactValue returns the value to record in place of the given value.
+func (p *RedactionPolicy) RedactValue(value string) string {
+	switch p.Mode {
+	case REDACT_HASH:
+		mac := hmac.New(sha256.New, p.Key)
+		mac.Write([]byte(value))
+		return HASH_PREFIX + hex.EncodeToString(mac.Sum(nil)[:HASH_LENGTH/2])
+	default:
+		return REDACTED
+	}
+}
+
+// RedactHeader returns a copy of the header with sensitive values redacted.
+func (p *RedactionPolicy) RedactHeader(header http.Header) http.Header {
+	result := make(http.Header, len(header))
+	for k, vs := range header {
+		if !p.Redacts(k) {
+			result[k] = vs
+			continue
+		}
+		if p.Mode == REDACT_DROP {
+			continue
+		}
+		rs := make([]string, len(vs))
+		for i, v := range vs {
+			rs[i] = p.redact(v)
+		}
+		result[k] = rs
+	}
+	return result
+}
+
+// RedactHeaders returns a copy of the parsed headers with sensitive values redacted.
+func (p *RedactionPolicy) RedactHeaders(headers map[string]string) map[string]string {
+	result := make(map[string]string, len(headers))
+	for k, v := range headers {
+		if !p.Redacts(k) {
+			result[k] = v
+			continue
+		}
+		if p.Mode == REDACT_DROP {
+			continue
+		}
+		result[k] = p.redact(v)
+	}
+	return result
+}
+
+// redact returns the value to record in place of the given value.
+// When hashing, a value which is exactly a hash is kept, so a value hashed when it was logged matches the same value hashed when parsed from a log written in plain text.
+// Any other value is redacted, including one which only looks redacted.
+func (p *RedactionPolicy) redact(value string) string {
+	if p.Mode == REDACT_HASH && isHash(value) {
+		return value
+	}
+	return p.RedactValue(value)
+}
+
+// isHash returns true if the value has the prefix and lower case hex digest of a value hashed by REDACT_HASH.
+func isHash(value string) bool {
+	digest, ok := strings.CutPrefix(value, HASH_PREFIX)
+	if !ok || len(digest) != HASH_LENGTH {
+		return false
+	}
+	for _, c := range digest {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
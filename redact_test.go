@@ -0,0 +1,103 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netgo_test
+
+import (
+	"aletheiaware.com/netgo"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedactionPolicy(t *testing.T) {
+	header := http.Header{
+		"Accept":        []string{"text/html"},
+		"Authorization": []string{"Basic YWxpY2U6c2VjcmV0"},
+		"Cookie":        []string{"session=1", "theme=dark"},
+	}
+	t.Run("Drop", func(t *testing.T) {
+		p, err := netgo.NewRedactionPolicy(netgo.REDACT_DROP, netgo.DefaultRedactedHeaders, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := http.Header{
+			"Accept": []string{"text/html"},
+		}
+		if actual := p.RedactHeader(header); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("Incorrect header; expected '%v', got '%v'", expected, actual)
+		}
+	})
+	t.Run("Mask", func(t *testing.T) {
+		p := netgo.DefaultRedactionPolicy()
+		expected := http.Header{
+			"Accept":        []string{"text/html"},
+			"Authorization": []string{netgo.REDACTED},
+			"Cookie":        []string{netgo.REDACTED, netgo.REDACTED},
+		}
+		if actual := p.RedactHeader(header); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("Incorrect header; expected '%v', got '%v'", expected, actual)
+		}
+		if header.Get("Authorization") != "Basic YWxpY2U6c2VjcmV0" {
+			t.Errorf("Original header modified")
+		}
+	})
+	t.Run("Hash", func(t *testing.T) {
+		if _, err := netgo.NewRedactionPolicy(netgo.REDACT_HASH, netgo.DefaultRedactedHeaders, nil); err == nil {
+			t.Errorf("Expected error for missing key")
+		}
+		p, err := netgo.NewRedactionPolicy(netgo.REDACT_HASH, []string{"authorization"}, []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := p.RedactHeader(header)
+		value := actual.Get("Authorization")
+		if !strings.HasPrefix(value, "HMAC-") || strings.Contains(value, "YWxpY2U6c2VjcmV0") {
+			t.Errorf("Incorrect hash; got '%s'", value)
+		}
+		if again := p.RedactHeader(header).Get("Authorization"); again != value {
+			t.Errorf("Hash not stable; expected '%s', got '%s'", value, again)
+		}
+		if actual.Get("Cookie") != "session=1" {
+			t.Errorf("Unexpected redaction of Cookie")
+		}
+		// Values hashed when logged are kept when parsed, so they match the same values parsed from plain text
+		if parsed := p.RedactHeader(http.Header{"Authorization": []string{value}}).Get("Authorization"); parsed != value {
+			t.Errorf("Hashed value not correlatable; expected '%s', got '%s'", value, parsed)
+		}
+		if parsed := p.RedactHeaders(map[string]string{"Authorization": value}); parsed["Authorization"] != value {
+			t.Errorf("Hashed value not correlatable; expected '%s', got '%s'", value, parsed["Authorization"])
+		}
+		if parsed := p.RedactHeaders(map[string]string{"Authorization": "Basic YWxpY2U6c2VjcmV0"}); parsed["Authorization"] != value {
+			t.Errorf("Incorrect parsed header; expected '%s', got '%s'", value, parsed["Authorization"])
+		}
+		// Values which only look hashed are hashed
+		for _, v := range []string{
+			"HMAC-0000",
+			"HMAC-0000000000000000000000000000000g",
+			"HMAC-ABCDEF00000000000000000000000000",
+			"HMAC-000000000000000000000000000000000",
+		} {
+			if parsed := p.RedactHeaders(map[string]string{"Authorization": v}); parsed["Authorization"] == v || !strings.HasPrefix(parsed["Authorization"], "HMAC-") {
+				t.Errorf("Incorrect parsed header; expected hash of '%s', got '%s'", v, parsed["Authorization"])
+			}
+			if redacted := p.RedactHeader(http.Header{"Authorization": []string{v}}).Get("Authorization"); redacted == v {
+				t.Errorf("Incorrect header; expected hash of '%s', got '%s'", v, redacted)
+			}
+		}
+	})
+}
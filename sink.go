@@ -0,0 +1,446 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LOG_SINKS       = "LOG_SINKS"
+	LOG_SINK_BUFFER = "LOG_SINK_BUFFER"
+)
+
+const (
+	// Default number of entries buffered by each sink
+	DEFAULT_SINK_BUFFER = 1024
+	// Default maximum number of entries sent by the HTTP sink in one request
+	DEFAULT_SINK_BATCH = 100
+	// Default location of the journald native protocol socket
+	JOURNALD_SOCKET = "/run/systemd/journal/socket"
+	// Syslog facility used for all entries (daemon)
+	SYSLOG_FACILITY = 3
+)
+
+// Sink receives log entries, each written as a single JSON line.
+type Sink interface {
+	io.Writer
+	io.Closer
+}
+
+// Flusher is implemented by sinks which batch entries, Flush is called whenever the sink's buffer has been drained.
+// Sinks which batch entries return a *BatchError when a batch fails, so the entries lost are counted.
+type Flusher interface {
+	Flush() error
+}
+
+// BatchError is returned by sinks which batch entries when a batch fails to be written.
+type BatchError struct {
+	// Number of entries in the batch
+	Count int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("Batch of %d Entries Failed: %s", e.Count, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// failedEntries returns the number of entries lost by the error of a write or flush.
+func failedEntries(err error) uint64 {
+	var b *BatchError
+	if errors.As(err, &b) {
+		return uint64(b.Count)
+	}
+	return 1
+}
+
+// ParseSink creates a sink from a URL;
+//   - syslog+udp://host:port, syslog+tcp://host:port, syslog+unix:///dev/log - RFC 5424 syslog
+//   - journald, journald:///path/to/socket - journald native protocol
+//   - http://host/path, https://host/path - HTTP POST of batched JSON lines
+func ParseSink(s, tag string) (Sink, error) {
+	if s == "journald" {
+		return NewJournaldSink(JOURNALD_SOCKET, tag)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "syslog+udp", "syslog+tcp":
+		return NewSyslogSink(strings.TrimPrefix(u.Scheme, "syslog+"), u.Host, tag)
+	case "syslog+unix":
+		return NewSyslogSink("unixgram", u.Path, tag)
+	case "journald":
+		path := u.Path
+		if path == "" {
+			path = JOURNALD_SOCKET
+		}
+		return NewJournaldSink(path, tag)
+	case "http", "https":
+		return NewHTTPSink(s, DEFAULT_SINK_BATCH), nil
+	}
+	return nil, fmt.Errorf("Unrecognized Log Sink: %s", s)
+}
+
+// SinksFromEnv creates buffered sinks for each of the comma-separated URLs in the LOG_SINKS environment variable, each buffering up to LOG_SINK_BUFFER entries.
+func SinksFromEnv() ([]*AsyncSink, error) {
+	value := os.Getenv(LOG_SINKS)
+	if value == "" {
+		return nil, nil
+	}
+	size := DEFAULT_SINK_BUFFER
+	if _, ok := os.LookupEnv(LOG_SINK_BUFFER); ok {
+		b, err := envInt(LOG_SINK_BUFFER)
+		if err != nil {
+			return nil, err
+		}
+		size = int(b)
+	}
+	tag := filepath.Base(os.Args[0])
+	var sinks []*AsyncSink
+	for _, s := range strings.Split(value, ",") {
+		sink, err := ParseSink(strings.TrimSpace(s), tag)
+		if err != nil {
+			for _, a := range sinks {
+				a.Close()
+			}
+			return nil, err
+		}
+		sinks = append(sinks, NewAsyncSink(sink, size))
+	}
+	return sinks, nil
+}
+
+// AsyncSink buffers entries and writes them to the underlying sink in the background, so a slow sink never blocks the caller.
+// Entries are dropped, and counted, when the buffer is full or the sink has been closed.
+type AsyncSink struct {
+	sink    Sink
+	entries chan []byte
+	done    chan struct{}
+	// Held for reading while sending, so entries is only closed once no writer is using it
+	mutex   sync.RWMutex
+	closed  bool
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+}
+
+func NewAsyncSink(sink Sink, size int) *AsyncSink {
+	if size <= 0 {
+		size = DEFAULT_SINK_BUFFER
+	}
+	a := &AsyncSink{
+		sink:    sink,
+		entries: make(chan []byte, size),
+		done:    make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *AsyncSink) Write(p []byte) (int, error) {
+	// The caller may reuse p after Write returns
+	entry := bytes.Clone(p)
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if a.closed {
+		a.dropped.Add(1)
+		return len(p), nil
+	}
+	select {
+	case a.entries <- entry:
+	default:
+		a.dropped.Add(1)
+	}
+	return len(p), nil
+}
+
+// Dropped returns the number of entries discarded because the buffer was full, or because they were written after Close.
+func (a *AsyncSink) Dropped() uint64 {
+	return a.dropped.Load()
+}
+
+// Failed returns the number of entries the underlying sink failed to write.
+func (a *AsyncSink) Failed() uint64 {
+	return a.failed.Load()
+}
+
+// Close writes any buffered entries and closes the underlying sink.
+// Entries written after Close are dropped.
+func (a *AsyncSink) Close() error {
+	a.mutex.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.entries)
+	}
+	a.mutex.Unlock()
+	<-a.done
+	return a.sink.Close()
+}
+
+func (a *AsyncSink) run() {
+	defer close(a.done)
+	flusher, _ := a.sink.(Flusher)
+	for entry := range a.entries {
+		if _, err := a.sink.Write(entry); err != nil {
+			a.failed.Add(failedEntries(err))
+		}
+		if flusher != nil && len(a.entries) == 0 {
+			if err := flusher.Flush(); err != nil {
+				a.failed.Add(failedEntries(err))
+			}
+		}
+	}
+}
+
+// entryLevel returns the level of a JSON log entry, or INFO if it cannot be determined.
+func entryLevel(p []byte) slog.Level {
+	var entry struct {
+		Level slog.Level `json:"level"`
+	}
+	if err := json.Unmarshal(p, &entry); err != nil {
+		return slog.LevelInfo
+	}
+	return entry.Level
+}
+
+// syslogSeverity maps a level to an RFC 5424 severity.
+func syslogSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3 // Error
+	case level >= slog.LevelWarn:
+		return 4 // Warning
+	case level >= slog.LevelInfo:
+		return 6 // Informational
+	default:
+		return 7 // Debug
+	}
+}
+
+// SyslogSink sends entries as RFC 5424 messages, using octet-counting framing over stream connections.
+type SyslogSink struct {
+	network  string
+	address  string
+	tag      string
+	hostname string
+	mutex    sync.Mutex
+	conn     net.Conn
+}
+
+// NewSyslogSink creates a sink sending to a syslog server over the given network; udp, tcp, unix, or unixgram.
+func NewSyslogSink(network, address, tag string) (*SyslogSink, error) {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	s := &SyslogSink{
+		network:  network,
+		address:  address,
+		tag:      tag,
+		hostname: hostname,
+	}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SyslogSink) connect() error {
+	conn, err := net.Dial(s.network, s.address)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *SyslogSink) Write(p []byte) (int, error) {
+	message := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		SYSLOG_FACILITY*8+syslogSeverity(entryLevel(p)),
+		time.Now().UTC().Format(time.RFC3339Nano),
+		s.hostname,
+		s.tag,
+		os.Getpid(),
+		bytes.TrimRight(p, "\n"))
+	if s.network == "tcp" || s.network == "unix" {
+		message = fmt.Sprintf("%d %s", len(message), message)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := io.WriteString(s.conn, message); err != nil {
+		// Reconnect on the next write
+		s.conn.Close()
+		s.conn = nil
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *SyslogSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// JournaldSink sends entries to journald using its native protocol, with the entry as MESSAGE.
+type JournaldSink struct {
+	tag  string
+	conn *net.UnixConn
+	addr *net.UnixAddr
+}
+
+func NewJournaldSink(socket, tag string) (*JournaldSink, error) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &JournaldSink{
+		tag:  tag,
+		conn: conn,
+		addr: &net.UnixAddr{Name: socket, Net: "unixgram"},
+	}, nil
+}
+
+func (s *JournaldSink) Write(p []byte) (int, error) {
+	var b bytes.Buffer
+	writeJournaldField(&b, "MESSAGE", bytes.TrimRight(p, "\n"))
+	writeJournaldField(&b, "PRIORITY", []byte(fmt.Sprint(syslogSeverity(entryLevel(p)))))
+	writeJournaldField(&b, "SYSLOG_IDENTIFIER", []byte(s.tag))
+	if _, err := s.conn.WriteToUnix(b.Bytes(), s.addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *JournaldSink) Close() error {
+	return s.conn.Close()
+}
+
+// writeJournaldField appends a field, using the length-prefixed form if the value contains a newline.
+func writeJournaldField(b *bytes.Buffer, key string, value []byte) {
+	b.WriteString(key)
+	if bytes.IndexByte(value, '\n') < 0 {
+		b.WriteByte('=')
+		b.Write(value)
+	} else {
+		b.WriteByte('\n')
+		binary.Write(b, binary.LittleEndian, uint64(len(value)))
+		b.Write(value)
+	}
+	b.WriteByte('\n')
+}
+
+// HTTPSink collects entries and POSTs them as newline-delimited JSON, in batches of up to the given size.
+type HTTPSink struct {
+	URL    string
+	Client *http.Client
+	size   int
+	mutex  sync.Mutex
+	batch  bytes.Buffer
+	count  int
+}
+
+func NewHTTPSink(url string, size int) *HTTPSink {
+	if size <= 0 {
+		size = DEFAULT_SINK_BATCH
+	}
+	return &HTTPSink{
+		URL: url,
+		Client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		size: size,
+	}
+}
+
+func (s *HTTPSink) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.batch.Write(p)
+	if len(p) == 0 || p[len(p)-1] != '\n' {
+		s.batch.WriteByte('\n')
+	}
+	s.count++
+	if s.count >= s.size {
+		if err := s.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends any collected entries.
+func (s *HTTPSink) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.flush()
+}
+
+func (s *HTTPSink) flush() error {
+	if s.count == 0 {
+		return nil
+	}
+	// Entries are discarded even if the request fails so a down collector cannot exhaust memory
+	body := bytes.NewReader(bytes.Clone(s.batch.Bytes()))
+	count := s.count
+	s.batch.Reset()
+	s.count = 0
+	response, err := s.Client.Post(s.URL, "application/x-ndjson", body)
+	if err != nil {
+		return &BatchError{Count: count, Err: err}
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return &BatchError{Count: count, Err: errors.New(response.Status)}
+	}
+	return nil
+}
+
+func (s *HTTPSink) Close() error {
+	return s.Flush()
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright 2022 Aletheia Ware LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netgo_test
+
+import (
+	"aletheiaware.com/netgo"
+	"bufio"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const sinkEntry = `{"time":"2022-03-04T12:00:00Z","level":"WARN","msg":"blocked"}` + "\n"
+
+var syslogPattern = regexp.MustCompile(`^<28>1 \S+ \S+ test \d+ - - \{"time":"2022-03-04T12:00:00Z","level":"WARN","msg":"blocked"\}$`)
+
+func TestSyslogSink(t *testing.T) {
+	t.Run("UDP", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		sink, err := netgo.ParseSink("syslog+udp://"+conn.LocalAddr().String(), "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sink.Close()
+		if _, err := sink.Write([]byte(sinkEntry)); err != nil {
+			t.Fatal(err)
+		}
+		buffer := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := string(buffer[:n]); !syslogPattern.MatchString(actual) {
+			t.Errorf("Incorrect message; got '%s'", actual)
+		}
+	})
+	t.Run("TCP", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		sink, err := netgo.ParseSink("syslog+tcp://"+listener.Addr().String(), "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sink.Close()
+		if _, err := sink.Write([]byte(sinkEntry)); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		length, err := reader.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := make([]byte, netgo.ParseInt(strings.TrimSpace(length), slog.New(slog.NewTextHandler(io.Discard, nil))))
+		if _, err := io.ReadFull(reader, message); err != nil {
+			t.Fatal(err)
+		}
+		if actual := string(message); !syslogPattern.MatchString(actual) {
+			t.Errorf("Incorrect message; got '%s'", actual)
+		}
+	})
+}
+
+func TestJournaldSink(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sink, err := netgo.ParseSink("journald://"+socket, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if _, err := sink.Write([]byte(sinkEntry)); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "MESSAGE=" + strings.TrimSpace(sinkEntry) + "\nPRIORITY=4\nSYSLOG_IDENTIFIER=test\n"
+	if actual := string(buffer[:n]); actual != expected {
+		t.Errorf("Incorrect datagram; expected '%s', got '%s'", expected, actual)
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	var (
+		mutex   sync.Mutex
+		batches []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		batches = append(batches, string(body))
+		mutex.Unlock()
+	}))
+	defer server.Close()
+	sink := netgo.NewHTTPSink(server.URL, 2)
+	for _, line := range []string{"{\"a\":1}\n", "{\"b\":2}\n", "{\"c\":3}\n"} {
+		if _, err := sink.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(batches) != 2 || batches[0] != "{\"a\":1}\n{\"b\":2}\n" || batches[1] != "{\"c\":3}\n" {
+		t.Errorf("Incorrect batches; got '%q'", batches)
+	}
+}
+
+// blockingSink blocks all writes until released.
+type blockingSink struct {
+	release chan struct{}
+	mutex   sync.Mutex
+	written []string
+}
+
+func (s *blockingSink) Write(p []byte) (int, error) {
+	<-s.release
+	s.mutex.Lock()
+	s.written = append(s.written, string(p))
+	s.mutex.Unlock()
+	return len(p), nil
+}
+
+func (s *blockingSink) Close() error {
+	return nil
+}
+
+func TestAsyncSink(t *testing.T) {
+	blocking := &blockingSink{release: make(chan struct{})}
+	sink := netgo.NewAsyncSink(blocking, 2)
+	logger := netgo.NewLogger(sink, slog.LevelInfo)
+	done := make(chan struct{})
+	go func() {
+		// Writes never block, even though the sink does
+		for i := 0; i < 10; i++ {
+			logger.Info("test", "i", i)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Logger blocked by slow sink")
+	}
+	close(blocking.release)
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// One entry is held by the blocked writer and two are buffered
+	written := len(blocking.written)
+	if written < 2 || written > 3 {
+		t.Errorf("Incorrect written count; got %d", written)
+	}
+	if dropped := sink.Dropped(); int(dropped)+written != 10 {
+		t.Errorf("Incorrect dropped count; expected %d, got %d", 10-written, dropped)
+	}
+}
+
+func TestAsyncSink_Failed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	sink := netgo.NewAsyncSink(netgo.NewHTTPSink(server.URL, 2), 10)
+	for i := 0; i < 5; i++ {
+		sink.Write([]byte(sinkEntry))
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Every entry of each failed batch is counted
+	if failed := sink.Failed(); failed != 5 {
+		t.Errorf("Incorrect failed count; expected 5, got %d", failed)
+	}
+}
+
+func TestAsyncSink_WriteAfterClose(t *testing.T) {
+	blocking := &blockingSink{release: make(chan struct{})}
+	close(blocking.release)
+	sink := netgo.NewAsyncSink(blocking, 2)
+	var group sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for j := 0; j < 100; j++ {
+				sink.Write([]byte(sinkEntry))
+			}
+		}()
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	group.Wait()
+	// Writes racing with, and following, Close are dropped rather than panicking
+	if n, err := sink.Write([]byte(sinkEntry)); n != len(sinkEntry) || err != nil {
+		t.Errorf("Incorrect write; got %d, %v", n, err)
+	}
+	if total := len(blocking.written) + int(sink.Dropped()); total != 401 {
+		t.Errorf("Incorrect total; expected 401, got %d", total)
+	}
+}